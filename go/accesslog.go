@@ -0,0 +1,62 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// accessLogKey marks the context of the session summary lines, which go to
+// ACCESS_LOG_FILE when it is set.
+type accessLogKey struct{}
+
+var accessLogContext = context.WithValue(context.Background(), accessLogKey{}, true)
+
+func isAccessLog(ctx context.Context) bool {
+    return ctx.Value(accessLogKey{}) != nil
+}
+
+// newAccessLog returns the writer of ACCESS_LOG_FILE at path: a new file is
+// started once it reaches maxSize megabytes, and old files beyond
+// maxBackups, or older than maxAge days, are removed. Zero keeps them all.
+func newAccessLog(path string, maxSize, maxBackups, maxAge int) *lumberjack.Logger {
+    return &lumberjack.Logger{
+        Filename:   path,
+        MaxSize:    maxSize,
+        MaxBackups: maxBackups,
+        MaxAge:     maxAge,
+    }
+}
+
+// accessLogHandler sends the records logged with accessLogContext to access
+// and all others, the lifecycle logs, to lifecycle. The attributes of a
+// session's logger, such as conn_id and client_ip, go with its records to
+// whichever of the two they end up in.
+type accessLogHandler struct {
+    lifecycle slog.Handler
+    access    slog.Handler
+}
+
+func (h accessLogHandler) handler(ctx context.Context) slog.Handler {
+    if isAccessLog(ctx) {
+        return h.access
+    }
+    return h.lifecycle
+}
+
+func (h accessLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return h.handler(ctx).Enabled(ctx, level)
+}
+
+func (h accessLogHandler) Handle(ctx context.Context, r slog.Record) error {
+    return h.handler(ctx).Handle(ctx, r)
+}
+
+func (h accessLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return accessLogHandler{h.lifecycle.WithAttrs(attrs), h.access.WithAttrs(attrs)}
+}
+
+func (h accessLogHandler) WithGroup(name string) slog.Handler {
+    return accessLogHandler{h.lifecycle.WithGroup(name), h.access.WithGroup(name)}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestAccessLogFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "access.log")
+    port := closedPort(t)
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    p := startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1", "ACCESS_LOG_FILE="+path)
+    echo := tcpEcho(t)
+    const sessions = 3
+    for range sessions {
+        ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", echo, []byte("ping")))
+        readResponse(t, ws)
+        ws.ReadMessage()
+        ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+        ws.ReadMessage()
+        ws.Close()
+    }
+    out := p.stop()
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+    if len(lines) != sessions {
+        t.Fatalf("%d lines in the access log, want %d: %s", len(lines), sessions, data)
+    }
+    for _, line := range lines {
+        var record map[string]any
+        if err := json.Unmarshal(line, &record); err != nil || record["msg"] != "Session ended" ||
+            record["target"] != fmt.Sprintf("127.0.0.1:%d", echo) || record["conn_id"] == nil {
+            t.Errorf("access log line %s", line)
+        }
+    }
+    // The lifecycle logs stay on stderr, without the summaries.
+    if strings.Contains(out, "Session ended") || outputRecord(out, "Server stopped") == nil {
+        t.Errorf("stderr: %s", out)
+    }
+}
+
+func TestAccessLogRotation(t *testing.T) {
+    dir := t.TempDir()
+    w := newAccessLog(filepath.Join(dir, "access.log"), 1, 1, 0)
+    defer w.Close()
+    line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+    for range 3 * 1024 {
+        if _, err := w.Write(line); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // The current file and the one backup kept; lumberjack removes the
+    // others in the background.
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        entries, _ := os.ReadDir(dir)
+        if len(entries) == 2 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d files after rotating, want 2", len(entries))
+        }
+    }
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "sync/atomic"
+)
+
+// adminToken is the bearer token that authorizes the /admin/ endpoints,
+// which are not served at all when it is empty.
+var adminToken string
+
+// quiesced is set by /admin/quiesce. While it is set new proxy sessions are
+// refused with 503, as during shutdown, but the running ones continue and
+// the process keeps serving until /admin/resume clears it.
+var quiesced atomic.Bool
+
+func registerAdmin(mux *http.ServeMux) {
+    mux.HandleFunc("POST /admin/quiesce", adminHandler(func() {
+        quiesced.Store(true)
+        slog.Info("Quiesced, refusing new sessions", "active_connections", activeConnections.Load())
+    }))
+    mux.HandleFunc("POST /admin/resume", adminHandler(func() {
+        quiesced.Store(false)
+        slog.Info("Resumed accepting new sessions")
+    }))
+}
+
+// adminHandler runs action for callers presenting ADMIN_TOKEN.
+func adminHandler(action func()) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !validBearerToken(r, adminToken) {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        action()
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestQuiesce(t *testing.T) {
+    setVar(t, &adminToken, "secret")
+    t.Cleanup(func() { quiesced.Store(false) })
+    srv := newTestHandlerServer(t)
+    port := tcpEcho(t)
+    admin := func(action, token string) int {
+        t.Helper()
+        req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/"+action, nil)
+        req.Header.Set("Authorization", "Bearer "+token)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+    upgrade := func() (*websocket.Conn, *http.Response, error) {
+        return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+    }
+
+    running := dialProxy(t, srv, "/")
+    running.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, running)
+
+    if status := admin("quiesce", "wrong"); status != http.StatusUnauthorized {
+        t.Errorf("wrong token: got %d", status)
+    }
+    if status := admin("quiesce", "secret"); status != http.StatusNoContent {
+        t.Fatalf("quiesce: got %d", status)
+    }
+    if _, resp, err := upgrade(); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("upgrade while quiesced: got %v, %v", resp, err)
+    }
+    running.WriteMessage(websocket.BinaryMessage, []byte("ping"))
+    if _, message, err := running.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Errorf("running session: got %q, %v", message, err)
+    }
+
+    if status := admin("resume", "secret"); status != http.StatusNoContent {
+        t.Fatalf("resume: got %d", status)
+    }
+    ws, _, err := upgrade()
+    if err != nil {
+        t.Fatalf("upgrade after resume: %v", err)
+    }
+    ws.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "io"
+
+    "golang.org/x/time/rate"
+)
+
+// rateBPS is RATE_BPS, the bytes per second each direction of a session may
+// carry, or 0 for no limit.
+var rateBPS int
+
+// globalRateBPS is GLOBAL_RATE_BPS, the bytes per second all sessions
+// together may carry, or 0 for no limit. globalLimiter, shared by every
+// pump, enforces it.
+var (
+    globalRateBPS int
+    globalLimiter *rate.Limiter
+)
+
+// newBandwidthLimiter returns a limiter of bps bytes per second. The burst
+// is at most one second's worth, so that the limit cannot be exceeded by
+// more than that.
+func newBandwidthLimiter(bps int) *rate.Limiter {
+    return rate.NewLimiter(rate.Limit(bps), min(bps, bufferSize))
+}
+
+// throttledReader holds back the reads from r so that they come to no more
+// than each of limiters allows; the tightest of them sets the pace. Each
+// read is cut to the smallest burst, and waits for its bytes once they have
+// been read, so the pump does not read again, and the sender is held back
+// by the connection's flow control, until they are allowed.
+type throttledReader struct {
+    r        io.Reader
+    limiters []*rate.Limiter
+    burst    int
+}
+
+// newSessionThrottle returns r limited to RATE_BPS and GLOBAL_RATE_BPS, or
+// r itself when there is no limit.
+func newSessionThrottle(r io.Reader) io.Reader {
+    var limiters []*rate.Limiter
+    if rateBPS > 0 {
+        limiters = append(limiters, newBandwidthLimiter(rateBPS))
+    }
+    if globalLimiter != nil {
+        limiters = append(limiters, globalLimiter)
+    }
+    if limiters == nil {
+        return r
+    }
+    t := &throttledReader{r: r, limiters: limiters, burst: limiters[0].Burst()}
+    for _, l := range limiters {
+        t.burst = min(t.burst, l.Burst())
+    }
+    return t
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+    if len(p) > t.burst {
+        p = p[:t.burst]
+    }
+    n, err := t.r.Read(p)
+    if n > 0 {
+        for _, l := range t.limiters {
+            l.WaitN(context.Background(), n)
+        }
+    }
+    return n, err
+}
+
+// packetThrottle holds back datagrams so that they come to no more than
+// RATE_BPS and GLOBAL_RATE_BPS allow. Unlike throttledReader it never cuts
+// what it passes on: a packet is waited for whole before it is written, a
+// burst at a time when it is larger than one.
+type packetThrottle struct {
+    limiters []*rate.Limiter
+}
+
+// newPacketThrottle returns the throttle of one direction of a UDP
+// session, or nil when there is no limit.
+func newPacketThrottle() *packetThrottle {
+    var limiters []*rate.Limiter
+    if rateBPS > 0 {
+        limiters = append(limiters, newBandwidthLimiter(rateBPS))
+    }
+    if globalLimiter != nil {
+        limiters = append(limiters, globalLimiter)
+    }
+    if limiters == nil {
+        return nil
+    }
+    return &packetThrottle{limiters: limiters}
+}
+
+// wait returns once a packet of n bytes may be written.
+func (t *packetThrottle) wait(n int) {
+    if t == nil {
+        return
+    }
+    for _, l := range t.limiters {
+        for left := n; left > 0; {
+            k := min(left, l.Burst())
+            l.WaitN(context.Background(), k)
+            left -= k
+        }
+    }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// download has a target send size bytes to a client of srv and returns
+// once they have all arrived.
+func download(t testing.TB, srv *httptest.Server, port uint16, size int) {
+    t.Helper()
+    ws := dialProxy(t, srv, "/")
+    ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    for got := 0; got < size; {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Errorf("after %d of %d bytes: %v", got, size, err)
+            return
+        }
+        got += len(message)
+    }
+}
+
+// udpTransfer sends size bytes in packets through a UDP session of srv to
+// the echo target at port, starting with one larger than the limiters'
+// burst, and returns once they have all come back whole.
+func udpTransfer(t testing.TB, srv *httptest.Server, port uint16, size int) {
+    t.Helper()
+    ws := dialProxy(t, srv, "/")
+    ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandUDP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    var sizes []int
+    for left, n := size, bufferSize+1000; left > 0; left, n = left-n, 1000 {
+        n = min(n, left)
+        sizes = append(sizes, n)
+        ws.WriteMessage(websocket.BinaryMessage, udpPacket(strings.Repeat("x", n)))
+    }
+    for _, want := range sizes {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Errorf("waiting for a packet of %d bytes: %v", want, err)
+            return
+        }
+        if len(message) != 2+want || int(binary.BigEndian.Uint16(message)) != want {
+            t.Errorf("got a packet of %d bytes, want %d", len(message)-2, want)
+        }
+    }
+}
+
+// sender is a target that sends size bytes to every connection.
+func sender(t testing.TB, size int) uint16 {
+    data := bytes.Repeat([]byte("x"), size)
+    return tcpServer(t, func(conn net.Conn) { conn.Write(data) })
+}
+
+// checkDuration reports an error unless elapsed is close to want.
+func checkDuration(t testing.TB, elapsed, want time.Duration) {
+    t.Helper()
+    if elapsed < want*85/100 || elapsed > want*3/2 {
+        t.Errorf("took %v, want about %v", elapsed, want)
+    }
+}
+
+func TestRateBPS(t *testing.T) {
+    const bps = 400_000
+    setVar(t, &rateBPS, bps)
+    srv := newTestServer(t)
+    // After the first burst, a second's worth at the limit.
+    size := bufferSize + bps
+    port := sender(t, size)
+
+    start := time.Now()
+    download(t, srv, port, size)
+    checkDuration(t, time.Since(start), time.Second)
+
+    // Each packet of a UDP session is held back whole, as much as each
+    // direction's limit asks; up and down overlap.
+    start = time.Now()
+    udpTransfer(t, srv, udpEcho(t), size)
+    checkDuration(t, time.Since(start), time.Second)
+}
+
+func TestGlobalRateBPS(t *testing.T) {
+    const bps = 400_000
+    setVar(t, &globalLimiter, newBandwidthLimiter(bps))
+    // The looser per-session limit leaves the global one to set the pace.
+    setVar(t, &rateBPS, 4*bps)
+    srv := newTestServer(t)
+    // Together, after the first burst, a second's worth at the cap.
+    size := (bufferSize + bps) / 2
+    port := sender(t, size)
+
+    start := time.Now()
+    var wg sync.WaitGroup
+    for range 2 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            download(t, srv, port, size)
+        }()
+    }
+    wg.Wait()
+    checkDuration(t, time.Since(start), time.Second)
+
+    // A UDP session beside a TCP one shares the cap as well. Its packets
+    // count against it on the way up and again on the way back.
+    echo := udpEcho(t)
+    start = time.Now()
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        download(t, srv, port, size)
+    }()
+    go func() {
+        defer wg.Done()
+        udpTransfer(t, srv, echo, size/2)
+    }()
+    wg.Wait()
+    checkDuration(t, time.Since(start), time.Second)
+
+    // Under a tighter per-session limit, that one applies.
+    setVar(t, &rateBPS, bps/2)
+    start = time.Now()
+    download(t, srv, port, size)
+    checkDuration(t, time.Since(start), time.Duration(size-bufferSize)*time.Second/(bps/2))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "io"
+    "sync"
+    "time"
+)
+
+// coalescingWriter gathers the target's data for up to window before
+// writing it on as one message, so that a target sending many small
+// segments does not cost a WebSocket frame each. At most MAX_INFLIGHT bytes
+// are held: a write that would go beyond it first waits for the buffered
+// data to be written out, which holds the pump back from reading more of
+// the target's data, and a write that fills the buffer is passed on at
+// once.
+type coalescingWriter struct {
+    w      io.Writer
+    window time.Duration
+
+    mu    sync.Mutex
+    buf   []byte
+    timer *time.Timer
+    err   error
+}
+
+func newCoalescingWriter(w io.Writer, window time.Duration) *coalescingWriter {
+    return &coalescingWriter{w: w, window: window, buf: make([]byte, 0, maxInflight)}
+}
+
+// Write buffers p. An error from writing out earlier data is returned by
+// the next Write.
+func (c *coalescingWriter) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.err != nil {
+        return 0, c.err
+    }
+    if len(c.buf)+len(p) > maxInflight {
+        if err := c.flushLocked(); err != nil {
+            return 0, err
+        }
+    }
+    c.buf = append(c.buf, p...)
+    if len(c.buf) >= maxInflight {
+        return len(p), c.flushLocked()
+    }
+    if c.timer == nil {
+        c.timer = time.AfterFunc(c.window, func() { c.flush() })
+    }
+    return len(p), nil
+}
+
+// flush writes out the buffered data.
+func (c *coalescingWriter) flush() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.flushLocked()
+}
+
+func (c *coalescingWriter) flushLocked() error {
+    if c.timer != nil {
+        c.timer.Stop()
+        c.timer = nil
+    }
+    if c.err != nil || len(c.buf) == 0 {
+        return c.err
+    }
+    _, c.err = c.w.Write(c.buf)
+    c.buf = c.buf[:0]
+    return c.err
+}
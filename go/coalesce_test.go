@@ -0,0 +1,199 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// recordingWriter keeps every write made to it.
+type recordingWriter struct {
+    mu     sync.Mutex
+    writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    w.writes = append(w.writes, bytes.Clone(p))
+    return len(p), nil
+}
+
+// data returns everything written, and the number of writes it took.
+func (w *recordingWriter) data() ([]byte, int) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return bytes.Join(w.writes, nil), len(w.writes)
+}
+
+func TestCoalescingWriter(t *testing.T) {
+    setVar(t, &maxInflight, 100)
+    rec := &recordingWriter{}
+    c := newCoalescingWriter(rec, time.Hour)
+
+    var want []byte
+    for i := range 30 {
+        segment := []byte(fmt.Sprintf("%02d,", i))
+        want = append(want, segment...)
+        if _, err := c.Write(segment); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // 90 bytes stay buffered; the next write would pass MAX_INFLIGHT.
+    if _, n := rec.data(); n != 0 {
+        t.Errorf("%d writes before the buffer filled", n)
+    }
+    big := bytes.Repeat([]byte("x"), 250)
+    want = append(want, big...)
+    c.Write(big)
+    c.Write([]byte("end"))
+    want = append(want, "end"...)
+    if err := c.flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    got, n := rec.data()
+    if !bytes.Equal(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+    if n != 3 {
+        t.Errorf("%d writes, want 3", n)
+    }
+}
+
+// TestCoalescing sends the target's many small segments to the client
+// through COALESCE_MS and checks that all of them arrive, in fewer
+// messages.
+func TestCoalescing(t *testing.T) {
+    setVar(t, &coalesceWindow, 20*time.Millisecond)
+    const segments = 200
+    var want bytes.Buffer
+    for i := range segments {
+        fmt.Fprintf(&want, "segment %d\n", i)
+    }
+    port := tcpServer(t, func(conn net.Conn) {
+        for _, line := range bytes.SplitAfter(want.Bytes(), []byte("\n")) {
+            conn.Write(line)
+        }
+        conn.Close()
+    })
+    srv := newTestServer(t)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    var got []byte
+    messages := 0
+    for {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            break
+        }
+        got = append(got, message...)
+        messages++
+    }
+    if !bytes.Equal(got, want.Bytes()) {
+        t.Errorf("got %d bytes, want %d", len(got), want.Len())
+    }
+    if messages >= segments {
+        t.Errorf("%d segments sent as %d messages", segments, messages)
+    }
+}
+
+// BenchmarkCoalescingWriter writes 64-byte segments, reporting how many
+// messages they are sent as.
+func BenchmarkCoalescingWriter(b *testing.B) {
+    segment := bytes.Repeat([]byte("x"), 64)
+    for _, window := range []time.Duration{0, time.Millisecond} {
+        b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+            var messages atomic.Int64
+            var w io.Writer = writerFunc(func(p []byte) (int, error) {
+                messages.Add(1)
+                return len(p), nil
+            })
+            var c *coalescingWriter
+            if window > 0 {
+                c = newCoalescingWriter(w, window)
+                w = c
+            }
+            b.SetBytes(int64(len(segment)))
+            for b.Loop() {
+                w.Write(segment)
+            }
+            if c != nil {
+                c.flush()
+            }
+            b.ReportMetric(float64(messages.Load())/float64(b.N), "msgs/op")
+        })
+    }
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// TestBackpressure has the target send as fast as it can to a client that
+// reads nothing, and checks that the target is held back rather than the
+// server buffering what it sends.
+func TestBackpressure(t *testing.T) {
+    setVar(t, &coalesceWindow, time.Millisecond)
+    setVar(t, &maxInflight, 4096)
+    var sent atomic.Int64
+    port := tcpServer(t, func(conn net.Conn) {
+        chunk := bytes.Repeat([]byte("x"), 32*1024)
+        for {
+            n, err := conn.Write(chunk)
+            sent.Add(int64(n))
+            if err != nil {
+                return
+            }
+        }
+    })
+    srv := newTestServer(t)
+
+    var before runtime.MemStats
+    runtime.GC()
+    runtime.ReadMemStats(&before)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+
+    // Once every socket buffer on the way is full, the target stops.
+    last := int64(-1)
+    for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(200 * time.Millisecond) {
+        n := sent.Load()
+        if n == last {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("target still sending after %d bytes", n)
+        }
+        last = n
+    }
+    var after runtime.MemStats
+    runtime.GC()
+    runtime.ReadMemStats(&after)
+    if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 8<<20 {
+        t.Errorf("heap grew by %d bytes with %d bytes sent", grown, last)
+    }
+    if last > 64<<20 {
+        t.Errorf("target sent %d bytes before being held back", last)
+    }
+
+    // Everything sent is still delivered once the client reads.
+    var got int64
+    for got < last {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        got += int64(len(message))
+    }
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "strings"
+    "time"
+)
+
+// Config is the configuration that can be read from the JSON file named by
+// CONFIG_FILE. Every field stands for the environment variable of the same
+// name in upper case; a variable that is set overrides the file, and a field
+// left at its zero value leaves the setting at its default.
+type Config struct {
+    UUID           string   `json:"uuid"`
+    UUIDs          []string `json:"uuids"`
+    WSPath         string   `json:"ws_path"`
+    VMessPath      string   `json:"vmess_path"`
+    TrojanPassword string   `json:"trojan_password"`
+    ObfsKey        string   `json:"obfs_key"`
+    BindAddr       string   `json:"bind_addr"`
+    Port           int      `json:"port"`
+    Ports          []int    `json:"ports"`
+    UnixSocket     string   `json:"unix_socket"`
+    UnixSocketMode string   `json:"unix_socket_mode"`
+    LogLevel       string   `json:"log_level"`
+    LogTargets     string   `json:"log_targets"`
+    LogTargetsSalt string   `json:"log_targets_salt"`
+
+    AccessLogFile       string `json:"access_log_file"`
+    AccessLogMaxSize    int    `json:"access_log_max_size"`
+    AccessLogMaxBackups int    `json:"access_log_max_backups"`
+    AccessLogMaxAge     int    `json:"access_log_max_age"`
+
+    BufferSize     int      `json:"buffer_size"`
+    WSReadBuffer   int      `json:"ws_read_buffer"`
+    WSWriteBuffer  int      `json:"ws_write_buffer"`
+    MaxMessageSize int      `json:"max_message_size"`
+    WSCompress     bool     `json:"ws_compress"`
+    CompressMin    int      `json:"compress_min"`
+    CoalesceMS     int      `json:"coalesce_ms"`
+    MaxInflight    int      `json:"max_inflight"`
+    WSSubprotocols []string `json:"ws_subprotocols"`
+    MaxConns       int      `json:"max_conns"`
+    MaxPumps       int      `json:"max_pumps"`
+    RateBPS        int      `json:"rate_bps"`
+    GlobalRateBPS  int      `json:"global_rate_bps"`
+    QuotaBytes     int      `json:"quota_bytes"`
+    QuotaPeriod    string   `json:"quota_period"`
+    QuotaFile      string   `json:"quota_file"`
+
+    IdleTimeout      string `json:"idle_timeout"`
+    PingInterval     string `json:"ping_interval"`
+    PongTimeout      string `json:"pong_timeout"`
+    HandshakeTimeout string `json:"handshake_timeout"`
+    WriteTimeout     string `json:"write_timeout"`
+    MaxSession       string `json:"max_session"`
+    ShutdownGrace    string `json:"shutdown_grace"`
+    DialTimeout      string `json:"dial_timeout"`
+    DialBackoff      string `json:"dial_backoff"`
+    DialRetries      int    `json:"dial_retries"`
+    TCPKeepAlive     string `json:"tcp_keepalive"`
+
+    DialNetwork    string            `json:"dial_network"`
+    HappyEyeballs  bool              `json:"happy_eyeballs"`
+    OutboundIP     string            `json:"outbound_ip"`
+    OutboundIface  string            `json:"outbound_iface"`
+    SrcPortRange   string            `json:"src_port_range"`
+    PoolIdle       string            `json:"pool_idle"`
+    PoolAll        bool              `json:"pool_all"`
+    UpstreamProxy  string            `json:"upstream_proxy"`
+    UpstreamWS     string            `json:"upstream_ws"`
+    UpstreamUUID   string            `json:"upstream_uuid"`
+    SendProxyProto string            `json:"send_proxy_proto"`
+    DNSCacheTTL    string            `json:"dns_cache_ttl"`
+    DNSNegativeTTL string            `json:"dns_negative_ttl"`
+    DoHURL         string            `json:"doh_url"`
+    RouteMap       map[string]string `json:"route_map"`
+
+    AllowPrivate    bool     `json:"allow_private"`
+    AllowHosts      []string `json:"allow_hosts"`
+    DenyHosts       []string `json:"deny_hosts"`
+    Sniff           bool     `json:"sniff"`
+    SniffAllowHosts []string `json:"sniff_allow_hosts"`
+    SniffDenyHosts  []string `json:"sniff_deny_hosts"`
+    AllowedOrigins  []string `json:"allowed_origins"`
+    RateLimit       float64  `json:"rate_limit"`
+    RateBurst       int      `json:"rate_burst"`
+    TrustProxy      bool     `json:"trust_proxy"`
+    ProbeResist     bool     `json:"probe_resist"`
+    UpgradeAuth     string   `json:"upgrade_auth"`
+
+    FallbackURL       string   `json:"fallback_url"`
+    FallbackDir       string   `json:"fallback_dir"`
+    RootResponse      string   `json:"root_response"`
+    RootStatus        int      `json:"root_status"`
+    StatsToken        string   `json:"stats_token"`
+    StatsPushURL      string   `json:"stats_push_url"`
+    StatsPushToken    string   `json:"stats_push_token"`
+    StatsPushInterval string   `json:"stats_push_interval"`
+    AdminToken        string   `json:"admin_token"`
+    Metrics           bool     `json:"metrics"`
+    PProf             bool     `json:"pprof"`
+    PProfAddr         string   `json:"pprof_addr"`
+    H2C               bool     `json:"h2c"`
+    EnableConnect     bool     `json:"enable_connect"`
+    ConnectAuth       string   `json:"connect_auth"`
+    SOCKS5Addr        string   `json:"socks5_addr"`
+    SOCKS5Auth        string   `json:"socks5_auth"`
+    TLSCert           string   `json:"tls_cert"`
+    TLSKey            string   `json:"tls_key"`
+    TLSClientCA       string   `json:"tls_client_ca"`
+    TLSAuto           bool     `json:"tls_auto"`
+    TLSDomains        []string `json:"tls_domains"`
+    TLSCacheDir       string   `json:"tls_cache_dir"`
+}
+
+// fileConfig holds the settings read from CONFIG_FILE by environment
+// variable name. It is empty when there is no file.
+var fileConfig map[string]string
+
+// getenv returns the named setting: the environment variable when it is
+// set, and the value from CONFIG_FILE otherwise.
+func getenv(name string) string {
+    if v := os.Getenv(name); v != "" {
+        return v
+    }
+    return fileConfig[name]
+}
+
+// LoadConfig reads and validates the JSON configuration file at path.
+// Unknown fields are rejected so that a misspelt setting is not silently
+// ignored, and every invalid field is reported at once.
+func LoadConfig(path string) (*Config, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var c Config
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&c); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    if err := c.validate(); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return &c, nil
+}
+
+func (c *Config) validate() error {
+    var errs []error
+    if _, err := parseUsers(strings.Join(append([]string{c.UUID}, c.UUIDs...), ",")); err != nil {
+        errs = append(errs, err)
+    }
+    for _, port := range c.Ports {
+        if port < 1 || port > 65535 {
+            errs = append(errs, fmt.Errorf("invalid port %d", port))
+        }
+    }
+    durations := map[string]string{
+        "idle_timeout":        c.IdleTimeout,
+        "ping_interval":       c.PingInterval,
+        "pong_timeout":        c.PongTimeout,
+        "handshake_timeout":   c.HandshakeTimeout,
+        "write_timeout":       c.WriteTimeout,
+        "max_session":         c.MaxSession,
+        "shutdown_grace":      c.ShutdownGrace,
+        "dial_timeout":        c.DialTimeout,
+        "dial_backoff":        c.DialBackoff,
+        "tcp_keepalive":       c.TCPKeepAlive,
+        "pool_idle":           c.PoolIdle,
+        "dns_cache_ttl":       c.DNSCacheTTL,
+        "dns_negative_ttl":    c.DNSNegativeTTL,
+        "stats_push_interval": c.StatsPushInterval,
+    }
+    for name, v := range durations {
+        if v == "" {
+            continue
+        }
+        if d, err := time.ParseDuration(v); err != nil || d < 0 {
+            errs = append(errs, fmt.Errorf("invalid %s %q", name, v))
+        }
+    }
+    if c.RateLimit < 0 {
+        errs = append(errs, fmt.Errorf("invalid rate_limit %v", c.RateLimit))
+    }
+    return errors.Join(errs...)
+}
+
+// env returns the settings of c by environment variable name, leaving out
+// those left at their zero value. Lists are joined with commas, as the
+// variables take them, and ROUTE_MAP is written back as JSON.
+func (c *Config) env() map[string]string {
+    env := make(map[string]string)
+    v := reflect.ValueOf(c).Elem()
+    for i := range v.NumField() {
+        field := v.Field(i)
+        if field.IsZero() {
+            continue
+        }
+        name := strings.ToUpper(v.Type().Field(i).Tag.Get("json"))
+        switch field.Kind() {
+        case reflect.Bool:
+            env[name] = "1"
+        case reflect.Slice:
+            var list []string
+            for j := range field.Len() {
+                list = append(list, fmt.Sprint(field.Index(j)))
+            }
+            env[name] = strings.Join(list, ",")
+        case reflect.Map:
+            data, _ := json.Marshal(field.Interface())
+            env[name] = string(data)
+        default:
+            env[name] = fmt.Sprint(field)
+        }
+    }
+    return env
+}
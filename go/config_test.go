@@ -0,0 +1,170 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// fullConfig sets every field of Config.
+const fullConfig = `{
+    "uuid": "de04add9-5c68-8bab-950c-08cd5320df18",
+    "uuids": ["6ba7b810-9dad-11d1-80b4-00c04fd430c8"],
+    "ws_path": "/tunnel",
+    "vmess_path": "/vmess",
+    "trojan_password": "trojan",
+    "obfs_key": "obfs",
+    "bind_addr": "127.0.0.1",
+    "port": 8000,
+    "ports": [8080, 8443],
+    "unix_socket": "/run/proxy.sock",
+    "unix_socket_mode": "660",
+    "log_level": "debug",
+    "log_targets": "hashed",
+    "log_targets_salt": "salt",
+    "access_log_file": "/var/log/access.log",
+    "access_log_max_size": 10,
+    "access_log_max_backups": 3,
+    "access_log_max_age": 7,
+    "buffer_size": 65536,
+    "ws_read_buffer": 8192,
+    "ws_write_buffer": 8192,
+    "max_message_size": 1048576,
+    "ws_compress": true,
+    "compress_min": 256,
+    "coalesce_ms": 5,
+    "max_inflight": 65536,
+    "ws_subprotocols": ["vless"],
+    "max_conns": 100,
+    "max_pumps": 400,
+    "rate_bps": 1000000,
+    "global_rate_bps": 10000000,
+    "quota_bytes": 1000000000,
+    "quota_period": "monthly",
+    "quota_file": "/var/lib/quota",
+    "idle_timeout": "1m",
+    "ping_interval": "20s",
+    "pong_timeout": "10s",
+    "handshake_timeout": "5s",
+    "write_timeout": "10s",
+    "max_session": "1h",
+    "shutdown_grace": "30s",
+    "dial_timeout": "5s",
+    "dial_backoff": "100ms",
+    "dial_retries": 2,
+    "tcp_keepalive": "30s",
+    "dial_network": "tcp4",
+    "happy_eyeballs": true,
+    "outbound_ip": "192.0.2.1",
+    "outbound_iface": "eth0",
+    "src_port_range": "40000-50000",
+    "pool_idle": "30s",
+    "pool_all": true,
+    "upstream_proxy": "socks5://127.0.0.1:1080",
+    "upstream_ws": "wss://upstream.example/",
+    "upstream_uuid": "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+    "send_proxy_proto": "2",
+    "dns_cache_ttl": "1m",
+    "dns_negative_ttl": "5s",
+    "doh_url": "https://dns.example/dns-query",
+    "route_map": {"ads.example.com": "127.0.0.1:9"},
+    "allow_private": true,
+    "allow_hosts": ["example.com", "*.example.org"],
+    "deny_hosts": ["bad.example"],
+    "sniff": true,
+    "sniff_allow_hosts": ["example.com"],
+    "sniff_deny_hosts": ["bad.example"],
+    "allowed_origins": ["https://example.com"],
+    "rate_limit": 0.5,
+    "rate_burst": 10,
+    "trust_proxy": true,
+    "probe_resist": true,
+    "upgrade_auth": "user:pass",
+    "fallback_url": "http://127.0.0.1:8000",
+    "fallback_dir": "/srv/www",
+    "root_response": "hello",
+    "root_status": 404,
+    "stats_token": "stats",
+    "stats_push_url": "https://collector.example/push",
+    "stats_push_token": "push",
+    "stats_push_interval": "1m",
+    "admin_token": "admin",
+    "metrics": true,
+    "pprof": true,
+    "pprof_addr": "127.0.0.1:6060",
+    "h2c": true,
+    "enable_connect": true,
+    "connect_auth": "user:pass",
+    "socks5_addr": "127.0.0.1:1080",
+    "socks5_auth": "user:pass",
+    "tls_cert": "/etc/tls/cert.pem",
+    "tls_key": "/etc/tls/key.pem",
+    "tls_client_ca": "/etc/tls/ca.pem",
+    "tls_auto": true,
+    "tls_domains": ["example.com", "www.example.com"],
+    "tls_cache_dir": "/var/lib/certs"
+}`
+
+// writeConfig writes data to a config file and returns its path.
+func writeConfig(t testing.TB, data string) string {
+    path := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestLoadConfig(t *testing.T) {
+    c, err := LoadConfig(writeConfig(t, fullConfig))
+    if err != nil {
+        t.Fatal(err)
+    }
+    env := c.env()
+    if n := reflect.TypeFor[Config]().NumField(); len(env) != n {
+        t.Errorf("got %d settings from the file, want all %d", len(env), n)
+    }
+    for name, want := range map[string]string{
+        "WS_PATH":         "/tunnel",
+        "PORTS":           "8080,8443",
+        "MAX_PUMPS":       "400",
+        "RATE_LIMIT":      "0.5",
+        "SNIFF":           "1",
+        "ALLOW_HOSTS":     "example.com,*.example.org",
+        "ROUTE_MAP":       `{"ads.example.com":"127.0.0.1:9"}`,
+        "WS_READ_BUFFER":  "8192",
+        "DNS_CACHE_TTL":   "1m",
+        "SRC_PORT_RANGE":  "40000-50000",
+        "ACCESS_LOG_FILE": "/var/log/access.log",
+    } {
+        if env[name] != want {
+            t.Errorf("%s: got %q, want %q", name, env[name], want)
+        }
+    }
+
+    _, err = LoadConfig(writeConfig(t, `{"uuid": "bad", "ports": [0], "idle_timeout": "soon"}`))
+    if err == nil || !strings.Contains(err.Error(), "invalid port 0") || !strings.Contains(err.Error(), "invalid idle_timeout") {
+        t.Errorf("invalid fields: got %v", err)
+    }
+    if _, err := LoadConfig(writeConfig(t, `{"ws_paht": "/tunnel"}`)); err == nil {
+        t.Error("unknown field accepted")
+    }
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+    path := writeConfig(t, `{"ws_path": "/file", "buffer_size": 65536, "max_pumps": 5, "route_map": {"ads.example.com": "127.0.0.1:9"}}`)
+    out, err := runStartup(t, "CONFIG_FILE="+path, "WS_PATH=/env")
+    if err != nil {
+        t.Fatalf("%v: %s", err, out)
+    }
+    summary := effectiveConfig(out)
+    if summary == nil || summary["ws_path"] != "/env" || summary["buffer_size"] != float64(65536) ||
+        summary["max_pumps"] != float64(5) || summary["routes"] != float64(1) {
+        t.Errorf("configuration summary: got %v", summary)
+    }
+
+    if out, err := runStartup(t, "CONFIG_FILE="+writeConfig(t, `{"wat": 1}`)); err == nil || !strings.Contains(out, "Invalid CONFIG_FILE") {
+        t.Errorf("unknown field: got %v: %s", err, out)
+    }
+}
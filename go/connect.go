@@ -0,0 +1,168 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "strconv"
+)
+
+// connectHandler serves HTTP CONNECT requests itself and passes everything
+// else on to next. CONNECT has to be intercepted before the ServeMux, which
+// routes by path and would reject the request's bare host:port target.
+func connectHandler(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodConnect {
+            handleConnect(w, r)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// handleConnect tunnels a CONNECT request to its target through the same
+// address checks, dialer and pumps as the WebSocket proxy.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+    if connectAuth != "" && !validateProxyAuth(r) {
+        w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+        http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+        return
+    }
+    if draining.Load() {
+        http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+        return
+    }
+    if quiesced.Load() {
+        http.Error(w, "Server is not accepting new connections", http.StatusServiceUnavailable)
+        return
+    }
+    if connLimiter != nil && !connLimiter.allow(clientIP(r)) {
+        http.Error(w, "Too many requests", http.StatusTooManyRequests)
+        return
+    }
+
+    release, ok := acquireSlot()
+    if !ok {
+        overloaded(w)
+        return
+    }
+    defer release()
+
+    sessions.Add(1)
+    defer sessions.Done()
+
+    logger := slog.With("conn_id", newConnID(), "client_ip", clientIP(r))
+
+    host, portStr, err := net.SplitHostPort(r.Host)
+    if err != nil {
+        http.Error(w, "Invalid target", http.StatusBadRequest)
+        return
+    }
+    port, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil || port == 0 {
+        http.Error(w, "Invalid target port", http.StatusBadRequest)
+        return
+    }
+    host = normalizeHost(host)
+    logger.Debug("CONNECT details", hostAttr("host", host), "port", port, "remote_addr", r.RemoteAddr)
+
+    checked, err := checkTarget(host, uint16(port), logger)
+    if err != nil {
+        logger.Warn("CONNECT rejected", hostAttr("host", host), "port", port, "error", err)
+        var perr *proxyError
+        if errors.As(err, &perr) && perr.code == closeBlockedHost {
+            http.Error(w, "Forbidden", http.StatusForbidden)
+        } else {
+            http.Error(w, "Bad gateway", http.StatusBadGateway)
+        }
+        return
+    }
+
+    if err := checkQuota(); err != nil {
+        logger.Warn("CONNECT refused", "error", err)
+        http.Error(w, "Quota exceeded", http.StatusServiceUnavailable)
+        return
+    }
+    releasePumps, ok := acquirePumps()
+    if !ok {
+        overloaded(w)
+        return
+    }
+    defer releasePumps()
+
+    target, err := dialTarget("tcp", checked.ips, checked.port)
+    if err != nil {
+        dialFailures.Inc()
+        logger.Warn("CONNECT dial error", hostAttr("host", host), "port", port, "error", err)
+        http.Error(w, "Bad gateway", http.StatusBadGateway)
+        return
+    }
+    defer target.Close()
+    src, dst := requestAddrs(r)
+    if err := writeProxyHeader(target, src, dst); err != nil {
+        logger.Warn("CONNECT error sending PROXY header", "error", err)
+        http.Error(w, "Bad gateway", http.StatusBadGateway)
+        return
+    }
+
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+        return
+    }
+    client, buf, err := hijacker.Hijack()
+    if err != nil {
+        logger.Warn("CONNECT hijack error", "error", err)
+        return
+    }
+    defer client.Close()
+
+    defer trackSession(client)()
+
+    if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+        return
+    }
+
+    idle := idleDeadline{client, target}
+    idle.extend()
+
+    errChan := make(chan error, 2)
+
+    // Read the client through buf so that bytes it sent right after the
+    // request headers are not lost.
+    var up io.Reader = buf.Reader
+    var sniffer *sniffReader
+    if sniff {
+        sniffer = newSniffReader(up, logger)
+        up = sniffer
+    }
+    sess := newSession("", logger)
+    sess.target, sess.route = r.Host, checked.route
+    defer limitTunnel(sess, client, target)()
+    go func() {
+        defer recoverPanic(logger, errChan)
+        errChan <- pump(target, up, idle, sess.countUp)
+    }()
+    go func() {
+        defer recoverPanic(logger, errChan)
+        errChan <- pump(client, target, idle, sess.countDown)
+    }()
+
+    err = idleError(<-errChan)
+    if sniffer != nil {
+        sess.sniffed = sniffer.sniffed()
+    }
+    sess.end(err)
+}
+
+// validateProxyAuth reports whether the request carries the Basic
+// credentials configured in CONNECT_AUTH.
+func validateProxyAuth(r *http.Request) bool {
+    want := "Basic " + base64.StdEncoding.EncodeToString([]byte(connectAuth))
+    got := r.Header.Get("Proxy-Authorization")
+    return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
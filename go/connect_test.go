@@ -0,0 +1,70 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// connectTo sends a CONNECT request for target to srv and returns the
+// connection and the response to it. extra is written right after the
+// request headers.
+func connectTo(t testing.TB, srv *httptest.Server, target, extra string) (net.Conn, *bufio.Reader, *http.Response) {
+    t.Helper()
+    conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n%s", target, target, extra)
+
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return conn, br, resp
+}
+
+func TestConnect(t *testing.T) {
+    srv := httptest.NewServer(connectHandler(http.NotFoundHandler()))
+    t.Cleanup(srv.Close)
+    target := fmt.Sprintf("127.0.0.1:%d", tcpEcho(t))
+
+    conn, br, resp := connectTo(t, srv, target, "early")
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("got %d", resp.StatusCode)
+    }
+    fmt.Fprint(conn, " data")
+    got := make([]byte, len("early data"))
+    if _, err := io.ReadFull(br, got); err != nil || string(got) != "early data" {
+        t.Fatalf("got %q, %v", got, err)
+    }
+
+    setVar(t, &allowPrivate, false)
+    if _, _, resp := connectTo(t, srv, target, ""); resp.StatusCode != http.StatusForbidden {
+        t.Errorf("private target: got %d, want 403", resp.StatusCode)
+    }
+    allowPrivate = true
+
+    quiesced.Store(true)
+    defer quiesced.Store(false)
+    if _, _, resp := connectTo(t, srv, target, ""); resp.StatusCode != http.StatusServiceUnavailable {
+        t.Errorf("quiesced: got %d, want 503", resp.StatusCode)
+    }
+    quiesced.Store(false)
+
+    setVar(t, &connLimiter, newIPLimiter(0.001, 1))
+    if _, _, resp := connectTo(t, srv, target, ""); resp.StatusCode != http.StatusOK {
+        t.Errorf("first tunnel under RATE_LIMIT: got %d", resp.StatusCode)
+    }
+    if _, _, resp := connectTo(t, srv, target, ""); resp.StatusCode != http.StatusTooManyRequests {
+        t.Errorf("second tunnel under RATE_LIMIT: got %d, want 429", resp.StatusCode)
+    }
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// unresponsivePort returns a loopback port whose connection attempts are
+// never answered: its listen backlog of 0 is filled by one connection that
+// is never accepted, after which the kernel drops every SYN.
+func unresponsivePort(t testing.TB) uint16 {
+    fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { syscall.Close(fd) })
+    if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+        t.Fatal(err)
+    }
+    if err := syscall.Listen(fd, 0); err != nil {
+        t.Fatal(err)
+    }
+    sa, _ := syscall.Getsockname(fd)
+    port := sa.(*syscall.SockaddrInet4).Port
+
+    filler, err := dialer.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { filler.Close() })
+    return uint16(port)
+}
+
+func TestDialTimeout(t *testing.T) {
+    d := *dialer
+    d.Timeout = 300 * time.Millisecond
+    setVar(t, &dialer, &d)
+    port := unresponsivePort(t)
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    start := time.Now()
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    expectClose(t, ws, closeDialFailed)
+    if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 3*time.Second {
+        t.Errorf("dial failed after %s, want about %s", elapsed, dialer.Timeout)
+    }
+}
+
+// The whole of 127.0.0.0/8 is local on Linux, so 127.0.0.2 can be bound
+// without configuring an address.
+func TestOutboundIP(t *testing.T) {
+    setVar(t, &outboundIP, net.IPv4(127, 0, 0, 2))
+    sources := make(chan net.Addr, 1)
+    port := tcpServer(t, func(conn net.Conn) {
+        sources <- conn.RemoteAddr()
+        conn.Write([]byte("hi"))
+    })
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    if src := (<-sources).(*net.TCPAddr); !src.IP.Equal(outboundIP) {
+        t.Errorf("dialed from %s, want %s", src.IP, outboundIP)
+    }
+
+    if out, err := runStartup(t, "OUTBOUND_IP=not-an-ip"); err == nil || !strings.Contains(out, "Invalid OUTBOUND_IP") {
+        t.Errorf("got %v: %s", err, out)
+    }
+}
+
+func TestTargetSocketOptions(t *testing.T) {
+    setVar(t, &tcpKeepAlive, tcpKeepAlive)
+    port := tcpEcho(t)
+    sockopt := func(conn net.Conn, level, opt int) int {
+        t.Helper()
+        raw, err := conn.(*net.TCPConn).SyscallConn()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var v int
+        raw.Control(func(fd uintptr) { v, err = syscall.GetsockoptInt(int(fd), level, opt) })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return v
+    }
+
+    tcpKeepAlive = 42 * time.Second
+    conn, err := dialTarget("tcp", []net.IP{net.IPv4(127, 0, 0, 1)}, port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if sockopt(conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+        t.Error("keepalive not enabled")
+    }
+    if idle := sockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 42 {
+        t.Errorf("keepalive idle %ds, want 42s", idle)
+    }
+    if sockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+        t.Error("TCP_NODELAY not set")
+    }
+
+    tcpKeepAlive = 0
+    off, err := dialTarget("tcp", []net.IP{net.IPv4(127, 0, 0, 1)}, port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer off.Close()
+    if sockopt(off, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+        t.Error("keepalive enabled with TCP_KEEPALIVE=0")
+    }
+}
+
+func TestOutboundIface(t *testing.T) {
+    bind, err := bindToDevice("lo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var calls atomic.Int32
+    d := *dialer
+    d.Control = func(network, address string, c syscall.RawConn) error {
+        calls.Add(1)
+        return bind(network, address, c)
+    }
+    setVar(t, &dialer, &d)
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("ping")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    if calls.Load() == 0 {
+        t.Error("SO_BINDTODEVICE hook not invoked for the target")
+    }
+
+    if out, err := runStartup(t, "OUTBOUND_IFACE=no-such-iface0"); err == nil || !strings.Contains(out, "Invalid OUTBOUND_IFACE") {
+        t.Errorf("unknown interface: got %v: %s", err, out)
+    }
+}
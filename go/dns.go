@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "net"
+    "sync"
+    "time"
+)
+
+// maxDNSCacheEntries bounds the cache; expired entries are swept out once it
+// grows past this size.
+const maxDNSCacheEntries = 4096
+
+// dnsCache caches the results of target name lookups for ttl, and failed
+// lookups for the shorter negativeTTL. A zero TTL disables caching of that
+// kind of result.
+type dnsCache struct {
+    ttl         time.Duration
+    negativeTTL time.Duration
+
+    // lookup performs the actual resolution. It is net.DefaultResolver's
+    // LookupIP unless DOH_URL replaces it.
+    lookup func(ctx context.Context, network, host string) ([]net.IP, error)
+
+    mu      sync.Mutex
+    entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+    ips     []net.IP
+    err     error
+    expires time.Time
+}
+
+func newDNSCache(ttl, negativeTTL time.Duration) *dnsCache {
+    return &dnsCache{
+        ttl:         ttl,
+        negativeTTL: negativeTTL,
+        lookup:      net.DefaultResolver.LookupIP,
+        entries:     make(map[string]dnsEntry),
+    }
+}
+
+// LookupIP returns the addresses of host, from the cache when a fresh entry
+// exists.
+func (c *dnsCache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+    now := time.Now()
+
+    c.mu.Lock()
+    e, ok := c.entries[host]
+    c.mu.Unlock()
+    if ok && now.Before(e.expires) {
+        return e.ips, e.err
+    }
+
+    ips, err := c.lookup(ctx, "ip", host)
+
+    ttl := c.ttl
+    if err != nil {
+        ttl = c.negativeTTL
+    }
+    // A lookup cut short by the caller says nothing about the name itself.
+    if ttl > 0 && ctx.Err() == nil {
+        c.mu.Lock()
+        if len(c.entries) >= maxDNSCacheEntries {
+            c.sweep(now)
+        }
+        c.entries[host] = dnsEntry{ips: ips, err: err, expires: now.Add(ttl)}
+        c.mu.Unlock()
+    }
+    return ips, err
+}
+
+// sweep removes expired entries. c.mu must be held.
+func (c *dnsCache) sweep(now time.Time) {
+    for host, e := range c.entries {
+        if !now.Before(e.expires) {
+            delete(c.entries, host)
+        }
+    }
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// stubResolver replaces the target resolver for the test with a cache over
+// lookup, returning the number of lookups made so far.
+func stubResolver(t testing.TB, ttl, negativeTTL time.Duration, lookup func(host string) ([]net.IP, error)) *atomic.Int32 {
+    var lookups atomic.Int32
+    c := newDNSCache(ttl, negativeTTL)
+    c.lookup = func(_ context.Context, _, host string) ([]net.IP, error) {
+        lookups.Add(1)
+        return lookup(host)
+    }
+    setVar(t, &resolver, c)
+    return &lookups
+}
+
+func TestDNSCache(t *testing.T) {
+    lookups := stubResolver(t, time.Minute, time.Minute, func(host string) ([]net.IP, error) {
+        if host == "missing.test" {
+            return nil, errors.New("no such host")
+        }
+        return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+    })
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    for i := 0; i < 2; i++ {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "echo.test", port, []byte("hi")))
+        readResponse(t, ws)
+    }
+    if n := lookups.Load(); n != 1 {
+        t.Errorf("%d lookups for two connections within the TTL, want 1", n)
+    }
+
+    for i := 0; i < 2; i++ {
+        if _, err := resolveTarget("missing.test"); err == nil {
+            t.Fatal("failed lookup not reported")
+        }
+    }
+    if n := lookups.Load(); n != 2 {
+        t.Errorf("failed lookup made %d times, want once", n-1)
+    }
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+    lookups := stubResolver(t, 10*time.Millisecond, 0, func(string) ([]net.IP, error) {
+        return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+    })
+    resolveTarget("echo.test")
+    time.Sleep(20 * time.Millisecond)
+    resolveTarget("echo.test")
+    if n := lookups.Load(); n != 2 {
+        t.Errorf("%d lookups across an expired entry, want 2", n)
+    }
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// dohTimeout bounds one DNS-over-HTTPS query, for callers that set no
+// deadline of their own.
+const dohTimeout = 5 * time.Second
+
+// maxDoHResponse bounds the size of a DNS-over-HTTPS response that is read.
+const maxDoHResponse = 64 * 1024
+
+// dohResolver resolves target names through the DNS-over-HTTPS server at
+// url (RFC 8484), set by DOH_URL, instead of the system resolver. Its
+// lookups stand in for the system's in the dnsCache, so their results are
+// cached the same way.
+type dohResolver struct {
+    url    string
+    client *http.Client
+}
+
+func newDoHResolver(url string) (*dohResolver, error) {
+    if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+        return nil, fmt.Errorf("must be an http:// or https:// URL")
+    }
+    return &dohResolver{url: url, client: &http.Client{Timeout: dohTimeout}}, nil
+}
+
+// LookupIP queries the A and AAAA records of host in parallel, or only one
+// of them for network "ip4" or "ip6", and returns the addresses of both. It
+// fails only when neither query found any.
+func (r *dohResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ip}, nil
+    }
+
+    type result struct {
+        ips []net.IP
+        err error
+    }
+    types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+    switch network {
+    case "ip4":
+        types = types[:1]
+    case "ip6":
+        types = types[1:]
+    }
+    results := make(chan result, len(types))
+    for _, qtype := range types {
+        go func() {
+            ips, err := r.query(ctx, host, qtype)
+            results <- result{ips, err}
+        }()
+    }
+
+    var ips []net.IP
+    var firstErr error
+    for range types {
+        res := <-results
+        ips = append(ips, res.ips...)
+        if res.err != nil && firstErr == nil {
+            firstErr = res.err
+        }
+    }
+    if len(ips) == 0 && firstErr != nil {
+        return nil, &net.DNSError{Err: firstErr.Error(), Name: host, Server: r.url}
+    }
+    if len(ips) == 0 {
+        return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+    }
+    return ips, nil
+}
+
+// query sends one question for host to the server and returns the
+// addresses in the answer.
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+    name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+    if err != nil {
+        return nil, err
+    }
+    // RFC 8484 asks for ID 0, which keeps the queries cacheable by HTTP.
+    msg := dnsmessage.Message{
+        Header:    dnsmessage.Header{RecursionDesired: true},
+        Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+    }
+    body, err := msg.Pack()
+    if err != nil {
+        return nil, err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/dns-message")
+    req.Header.Set("Accept", "application/dns-message")
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+    }
+    data, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+    if err != nil {
+        return nil, err
+    }
+
+    var answer dnsmessage.Message
+    if err := answer.Unpack(data); err != nil {
+        return nil, fmt.Errorf("invalid DNS-over-HTTPS response: %w", err)
+    }
+    // A name that does not exist simply has no addresses.
+    if answer.RCode == dnsmessage.RCodeNameError {
+        return nil, nil
+    }
+    if answer.RCode != dnsmessage.RCodeSuccess {
+        return nil, fmt.Errorf("server answered %s", answer.RCode)
+    }
+    var ips []net.IP
+    for _, rr := range answer.Answers {
+        switch body := rr.Body.(type) {
+        case *dnsmessage.AResource:
+            ips = append(ips, net.IP(body.A[:]))
+        case *dnsmessage.AAAAResource:
+            ips = append(ips, net.IP(body.AAAA[:]))
+        }
+    }
+    return ips, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// dohServer starts a DNS-over-HTTPS server that answers every A question
+// for echo.test with 127.0.0.1, finds no AAAA records, and answers that any
+// other name does not exist. It returns its URL and the number of queries
+// it has answered.
+func dohServer(t testing.TB) (string, *atomic.Int32) {
+    var queries atomic.Int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        var msg dnsmessage.Message
+        if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || msg.Unpack(body) != nil || len(msg.Questions) != 1 {
+            http.Error(w, "bad query", http.StatusBadRequest)
+            return
+        }
+        queries.Add(1)
+        q := msg.Questions[0]
+        msg.Header.Response = true
+        switch {
+        case q.Name.String() != "echo.test.":
+            msg.Header.RCode = dnsmessage.RCodeNameError
+        case q.Type == dnsmessage.TypeA:
+            msg.Answers = []dnsmessage.Resource{{
+                Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+                Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+            }}
+        }
+        answer, _ := msg.Pack()
+        w.Header().Set("Content-Type", "application/dns-message")
+        w.Write(answer)
+    }))
+    t.Cleanup(srv.Close)
+    return srv.URL, &queries
+}
+
+func TestDoH(t *testing.T) {
+    url, queries := dohServer(t)
+    doh, err := newDoHResolver(url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := newDNSCache(time.Minute, time.Minute)
+    c.lookup = doh.LookupIP
+    setVar(t, &resolver, c)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    for range 2 {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "echo.test", port, []byte("hi")))
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+            t.Fatalf("got %q, %v", message, err)
+        }
+    }
+    // One A and one AAAA query, and the second session is served from the
+    // cache.
+    if n := queries.Load(); n != 2 {
+        t.Errorf("%d queries, want 2", n)
+    }
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "missing.test", port, nil))
+    if _, _, err := ws.ReadMessage(); err == nil {
+        t.Error("session to a name that does not exist got a response")
+    }
+
+    ips, err := doh.LookupIP(context.Background(), "ip4", "echo.test")
+    if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+        t.Errorf("ip4 lookup: got %v, %v", ips, err)
+    }
+    if _, err := newDoHResolver("dns.example"); err == nil {
+        t.Error("DOH_URL without a scheme accepted")
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "slices"
+    "strings"
+)
+
+// genClient writes a vless:// share URL for every configured user to w,
+// one per line, which v2ray, Xray and most of their clients import as they
+// are. host is the name clients reach the server by; it defaults to the
+// first of TLS_DOMAINS, and to localhost without any. port, the first of
+// PORTS by default, differs where a platform serves the server on a port
+// of its own.
+func genClient(w io.Writer, host, port string) error {
+    if host == "" && len(tlsDomains) > 0 {
+        host = tlsDomains[0]
+    }
+    if host == "" {
+        host = "localhost"
+    }
+    if port == "" {
+        port = ports[0]
+    }
+    tls := tlsAuto || tlsCert != ""
+
+    ids := make([][16]byte, 0, len(users))
+    for id := range users {
+        ids = append(ids, id)
+    }
+    slices.SortFunc(ids, func(a, b [16]byte) int {
+        return strings.Compare(users[a], users[b])
+    })
+
+    for _, id := range ids {
+        query := url.Values{
+            "encryption": {"none"},
+            "type":       {"ws"},
+            "host":       {host},
+            "path":       {wsPath},
+            "security":   {"none"},
+        }
+        if tls {
+            query.Set("security", "tls")
+            query.Set("sni", host)
+        }
+        u := url.URL{
+            Scheme:   "vless",
+            User:     url.User(formatUUID(id)),
+            Host:     net.JoinHostPort(host, port),
+            RawQuery: query.Encode(),
+            Fragment: users[id],
+        }
+        if _, err := fmt.Fprintln(w, u.String()); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// formatUUID returns id in the usual dashed form.
+func formatUUID(id [16]byte) string {
+    s := hex.EncodeToString(id[:])
+    return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
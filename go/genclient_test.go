@@ -0,0 +1,58 @@
+package main
+
+import (
+    "bytes"
+    "net/url"
+    "os"
+    "os/exec"
+    "strings"
+    "testing"
+)
+
+func TestGenClient(t *testing.T) {
+    withUsers(t, "bob:22222222-2222-2222-2222-222222222222,alice:11111111-1111-1111-1111-111111111111")
+    setVar(t, &wsPath, "/tunnel")
+    setVar(t, &ports, []string{"8443"})
+    setVar(t, &tlsCert, "cert.pem")
+
+    var out bytes.Buffer
+    if err := genClient(&out, "proxy.example", ""); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("got %d URLs, want one per user: %s", len(lines), out.String())
+    }
+    for i, want := range []struct{ label, uuid string }{
+        {"alice", "11111111-1111-1111-1111-111111111111"},
+        {"bob", "22222222-2222-2222-2222-222222222222"},
+    } {
+        u, err := url.Parse(lines[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        q := u.Query()
+        if u.Scheme != "vless" || u.User.Username() != want.uuid || u.Host != "proxy.example:8443" || u.Fragment != want.label {
+            t.Errorf("%s: got %s", want.label, lines[i])
+        }
+        if q.Get("path") != "/tunnel" || q.Get("type") != "ws" || q.Get("security") != "tls" || q.Get("sni") != "proxy.example" {
+            t.Errorf("%s: got query %v", want.label, q)
+        }
+    }
+
+    // Without TLS, and through the flag.
+    cmd := exec.Command(os.Args[0], "-test.run=^$", "-genclient", "-host", "10.0.0.1", "-port", "80")
+    cmd.Env = append(os.Environ(), "TEST_MAIN=1", "UUID=33333333-3333-3333-3333-333333333333", "WS_PATH=/ws")
+    stdout, err := cmd.Output()
+    if err != nil {
+        t.Fatal(err)
+    }
+    u, err := url.Parse(strings.TrimSpace(string(stdout)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if u.User.Username() != "33333333-3333-3333-3333-333333333333" || u.Host != "10.0.0.1:80" ||
+        u.Query().Get("path") != "/ws" || u.Query().Get("security") != "none" {
+        t.Errorf("-genclient printed %s", stdout)
+    }
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "net"
+    "strings"
+)
+
+// hostPatterns is a list of destination patterns. A pattern is either an
+// exact host name or address, or "*.domain", which matches every subdomain
+// of domain but not domain itself.
+type hostPatterns []string
+
+func parseHostPatterns(list string) hostPatterns {
+    var patterns hostPatterns
+    for _, pattern := range splitList(list) {
+        patterns = append(patterns, strings.ToLower(pattern))
+    }
+    return patterns
+}
+
+func (p hostPatterns) match(host string) bool {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    for _, pattern := range p {
+        if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+            if strings.HasSuffix(host, "."+domain) {
+                return true
+            }
+        } else if host == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// normalizeHost rewrites a host sent as a domain name that is really an IP
+// address, possibly bracketed, into the canonical form of the address, the
+// same as when it is sent as one. The host rules and the private address
+// checks then treat it the same way whichever address type it came in.
+func normalizeHost(host string) string {
+    if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+        return ip.String()
+    }
+    return host
+}
+
+// hostAllowed applies DENY_HOSTS and ALLOW_HOSTS to a destination host. A
+// denied host is always rejected; when an allowlist is configured, only the
+// hosts on it are accepted.
+func hostAllowed(host string) bool {
+    if denyHosts.match(host) {
+        return false
+    }
+    return len(allowHosts) == 0 || allowHosts.match(host)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestHostPatterns(t *testing.T) {
+    patterns := parseHostPatterns("Example.com, *.corp.example")
+    for host, want := range map[string]bool{
+        "example.com":        true,
+        "EXAMPLE.com.":       true,
+        "www.example.com":    false,
+        "corp.example":       false,
+        "db.corp.example":    true,
+        "a.b.corp.example":   true,
+        "evilcorp.example":   false,
+        "corp.example.other": false,
+    } {
+        if got := patterns.match(host); got != want {
+            t.Errorf("%s: got %v, want %v", host, got, want)
+        }
+    }
+}
+
+func TestHostRules(t *testing.T) {
+    setVar(t, &allowHosts, nil)
+    setVar(t, &denyHosts, nil)
+    for _, c := range []struct {
+        allow, deny string
+        allowed     []string
+        refused     []string
+    }{
+        {deny: "*.ads.example", allowed: []string{"example.com", "ads.example"}, refused: []string{"x.ads.example"}},
+        {allow: "*.example.com", allowed: []string{"www.example.com"}, refused: []string{"example.org", "example.com"}},
+        {allow: "*.example.com", deny: "admin.example.com", allowed: []string{"www.example.com"}, refused: []string{"admin.example.com"}},
+    } {
+        allowHosts, denyHosts = parseHostPatterns(c.allow), parseHostPatterns(c.deny)
+        for _, host := range c.allowed {
+            if !hostAllowed(host) {
+                t.Errorf("allow %q, deny %q: %s refused", c.allow, c.deny, host)
+            }
+        }
+        for _, host := range c.refused {
+            if hostAllowed(host) {
+                t.Errorf("allow %q, deny %q: %s allowed", c.allow, c.deny, host)
+            }
+        }
+    }
+
+    allowHosts, denyHosts = nil, parseHostPatterns("127.0.0.1")
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    expectClose(t, ws, closeBlockedHost)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+    "net"
+    "syscall"
+)
+
+// bindToDevice returns a dialer Control function that binds every socket it
+// creates to the network interface named iface with SO_BINDTODEVICE.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+    if _, err := net.InterfaceByName(iface); err != nil {
+        return nil, err
+    }
+    return func(network, address string, c syscall.RawConn) error {
+        var sockErr error
+        err := c.Control(func(fd uintptr) {
+            sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+        })
+        if err != nil {
+            return err
+        }
+        return sockErr
+    }, nil
+}
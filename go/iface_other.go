@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+    "fmt"
+    "syscall"
+)
+
+// bindToDevice reports that OUTBOUND_IFACE cannot be used: binding a socket
+// to an interface by name needs SO_BINDTODEVICE, which only Linux has.
+func bindToDevice(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+    return nil, fmt.Errorf("binding to an interface is only supported on Linux")
+}
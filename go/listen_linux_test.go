@@ -0,0 +1,23 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+)
+
+// The whole of 127.0.0.0/8 is local on Linux, so a listener bound to
+// 127.0.0.1 can be shown not to answer on 127.0.0.2.
+func TestBindAddr(t *testing.T) {
+    port := closedPort(t)
+    startMain(t, fmt.Sprintf("127.0.0.1:%d", port), "BIND_ADDR=127.0.0.1", fmt.Sprintf("PORT=%d", port))
+    if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.2:%d", port)); err == nil {
+        conn.Close()
+        t.Error("server reachable on 127.0.0.2")
+    }
+
+    if out, err := runStartup(t, "BIND_ADDR=not an address"); err == nil || !strings.Contains(out, "Invalid BIND_ADDR") {
+        t.Errorf("got %v: %s", err, out)
+    }
+}
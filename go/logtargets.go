@@ -0,0 +1,114 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "net"
+    "sort"
+    "strings"
+)
+
+// logTargets is LOG_TARGETS, which says how the destinations of sessions
+// appear in the logs: "full" logs them as they are, "hashed" logs a salted
+// hash of the host in their place, and "none" leaves them out, so that a
+// shared deployment does not keep a record of where its users go. The
+// errors from checking, resolving and dialing a target never name it, so
+// that they can be logged, and given as the reason a session ended, under
+// any setting.
+var logTargets = "full"
+
+// logTargetSalt keys the hashes of hosts, so that they cannot be matched
+// against a list of candidate hosts. It is LOG_TARGETS_SALT, which keeps a
+// host's hash the same across restarts and replicas; without it, a salt is
+// drawn at startup and a host hashes alike only throughout one run.
+var logTargetSalt = make([]byte, 32)
+
+func init() {
+    rand.Read(logTargetSalt)
+}
+
+func parseLogTargets(v string) (string, error) {
+    switch v {
+    case "", "full":
+        return "full", nil
+    case "hashed", "none":
+        return v, nil
+    default:
+        return "", fmt.Errorf("must be full, hashed or none")
+    }
+}
+
+// hostAttr returns the log attribute for the destination host under key as
+// LOG_TARGETS allows it to be logged. With "none" it is the empty attribute,
+// which the handler drops.
+func hostAttr(key, host string) slog.Attr {
+    switch logTargets {
+    case "none":
+        return slog.Attr{}
+    case "hashed":
+        return slog.String(key, hashHost(host))
+    default:
+        return slog.String(key, host)
+    }
+}
+
+// targetAttr is hostAttr for a host:port target. A hashed target keeps its
+// port.
+func targetAttr(key, target string) slog.Attr {
+    host, port, err := net.SplitHostPort(target)
+    if logTargets != "hashed" || err != nil {
+        return hostAttr(key, target)
+    }
+    return slog.String(key, net.JoinHostPort(hashHost(host), port))
+}
+
+func hashHost(host string) string {
+    mac := hmac.New(sha256.New, logTargetSalt)
+    mac.Write([]byte(host))
+    return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// targetError is an error from checking, resolving or dialing a target with
+// the target's names and addresses taken out of its text; the log lines it
+// ends up in name the target as LOG_TARGETS allows instead. errors.Is and
+// errors.As still see the error it wraps.
+type targetError struct {
+    err   error
+    names []string
+}
+
+// hideTarget returns err without the names in its text, or nil for no
+// error. The longest names are taken out first, so none is left half in.
+func hideTarget(err error, names ...string) error {
+    if err == nil {
+        return nil
+    }
+    names = append([]string(nil), names...)
+    sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+    return &targetError{err: err, names: names}
+}
+
+// hideAddrs is hideTarget for the addresses of a resolved target.
+func hideAddrs(err error, ips []net.IP) error {
+    names := make([]string, len(ips))
+    for i, ip := range ips {
+        names[i] = ip.String()
+    }
+    return hideTarget(err, names...)
+}
+
+func (e *targetError) Error() string {
+    s := e.err.Error()
+    for _, name := range e.names {
+        if name != "" {
+            s = strings.ReplaceAll(s, name, "target")
+        }
+    }
+    return s
+}
+
+func (e *targetError) Unwrap() error { return e.err }
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestLogTargets(t *testing.T) {
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    // session runs one session to the echo target and returns its
+    // "Connection details" and "Session ended" records.
+    session := func() (details, ended map[string]any) {
+        t.Helper()
+        logs := captureLogs(t)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+        readResponse(t, ws)
+        ws.Close()
+        return logs.wait(t, "Connection details"), logs.wait(t, "Session ended")
+    }
+
+    setVar(t, &logTargets, "full")
+    details, ended := session()
+    if details["host"] != "127.0.0.1" || ended["target"] != fmt.Sprintf("127.0.0.1:%d", port) {
+        t.Errorf("full: host %v, target %v", details["host"], ended["target"])
+    }
+
+    setVar(t, &logTargets, "none")
+    details, ended = session()
+    if _, ok := details["host"]; ok {
+        t.Errorf("none: host logged as %v", details["host"])
+    }
+    if _, ok := ended["target"]; ok {
+        t.Errorf("none: target logged as %v", ended["target"])
+    }
+    if details["port"] != float64(port) || ended["bytes_up"] == nil {
+        t.Errorf("none: other fields dropped: %v, %v", details, ended)
+    }
+
+    setVar(t, &logTargets, "hashed")
+    details, ended = session()
+    hashed, ok := details["host"].(string)
+    if !ok || !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(hashed) {
+        t.Fatalf("hashed: host logged as %v", details["host"])
+    }
+    if ended["target"] != fmt.Sprintf("%s:%d", hashed, port) {
+        t.Errorf("hashed: target %v, want the hashed host and the port", ended["target"])
+    }
+    if again, _ := session(); again["host"] != hashed {
+        t.Errorf("hashed: %v the second time, %v the first", again["host"], hashed)
+    }
+    if hashHost("127.0.0.2") == hashed {
+        t.Error("two hosts hash alike")
+    }
+
+    // A hash made with another salt, as in another run, does not match.
+    saved := append([]byte(nil), logTargetSalt...)
+    t.Cleanup(func() { copy(logTargetSalt, saved) })
+    logTargetSalt[0] ^= 1
+    if hashHost("127.0.0.1") == hashed {
+        t.Error("hash does not depend on the salt")
+    }
+}
+
+// TestLogTargetsSalt runs two instances of the server with the same
+// LOG_TARGETS_SALT, as after a restart or beside a replica, and checks that
+// both log a host as the same hash, keyed by that salt.
+func TestLogTargetsSalt(t *testing.T) {
+    echo := tcpEcho(t)
+    mac := hmac.New(sha256.New, []byte("pepper"))
+    mac.Write([]byte("127.0.0.1"))
+    want := fmt.Sprintf("%s:%d", hex.EncodeToString(mac.Sum(nil)[:8]), echo)
+
+    for range 2 {
+        port := closedPort(t)
+        addr := fmt.Sprintf("127.0.0.1:%d", port)
+        p := startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1",
+            "LOG_TARGETS=hashed", "LOG_TARGETS_SALT=pepper")
+        ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", echo, nil))
+        readResponse(t, ws)
+        ws.Close()
+        time.Sleep(100 * time.Millisecond)
+        if r := outputRecord(p.stop(), "Session ended"); r == nil || r["target"] != want {
+            t.Errorf("session summary: got %v, want target %s", r, want)
+        }
+    }
+}
+
+// TestLogTargetsNoneErrors has sessions under LOG_TARGETS=none fail on the
+// host rules, on resolving and on dialing, through VLESS, SOCKS5 and mux,
+// and checks that no log line names their targets, not even in an error.
+func TestLogTargetsNoneErrors(t *testing.T) {
+    setVar(t, &logTargets, "none")
+    setVar(t, &denyHosts, parseHostPatterns("blocked.test"))
+    closed := closedPort(t)
+    stubResolver(t, time.Minute, 0, func(host string) ([]net.IP, error) {
+        if host == "refused.test" {
+            return []net.IP{net.IPv4(127, 0, 0, 2)}, nil
+        }
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+    })
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+
+    for host, code := range map[string]int{
+        "blocked.test": closeBlockedHost,
+        "missing.test": closeDialFailed,
+        "refused.test": closeDialFailed,
+    } {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, host, closed, nil))
+        expectClose(t, ws, code)
+    }
+    if _, reply := socks5Connect(t, startSOCKS5(t), "", "", net.IPv4(127, 0, 0, 2), closed); reply == socks5Succeeded {
+        t.Error("SOCKS5 dial to a closed port succeeded")
+    }
+    ws := muxSessionConn(t, srv, muxFrame(1, muxStatusNew, 0,
+        append(binary.BigEndian.AppendUint16([]byte{muxNetworkTCP}, closed), 1, 127, 0, 0, 2), nil))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{id: 1, status: muxStatusEnd, option: muxOptionError}) {
+        t.Errorf("mux stream to a closed port: got %+v", reply)
+    }
+    logs.wait(t, "Session ended")
+
+    for _, r := range logs.records() {
+        line, _ := json.Marshal(r)
+        for _, name := range []string{"blocked.test", "missing.test", "refused.test", "127.0.0.2"} {
+            if strings.Contains(string(line), name) {
+                t.Errorf("%s logged: %s", name, line)
+            }
+        }
+    }
+}
@@ -1,204 +1,2696 @@
 package main
 
 import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
     "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
-    "log"
+    "io"
+    "io/fs"
+    "log/slog"
+    mathrand "math/rand/v2"
     "net"
     "net/http"
+    "net/http/httputil"
+    "net/url"
     "os"
+    "os/signal"
+    "runtime"
+    "runtime/debug"
+    "slices"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
 
     "github.com/gorilla/websocket"
+    "golang.org/x/crypto/acme/autocert"
+    "golang.org/x/net/http2"
+    "golang.org/x/net/http2/h2c"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+    version   = "dev"
+    commit    = "unknown"
+    buildDate = "unknown"
 )
 
 var (
     upgrader = websocket.Upgrader{
-        CheckOrigin: func(r *http.Request) bool {
-            return true
+        CheckOrigin: checkOrigin,
+        Error:       upgradeError,
+    }
+
+    // allowedOrigins lists the browser origins that may open a WebSocket.
+    // It is empty when every origin is allowed.
+    allowedOrigins []string
+
+    // wsSubprotocols lists the subprotocols that may be selected for a
+    // WebSocket, in WS_SUBPROTOCOLS. It is empty when none is selected.
+    wsSubprotocols []string
+
+    // users maps every accepted UUID to the label logged for its sessions.
+    users          map[[16]byte]string
+    bindAddr       string
+    ports          []string
+    wsPath         string
+    vmessPath      string
+    bufferSize     int
+    maxMessageSize int64
+    compressMin    int
+    coalesceWindow time.Duration
+    idleTimeout    time.Duration
+    pingInterval   time.Duration
+    pongTimeout    time.Duration
+    writeTimeout   time.Duration
+    maxSession     time.Duration
+    shutdownGrace  time.Duration
+    dialer         *net.Dialer
+    outboundIP     net.IP
+    dialRetries    int
+    tcpKeepAlive   time.Duration
+    dialBackoff    time.Duration
+    poolIdle       time.Duration
+    resolver       *dnsCache
+    allowPrivate   bool
+    allowHosts     hostPatterns
+    denyHosts      hostPatterns
+
+    // maxInflight bounds the bytes of one direction of a session that are
+    // held between reading them from one side and writing them to the
+    // other. Neither side is read from again until they have been written.
+    maxInflight int
+
+    // handshakeTimeout bounds the wait for the request header after a
+    // WebSocket upgrade.
+    handshakeTimeout time.Duration
+
+    // dialFamily is "4" or "6" when DIAL_NETWORK restricts targets to one
+    // address family, and empty otherwise.
+    dialFamily    string
+    happyEyeballs bool
+
+    // connSlots limits the number of simultaneous sessions to MAX_CONNS.
+    // It is nil when the number is unlimited.
+    connSlots chan struct{}
+
+    // maxPumps limits the number of sessions pumping data at once to
+    // MAX_PUMPS, counting the two goroutines of each as one pair. It is
+    // zero when the number is unlimited.
+    maxPumps    int64
+    activePumps atomic.Int64
+
+    // connLimiter limits how fast each client IP may open sessions. It is
+    // nil when RATE_LIMIT is unset.
+    connLimiter *ipLimiter
+    trustProxy  bool
+
+    // upgradeAuth is the bearer token or user:password that proxy upgrades
+    // must present in their Authorization header, or empty when none is
+    // required.
+    upgradeAuth string
+
+    // probeResist stalls clients that fail to authenticate instead of
+    // closing their connection at once.
+    probeResist bool
+
+    // fallback serves requests that are not proxy upgrades when
+    // FALLBACK_URL or FALLBACK_DIR is set.
+    fallback http.Handler
+
+    // rootStatus and rootResponse answer the other requests when there is
+    // no fallback.
+    rootStatus   int
+    rootResponse string
+
+    statsToken    string
+    socks5Addr    string
+    socks5Auth    string
+    enableConnect bool
+    connectAuth   string
+
+    unixSocket     string
+    unixSocketMode fs.FileMode
+
+    tlsCert     string
+    tlsKey      string
+    tlsAuto     bool
+    tlsDomains  []string
+    tlsCacheDir string
+
+    // tlsClientCAs is the pool read from TLS_CLIENT_CA. When set, the HTTPS
+    // listener only accepts clients presenting a certificate it signed.
+    tlsClientCAs *x509.CertPool
+
+    bufferPool = sync.Pool{
+        New: func() any {
+            b := make([]byte, bufferSize)
+            return &b
         },
     }
-    uuid string
-)
 
-func init() {
-    uuid = os.Getenv("UUID")
-    if uuid == "" {
-        uuid = "123456"
+    // draining is set once shutdown begins so that no new proxy sessions
+    // are accepted while the existing ones finish.
+    draining atomic.Bool
+    sessions sync.WaitGroup
+
+    // ready is set once every listener is bound, for /readyz.
+    ready atomic.Bool
+
+    startTime         = time.Now()
+    activeConnections atomic.Int64
+
+    // sessionsServed, totalBytesUp and totalBytesDown are the totals of
+    // the whole run, pushed to STATS_PUSH_URL and logged when the server
+    // stops.
+    sessionsServed atomic.Int64
+    totalBytesUp   atomic.Int64
+    totalBytesDown atomic.Int64
+
+    // sessionCtx is cancelled when the shutdown grace period expires and
+    // closes every session that is still running.
+    sessionCtx, cancelSessions = context.WithCancel(context.Background())
+)
+
+// errShortHeader is returned by handleProxyRequest for a message that ends
+// before the request header does. The rest of the header may follow in the
+// next message.
+var errShortHeader = errors.New("message too short")
+
+// errWriteTimeout is returned by writeData when the client has not taken a
+// message within WRITE_TIMEOUT. It is not a net.Error, so that idleError
+// does not mistake it for the session idling.
+var errWriteTimeout = errors.New("client stopped reading")
+
+// errPrivateTarget is returned by resolveTarget for targets that resolve
+// only to private addresses.
+var errPrivateTarget = errors.New("private address")
+
+// errAuthFailed is returned by the request handlers when the client's
+// credentials are not accepted.
+var errAuthFailed = errors.New("authentication failed")
+
+// errClientClosed is reported by proxyWebSocketToTCP when the client closed
+// the WebSocket normally and the target connection was half-closed.
+var errClientClosed = errors.New("client closed the session")
+
+// isNormalClose reports whether err only says that a session ended the way
+// sessions end: the target closed its connection, the client sent a normal
+// or going-away close frame, or the server ended the session itself. Any
+// other error, including a close frame with another code and a connection
+// lost without one, is an abnormal closure.
+func isNormalClose(err error) bool {
+    var ce *websocket.CloseError
+    if errors.As(err, &ce) {
+        return ce.Code == websocket.CloseNormalClosure || ce.Code == websocket.CloseGoingAway
+    }
+    return err == nil || errors.Is(err, io.EOF) || errors.Is(err, errClientClosed) || errors.Is(err, context.Canceled)
+}
+
+// maxDialRetryTime bounds the time spent retrying a target dial, so that a
+// client is not kept waiting on a target that stays unavailable. It is only
+// changed by tests.
+var maxDialRetryTime = 30 * time.Second
+
+// Close codes sent to the client when a request is refused after the
+// WebSocket handshake, from the range reserved for applications.
+const (
+    closeBadCommand      = 4000
+    closeMalformedHeader = 4002
+    closeBlockedHost     = 4003
+    closeDialFailed      = 4004
+    closeSessionLimit    = 4008
+    closeOverloaded      = 4009
+    closeQuotaExceeded   = 4010
+)
+
+var closeReasons = map[int]string{
+    closeBadCommand:      "bad command",
+    closeMalformedHeader: "malformed header",
+    closeBlockedHost:     "blocked host",
+    closeDialFailed:      "dial failed",
+    closeSessionLimit:    "session limit reached",
+    closeOverloaded:      "server overloaded",
+    closeQuotaExceeded:   "quota exceeded",
+}
+
+// proxyError is a refused request reported to the client in a close frame
+// with the given code before the connection is closed.
+type proxyError struct {
+    code int
+    err  error
+}
+
+func newProxyError(code int, err error) error {
+    return &proxyError{code: code, err: err}
+}
+
+// malformedHeader reports a request header that could not be parsed.
+func malformedHeader(msg string) error {
+    return newProxyError(closeMalformedHeader, errors.New(msg))
+}
+
+func (e *proxyError) Error() string { return e.err.Error() }
+
+func (e *proxyError) Unwrap() error { return e.err }
+
+// loggedHeaderBytes is how much of a malformed request header is logged.
+const loggedHeaderBytes = 16
+
+const defaultUUID = "de04add9-5c68-8bab-950c-08cd5320df18"
+
+// vlessVersion is the only version of the VLESS request header served. A
+// later version may frame the header differently, so it is refused rather
+// than misparsed.
+const vlessVersion = 0
+
+const (
+    commandTCP = 1
+    commandUDP = 2
+    commandMux = 3
+)
+
+// commandNetworks maps the VLESS and VMess commands that open a connection
+// to the network the target is dialed on.
+var commandNetworks = map[byte]string{
+    commandTCP: "tcp",
+    commandUDP: "udp",
+}
+
+func init() {
+    // The file is read first so that it can set LOG_LEVEL too; its errors
+    // are reported once the logger is set up.
+    var configErr error
+    if path := os.Getenv("CONFIG_FILE"); path != "" {
+        var c *Config
+        if c, configErr = LoadConfig(path); configErr == nil {
+            fileConfig = c.env()
+        }
+    }
+
+    var level slog.Level
+    if v := getenv("LOG_LEVEL"); v != "" {
+        if err := level.UnmarshalText([]byte(v)); err != nil {
+            fatal("Invalid LOG_LEVEL", "value", v)
+        }
+    }
+    var handler slog.Handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+    // The session summaries are always written to ACCESS_LOG_FILE, whatever
+    // LOG_LEVEL keeps on stderr.
+    if v := getenv("ACCESS_LOG_FILE"); v != "" {
+        accessLog := newAccessLog(v,
+            envInt("ACCESS_LOG_MAX_SIZE", 100, 1),
+            envInt("ACCESS_LOG_MAX_BACKUPS", 0, 0),
+            envInt("ACCESS_LOG_MAX_AGE", 0, 0),
+        )
+        handler = accessLogHandler{lifecycle: handler, access: slog.NewJSONHandler(accessLog, nil)}
+    }
+    slog.SetDefault(slog.New(handler))
+    var err error
+    if logTargets, err = parseLogTargets(getenv("LOG_TARGETS")); err != nil {
+        fatal("Invalid LOG_TARGETS", "value", getenv("LOG_TARGETS"), "error", err)
+    }
+    if salt := envSecret("LOG_TARGETS_SALT"); salt != "" {
+        logTargetSalt = []byte(salt)
+    }
+
+    if configErr != nil {
+        fatal("Invalid CONFIG_FILE", "error", configErr)
+    }
+
+    users, err = parseUsers(envSecret("UUID") + "," + envSecret("UUIDS"))
+    if err != nil {
+        fatal("Invalid user configuration", "error", err)
+    }
+    if len(users) == 0 {
+        slog.Warn("No UUID configured, using the default UUID")
+        id, _ := parseUUID(defaultUUID)
+        users[id] = "default"
+    }
+
+    ports = splitList(getenv("PORTS"))
+    if len(ports) == 0 {
+        ports = []string{strconv.Itoa(envInt("PORT", 8080, 1))}
+    }
+    for _, port := range ports {
+        if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+            fatal("Invalid port: must be between 1 and 65535", "value", port)
+        }
+    }
+    bindAddr = getenv("BIND_ADDR")
+    if _, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(bindAddr, ports[0])); err != nil {
+        fatal("Invalid BIND_ADDR", "value", bindAddr, "error", err)
+    }
+    wsPath = getenv("WS_PATH")
+    if wsPath == "" {
+        wsPath = "/"
+    } else if !strings.HasPrefix(wsPath, "/") {
+        fatal("Invalid WS_PATH: must start with /", "value", wsPath)
+    }
+    if vmessPath = getenv("VMESS_PATH"); vmessPath != "" {
+        if !strings.HasPrefix(vmessPath, "/") || vmessPath == wsPath {
+            fatal("Invalid VMESS_PATH: must start with / and differ from WS_PATH", "value", vmessPath)
+        }
+        vmessUsers = newVMessUsers(users)
+    }
+    if v := envSecret("TROJAN_PASSWORD"); v != "" {
+        trojanKey = newTrojanKey(v)
+    }
+    if v := envSecret("OBFS_KEY"); v != "" {
+        obfsKey = newObfsKey(v)
+    }
+
+    bufferSize = envInt("BUFFER_SIZE", 32*1024, 1)
+    maxInflight = envInt("MAX_INFLIGHT", bufferSize, 1)
+    rateBPS = envInt("RATE_BPS", 0, 0)
+    if globalRateBPS = envInt("GLOBAL_RATE_BPS", 0, 0); globalRateBPS > 0 {
+        globalLimiter = newBandwidthLimiter(globalRateBPS)
+    }
+    if n := envInt("QUOTA_BYTES", 0, 0); n > 0 {
+        period := getenv("QUOTA_PERIOD")
+        if period == "" {
+            period = "month"
+        }
+        if quota, err = newEgressQuota(int64(n), period, getenv("QUOTA_FILE")); err != nil {
+            fatal("Invalid quota configuration", "error", err)
+        }
+    }
+    maxMessageSize = int64(envInt("MAX_MESSAGE_SIZE", 4<<20, 1))
+    upgrader.ReadBufferSize = envInt("WS_READ_BUFFER", 32*1024, 1)
+    upgrader.WriteBufferSize = envInt("WS_WRITE_BUFFER", 32*1024, 1)
+    upgrader.EnableCompression = getenv("WS_COMPRESS") == "1"
+    compressMin = envInt("COMPRESS_MIN", 512, 0)
+    coalesceWindow = time.Duration(envInt("COALESCE_MS", 0, 0)) * time.Millisecond
+    allowedOrigins = splitList(getenv("ALLOWED_ORIGINS"))
+    wsSubprotocols = splitList(getenv("WS_SUBPROTOCOLS"))
+    if n := envInt("MAX_CONNS", 0, 0); n > 0 {
+        connSlots = make(chan struct{}, n)
+    }
+    maxPumps = int64(envInt("MAX_PUMPS", 0, 0))
+    if v := getenv("RATE_LIMIT"); v != "" {
+        rate, err := strconv.ParseFloat(v, 64)
+        if err != nil || rate <= 0 {
+            fatal("Invalid RATE_LIMIT: must be a positive number of connections per second", "value", v)
+        }
+        connLimiter = newIPLimiter(rate, envInt("RATE_BURST", max(1, int(rate)), 1))
+    }
+    trustProxy = getenv("TRUST_PROXY") == "1"
+    idleTimeout = envDuration("IDLE_TIMEOUT", 300*time.Second)
+    pingInterval = envDuration("PING_INTERVAL", 30*time.Second)
+    pongTimeout = envDuration("PONG_TIMEOUT", 30*time.Second)
+    writeTimeout = envDuration("WRITE_TIMEOUT", 30*time.Second)
+    maxSession = envDuration("MAX_SESSION", 0)
+    handshakeTimeout = envDuration("HANDSHAKE_TIMEOUT", 10*time.Second)
+    shutdownGrace = envDuration("SHUTDOWN_GRACE", 10*time.Second)
+    dialer = &net.Dialer{Timeout: envDuration("DIAL_TIMEOUT", 10*time.Second)}
+    if v := getenv("OUTBOUND_IP"); v != "" {
+        if outboundIP = net.ParseIP(v); outboundIP == nil {
+            fatal("Invalid OUTBOUND_IP", "value", v)
+        }
+    }
+    if v := getenv("OUTBOUND_IFACE"); v != "" {
+        if dialer.Control, err = bindToDevice(v); err != nil {
+            fatal("Invalid OUTBOUND_IFACE", "value", v, "error", err)
+        }
+    }
+    if v := getenv("SRC_PORT_RANGE"); v != "" {
+        if srcPorts, err = parsePortRange(v); err != nil {
+            fatal("Invalid SRC_PORT_RANGE", "value", v, "error", err)
+        }
+    }
+    forward := dialerFor("tcp")
+    poolIdle = envDuration("POOL_IDLE", 0)
+    if poolIdle > 0 {
+        forward = newDialPool(dialerFor("tcp"), poolIdle)
+        if getenv("POOL_ALL") == "1" {
+            targetPool = newDialPool(dialerFor("tcp"), poolIdle)
+        }
+    }
+    if v := envSecret("UPSTREAM_PROXY"); v != "" {
+        if upstreamDialer, err = newUpstreamDialer(v, forward); err != nil {
+            fatal("Invalid UPSTREAM_PROXY", "value", v, "error", err)
+        }
+    }
+    if v := getenv("UPSTREAM_WS"); v != "" {
+        if upstreamDialer != nil {
+            fatal("UPSTREAM_WS cannot be combined with UPSTREAM_PROXY")
+        }
+        if upstreamDialer, err = newWSUpstreamDialer(v, envSecret("UPSTREAM_UUID"), forward); err != nil {
+            fatal("Invalid UPSTREAM_WS", "value", v, "error", err)
+        }
+    }
+    dialRetries = envInt("DIAL_RETRIES", 0, 0)
+    tcpKeepAlive = envDuration("TCP_KEEPALIVE", 15*time.Second)
+    dialBackoff = envDuration("DIAL_BACKOFF", 200*time.Millisecond)
+    resolver = newDNSCache(
+        envDuration("DNS_CACHE_TTL", 60*time.Second),
+        envDuration("DNS_NEGATIVE_TTL", 5*time.Second),
+    )
+    if sendProxyProto, err = parseProxyProtoVersion(getenv("SEND_PROXY_PROTO")); err != nil {
+        fatal("Invalid SEND_PROXY_PROTO", "value", getenv("SEND_PROXY_PROTO"), "error", err)
+    }
+    if v := getenv("DOH_URL"); v != "" {
+        doh, err := newDoHResolver(v)
+        if err != nil {
+            fatal("Invalid DOH_URL", "value", v, "error", err)
+        }
+        resolver.lookup = doh.LookupIP
+    }
+    allowPrivate = getenv("ALLOW_PRIVATE") == "1"
+    allowHosts = parseHostPatterns(getenv("ALLOW_HOSTS"))
+    denyHosts = parseHostPatterns(getenv("DENY_HOSTS"))
+    sniff = getenv("SNIFF") == "1"
+    sniffAllowHosts = parseHostPatterns(getenv("SNIFF_ALLOW_HOSTS"))
+    sniffDenyHosts = parseHostPatterns(getenv("SNIFF_DENY_HOSTS"))
+    if v := getenv("ROUTE_MAP"); v != "" {
+        if routeMap, err = parseRouteMap(v); err != nil {
+            fatal("Invalid ROUTE_MAP", "error", err)
+        }
+    }
+
+    switch v := getenv("DIAL_NETWORK"); v {
+    case "", "tcp":
+    case "tcp4", "tcp6":
+        dialFamily = v[3:]
+    default:
+        fatal("Invalid DIAL_NETWORK: must be tcp, tcp4 or tcp6", "value", v)
+    }
+    happyEyeballs = getenv("HAPPY_EYEBALLS") == "1"
+
+    if v := getenv("FALLBACK_URL"); v != "" {
+        fallback, err = newFallbackProxy(v)
+        if err != nil {
+            fatal("Invalid FALLBACK_URL", "value", v, "error", err)
+        }
+    } else if v := getenv("FALLBACK_DIR"); v != "" {
+        fallback = http.FileServer(http.Dir(v))
+    }
+    rootStatus = envInt("ROOT_STATUS", http.StatusOK, 100)
+    if rootStatus > 599 {
+        fatal("Invalid ROOT_STATUS", "value", rootStatus)
+    }
+    rootResponse = getenv("ROOT_RESPONSE")
+    switch {
+    case rootResponse != "":
+    case rootStatus == http.StatusOK:
+        rootResponse = "Server is running"
+    case rootStatus == http.StatusNotFound:
+        // The body net/http sends for a path it does not serve.
+        rootResponse = "404 page not found\n"
+    default:
+        rootResponse = http.StatusText(rootStatus)
+    }
+
+    statsToken = envSecret("STATS_TOKEN")
+    statsPushURL = getenv("STATS_PUSH_URL")
+    statsPushInterval = envDuration("STATS_PUSH_INTERVAL", time.Minute)
+    statsPushToken = envSecret("STATS_PUSH_TOKEN")
+    if statsPushURL != "" && statsPushInterval == 0 {
+        fatal("STATS_PUSH_INTERVAL must be positive")
+    }
+    adminToken = envSecret("ADMIN_TOKEN")
+    probeResist = getenv("PROBE_RESIST") == "1"
+    upgradeAuth = envSecret("UPGRADE_AUTH")
+    socks5Addr = getenv("SOCKS5_ADDR")
+    socks5Auth = envSecret("SOCKS5_AUTH")
+    enableConnect = getenv("ENABLE_CONNECT") == "1"
+    connectAuth = envSecret("CONNECT_AUTH")
+
+    unixSocket = getenv("UNIX_SOCKET")
+    if v := getenv("UNIX_SOCKET_MODE"); v != "" {
+        mode, err := strconv.ParseUint(v, 8, 32)
+        if err != nil {
+            fatal("Invalid UNIX_SOCKET_MODE: must be an octal file mode", "value", v)
+        }
+        unixSocketMode = fs.FileMode(mode)
+    }
+    if unixSocket != "" && len(ports) > 1 {
+        fatal("UNIX_SOCKET cannot be combined with several PORTS")
+    }
+
+    tlsCert = getenv("TLS_CERT")
+    tlsKey = getenv("TLS_KEY")
+    tlsAuto = getenv("TLS_AUTO") == "1"
+    tlsDomains = splitList(getenv("TLS_DOMAINS"))
+    tlsCacheDir = getenv("TLS_CACHE_DIR")
+    if tlsCacheDir == "" {
+        tlsCacheDir = "certs"
+    }
+    if tlsAuto && len(tlsDomains) == 0 {
+        fatal("TLS_AUTO requires TLS_DOMAINS")
+    }
+    if (tlsCert == "") != (tlsKey == "") {
+        fatal("TLS_CERT and TLS_KEY must be set together")
+    }
+    if v := getenv("TLS_CLIENT_CA"); v != "" {
+        if !tlsAuto && tlsCert == "" {
+            fatal("TLS_CLIENT_CA requires TLS_CERT and TLS_KEY or TLS_AUTO")
+        }
+        pem, err := os.ReadFile(v)
+        if err != nil {
+            fatal("Invalid TLS_CLIENT_CA", "error", err)
+        }
+        tlsClientCAs = x509.NewCertPool()
+        if !tlsClientCAs.AppendCertsFromPEM(pem) {
+            fatal("Invalid TLS_CLIENT_CA: no PEM certificates found", "path", v)
+        }
+    }
+
+    slog.Info("Build", "version", version, "commit", commit, "build_date", buildDate)
+    logConfig()
+}
+
+// logConfig logs the effective configuration in one line so that a
+// misconfigured deployment can be diagnosed from its startup log. Secrets
+// are reported only as being set.
+func logConfig() {
+    slog.Info("Effective configuration",
+        "bind_addr", bindAddr,
+        "ports", ports,
+        "ws_path", wsPath,
+        "vmess_path", vmessPath,
+        "trojan", trojanKey != nil,
+        "obfs", obfsKey != nil,
+        "users", len(users),
+        "buffer_size", bufferSize,
+        "max_message_size", maxMessageSize,
+        "ws_compress", upgrader.EnableCompression,
+        "compress_min", compressMin,
+        "coalesce_window", coalesceWindow.String(),
+        "max_inflight", maxInflight,
+        "rate_bps", rateBPS,
+        "global_rate_bps", globalRateBPS,
+        "quota", quota != nil,
+        "max_conns", cap(connSlots),
+        "max_pumps", maxPumps,
+        "rate_limit", connLimiter != nil,
+        "idle_timeout", idleTimeout.String(),
+        "ping_interval", pingInterval.String(),
+        "pong_timeout", pongTimeout.String(),
+        "write_timeout", writeTimeout.String(),
+        "max_session", maxSession.String(),
+        "handshake_timeout", handshakeTimeout.String(),
+        "dial_timeout", dialer.Timeout.String(),
+        "dial_retries", dialRetries,
+        "tcp_keepalive", tcpKeepAlive.String(),
+        "dial_network", "tcp"+dialFamily,
+        "outbound_iface", getenv("OUTBOUND_IFACE"),
+        "src_port_range", getenv("SRC_PORT_RANGE"),
+        "allow_private", allowPrivate,
+        "sniff", sniff,
+        "routes", len(routeMap),
+        "happy_eyeballs", happyEyeballs,
+        "upstream_proxy", upstreamDialer != nil,
+        "pool_idle", poolIdle.String(),
+        "pool_all", targetPool != nil,
+        "fallback", fallback != nil,
+        "stats", statsToken != "",
+        "stats_push", statsPushURL != "",
+        "admin", adminToken != "",
+        "probe_resist", probeResist,
+        "upgrade_auth", upgradeAuth != "",
+        "socks5", socks5Addr,
+        "connect", enableConnect,
+        "unix_socket", unixSocket,
+        "tls", tlsAuto || tlsCert != "",
+        "tls_client_ca", tlsClientCAs != nil,
+        "log_targets", logTargets,
+        "access_log_file", getenv("ACCESS_LOG_FILE"),
+        "doh", getenv("DOH_URL") != "",
+        "send_proxy_proto", sendProxyProto,
+    )
+}
+
+// parseUUID decodes a UUID string, with or without dashes, into its 16 bytes.
+func parseUUID(s string) ([16]byte, error) {
+    var id [16]byte
+    b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+    if err != nil {
+        return id, err
+    }
+    if len(b) != len(id) {
+        return id, fmt.Errorf("expected %d bytes, got %d", len(id), len(b))
+    }
+    copy(id[:], b)
+    return id, nil
+}
+
+// parseUsers builds the user table from a comma-separated list of UUIDs.
+// Each entry may be prefixed with "label:" to name it in the logs; entries
+// without a label are named by their position in the list.
+func parseUsers(list string) (map[[16]byte]string, error) {
+    users := make(map[[16]byte]string)
+    for n, entry := range splitList(list) {
+        label, uuid, ok := strings.Cut(entry, ":")
+        if !ok {
+            label, uuid = fmt.Sprintf("user%d", n+1), entry
+        }
+        id, err := parseUUID(uuid)
+        if err != nil {
+            return nil, fmt.Errorf("invalid UUID %q: %w", uuid, err)
+        }
+        users[id] = label
+    }
+    return users, nil
+}
+
+// splitList splits a comma-separated setting into its non-empty, trimmed
+// entries.
+func splitList(s string) []string {
+    var list []string
+    for _, entry := range strings.Split(s, ",") {
+        if entry = strings.TrimSpace(entry); entry != "" {
+            list = append(list, entry)
+        }
+    }
+    return list
+}
+
+// envInt reads an integer of at least min from the named environment
+// variable, falling back to def when it is unset.
+func envInt(name string, def, min int) int {
+    v := getenv(name)
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < min {
+        fatal("Invalid "+name+": must be an integer of at least "+strconv.Itoa(min), "value", v)
+    }
+    return n
+}
+
+// envSecret reads a secret, taking the first of these that is set:
+//
+//  1. the named environment variable;
+//  2. the file named by the environment variable with _FILE appended, as
+//     mounted by secret managers, with surrounding whitespace trimmed;
+//  3. the named setting in CONFIG_FILE.
+//
+// Every secret is read here, so they all follow this order.
+func envSecret(name string) string {
+    if v := os.Getenv(name); v != "" {
+        return v
+    }
+    if path := os.Getenv(name + "_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            fatal("Failed to read "+name+"_FILE", "error", err)
+        }
+        return strings.TrimSpace(string(data))
+    }
+    return fileConfig[name]
+}
+
+// fatal logs msg at error level and exits. It stands in for log.Fatal,
+// which slog has no equivalent of.
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
+// envDuration reads a time.Duration from the named environment variable,
+// falling back to def when it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+    v := getenv(name)
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        fatal("Invalid "+name, "value", v, "error", err)
+    }
+    if d < 0 {
+        fatal("Invalid "+name+": must not be negative", "value", v)
+    }
+    return d
+}
+
+func main() {
+    validate := flag.Bool("validate", false, "check the configuration and exit without serving")
+    genclient := flag.Bool("genclient", false, "print a vless:// URL for every user and exit without serving")
+    clientHost := flag.String("host", "", "the server's host name in the URLs printed by -genclient")
+    clientPort := flag.String("port", "", "the server's port in the URLs printed by -genclient")
+    flag.Parse()
+    if *validate || getenv("VALIDATE") == "1" {
+        validateConfig()
+        return
+    }
+    if *genclient {
+        if err := genClient(os.Stdout, *clientHost, *clientPort); err != nil {
+            fatal("Failed to write client configuration", "error", err)
+        }
+        return
+    }
+
+    handler := newHandler()
+    var servers []*http.Server
+    for _, port := range ports {
+        srv := &http.Server{Addr: net.JoinHostPort(bindAddr, port), Handler: handler}
+        ln, err := listen(srv.Addr)
+        if err != nil {
+            fatal("Failed to listen", "error", err)
+        }
+
+        go func() {
+            if err := serve(srv, ln); err != nil && err != http.ErrServerClosed {
+                slog.Error("Server error", "error", err)
+                logSummary("error")
+                os.Exit(1)
+            }
+        }()
+        servers = append(servers, srv)
+        slog.Info("Server is running", "addr", ln.Addr().String(), "tls", tlsAuto || tlsCert != "")
+    }
+
+    var socksLn net.Listener
+    if socks5Addr != "" {
+        var err error
+        if socksLn, err = net.Listen("tcp", socks5Addr); err != nil {
+            fatal("Failed to listen for SOCKS5", "error", err)
+        }
+        go serveSOCKS5(socksLn)
+        slog.Info("SOCKS5 frontend is running", "addr", socksLn.Addr().String())
+    }
+    if quota != nil && quota.file != "" {
+        go quota.saveEvery(quotaSaveInterval)
+    }
+    if statsPushURL != "" {
+        go pushStats()
+    }
+    ready.Store(true)
+
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+    sig := <-sigChan
+
+    slog.Info("Shutting down", "signal", sig.String())
+    if socksLn != nil {
+        socksLn.Close()
+    }
+    shutdown(servers)
+    if quota != nil && quota.file != "" {
+        if err := quota.save(); err != nil {
+            slog.Warn("Failed to save QUOTA_FILE", "error", err)
+        }
+    }
+    logSummary("signal", "signal", sig.String())
+}
+
+// newHandler returns the handler every listener serves: the proxy and the
+// fallback site at the root, the health and status endpoints, and those of
+// the optional features that are enabled.
+func newHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", handleRequest)
+    mux.HandleFunc("/health", handleHealth)
+    mux.HandleFunc("/healthz", handleHealth)
+    mux.HandleFunc("/livez", handleLive)
+    mux.HandleFunc("/readyz", handleReady)
+    mux.HandleFunc("/version", handleVersion)
+    if statsToken != "" {
+        mux.HandleFunc("/stats", handleStats)
+    }
+    if adminToken != "" {
+        registerAdmin(mux)
+    }
+    if getenv("METRICS") == "1" {
+        registerMetrics(mux)
+    }
+    if getenv("PPROF") == "1" {
+        registerPprof(mux, getenv("PPROF_ADDR"))
+    }
+
+    var handler http.Handler = mux
+    if enableConnect {
+        handler = connectHandler(handler)
+    }
+    if getenv("H2C") == "1" {
+        // HTTP/1.1 requests, including WebSocket upgrades, pass through
+        // the h2c handler unchanged.
+        handler = h2c.NewHandler(handler, &http2.Server{})
+    }
+    return handler
+}
+
+// logSummary writes the last line of a run: why the server stopped, for how
+// long it ran and what it served.
+func logSummary(reason string, args ...any) {
+    args = append([]any{
+        "reason", reason,
+        "uptime", time.Since(startTime).Round(time.Second).String(),
+        "sessions", sessionsServed.Load(),
+        "bytes_up", totalBytesUp.Load(),
+        "bytes_down", totalBytesDown.Load(),
+    }, args...)
+    slog.Info("Server stopped", args...)
+}
+
+// validateConfig runs the checks that would otherwise only fail once the
+// server starts. The settings themselves have already been validated, and
+// the effective configuration logged, by init.
+func validateConfig() {
+    if tlsCert != "" {
+        if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+            fatal("Invalid TLS_CERT or TLS_KEY", "error", err)
+        }
+    }
+    slog.Info("Configuration is valid")
+}
+
+// listen opens the server's listener: the Unix socket at UNIX_SOCKET when
+// one is configured, and the TCP address addr otherwise. A socket file left
+// behind by an earlier run is removed first.
+func listen(addr string) (net.Listener, error) {
+    if unixSocket == "" {
+        return net.Listen("tcp", addr)
+    }
+
+    if err := os.Remove(unixSocket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+    }
+    ln, err := net.Listen("unix", unixSocket)
+    if err != nil {
+        return nil, err
+    }
+    if unixSocketMode != 0 {
+        if err := os.Chmod(unixSocket, unixSocketMode); err != nil {
+            ln.Close()
+            return nil, fmt.Errorf("failed to set socket mode: %w", err)
+        }
+    }
+    return ln, nil
+}
+
+// serve runs srv on ln over HTTPS when a certificate is configured through
+// TLS_CERT and TLS_KEY or requested from Let's Encrypt with TLS_AUTO, and
+// over plain HTTP otherwise. With TLS_CLIENT_CA, clients must also present
+// a certificate signed by it.
+func serve(srv *http.Server, ln net.Listener) error {
+    switch {
+    case tlsAuto:
+        m := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(tlsDomains...),
+            Cache:      autocert.DirCache(tlsCacheDir),
+        }
+        srv.TLSConfig = m.TLSConfig()
+        requireClientCert(srv.TLSConfig)
+        return srv.ServeTLS(ln, "", "")
+    case tlsCert != "" && tlsKey != "":
+        srv.TLSConfig = &tls.Config{}
+        requireClientCert(srv.TLSConfig)
+        return srv.ServeTLS(ln, tlsCert, tlsKey)
+    default:
+        return srv.Serve(ln)
+    }
+}
+
+func requireClientCert(config *tls.Config) {
+    if tlsClientCAs != nil {
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+        config.ClientCAs = tlsClientCAs
+    }
+}
+
+// shutdown stops every server accepting new connections and waits up to
+// shutdownGrace for active proxy sessions to finish before closing the
+// remaining ones.
+func shutdown(servers []*http.Server) {
+    draining.Store(true)
+
+    ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+    defer cancel()
+
+    // Shutdown returns once no request is still inside a handler, so every
+    // session has been added to the wait group by the time it is waited on.
+    var stopped sync.WaitGroup
+    for _, srv := range servers {
+        stopped.Add(1)
+        go func() {
+            defer stopped.Done()
+            if err := srv.Shutdown(ctx); err != nil {
+                slog.Error("Shutdown error", "addr", srv.Addr, "error", err)
+            }
+        }()
+    }
+    stopped.Wait()
+
+    done := make(chan struct{})
+    go func() {
+        sessions.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        slog.Info("All sessions finished")
+    case <-ctx.Done():
+        slog.Warn("Grace period expired, closing remaining sessions")
+        cancelSessions()
+    }
+}
+
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+    if handle := requestHandlerFor(r); handle != nil {
+        if draining.Load() {
+            http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+            return
+        }
+        if maxPumps > 0 && activePumps.Load() >= maxPumps {
+            overloaded(w)
+            return
+        }
+        if quiesced.Load() {
+            http.Error(w, "Server is not accepting new connections", http.StatusServiceUnavailable)
+            return
+        }
+        if connLimiter != nil && !connLimiter.allow(clientIP(r)) {
+            http.Error(w, "Too many requests", http.StatusTooManyRequests)
+            return
+        }
+        if upgradeAuth != "" && !validUpgradeAuth(r) {
+            if strings.Contains(upgradeAuth, ":") {
+                w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+            } else {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+            }
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        handleWebSocket(w, r, handle)
+        return
+    }
+
+    if fallback != nil {
+        fallback.ServeHTTP(w, r)
+        return
+    }
+
+    w.WriteHeader(rootStatus)
+    w.Write([]byte(rootResponse))
+}
+
+// requestHandler parses a proxy request that arrived in message and serves
+// its session on wsConn.
+type requestHandler func(wsConn *clientConn, message []byte, logger *slog.Logger) error
+
+// requestHandlerFor returns the handler of the protocol served on the path
+// of r, or nil when r is not a proxy upgrade.
+func requestHandlerFor(r *http.Request) requestHandler {
+    if !websocket.IsWebSocketUpgrade(r) {
+        return nil
+    }
+    switch {
+    case r.URL.Path == wsPath:
+        return handleProxyRequest
+    case vmessPath != "" && r.URL.Path == vmessPath:
+        return handleVMessRequest
+    }
+    return nil
+}
+
+// clientIP returns the IP address of the client that sent r. Behind a
+// trusted proxy (TRUST_PROXY=1) that is the last address the proxy added to
+// X-Forwarded-For, or its X-Real-IP, rather than the proxy's own. Headers
+// that do not hold a valid address are ignored.
+func clientIP(r *http.Request) string {
+    if trustProxy {
+        // Earlier hops were written by the client and cannot be trusted;
+        // only the proxy's own entry is.
+        hops := splitList(strings.Join(r.Header.Values("X-Forwarded-For"), ","))
+        if len(hops) > 0 {
+            if ip := net.ParseIP(hops[len(hops)-1]); ip != nil {
+                return ip.String()
+            }
+        }
+        if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+            return ip.String()
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// earlyData returns the first message of a session when the client sent it
+// with the upgrade request to save a round trip, base64url-encoded in the
+// "ed" query parameter or in Sec-WebSocket-Protocol. fromProtocol reports
+// which of the two it came from. An "ed" that is a number only announces
+// how much early data the client may send and is ignored, as is a
+// Sec-WebSocket-Protocol that does not decode or that names one of
+// WS_SUBPROTOCOLS, since it is then a real subprotocol.
+func earlyData(r *http.Request) (data []byte, fromProtocol bool, err error) {
+    if ed := r.URL.Query().Get("ed"); ed != "" {
+        if _, err := strconv.Atoi(ed); err != nil {
+            data, err = decodeEarlyData(ed)
+            return data, false, err
+        }
+    }
+    if proto := r.Header.Get("Sec-WebSocket-Protocol"); proto != "" && selectSubprotocol(r) == "" {
+        if data, err := decodeEarlyData(proto); err == nil {
+            return data, true, nil
+        }
+    }
+    return nil, false, nil
+}
+
+// selectSubprotocol returns the first subprotocol requested by r that is
+// listed in WS_SUBPROTOCOLS, or an empty string when there is none.
+func selectSubprotocol(r *http.Request) string {
+    for _, proto := range websocket.Subprotocols(r) {
+        if slices.Contains(wsSubprotocols, proto) {
+            return proto
+        }
+    }
+    return ""
+}
+
+func decodeEarlyData(s string) ([]byte, error) {
+    data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(data)) > maxMessageSize {
+        return nil, fmt.Errorf("early data exceeds MAX_MESSAGE_SIZE")
+    }
+    if len(data) == 0 {
+        return nil, nil
+    }
+    return data, nil
+}
+
+// newFallbackProxy returns a reverse proxy to rawURL, so that anyone probing
+// the server sees an ordinary website instead of a proxy endpoint.
+func newFallbackProxy(rawURL string) (http.Handler, error) {
+    target, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    if target.Scheme == "" || target.Host == "" {
+        return nil, fmt.Errorf("missing scheme or host")
+    }
+
+    proxy := httputil.NewSingleHostReverseProxy(target)
+    director := proxy.Director
+    proxy.Director = func(r *http.Request) {
+        director(r)
+        // Virtual hosts at the upstream expect their own name.
+        r.Host = target.Host
+    }
+    return proxy, nil
+}
+
+// checkOrigin accepts an upgrade whose Origin is listed in ALLOWED_ORIGINS,
+// where "*" matches any origin. Requests without an Origin header come from
+// non-browser clients and are always accepted, as is everything when no
+// origins are configured.
+func checkOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" || len(allowedOrigins) == 0 {
+        return true
+    }
+    for _, allowed := range allowedOrigins {
+        if allowed == "*" || strings.EqualFold(allowed, origin) {
+            return true
+        }
+    }
+    return false
+}
+
+// upgradeError answers a request that could not be upgraded to a WebSocket
+// with status and a one-line body naming the reason, instead of the bare
+// status text, so that a misconfigured client can tell what went wrong.
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+    slog.Warn("WebSocket upgrade error", "client_ip", clientIP(r), "status", status, "error", reason)
+    w.Header().Set("Sec-WebSocket-Version", "13")
+    http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(status), reason), status)
+}
+
+// validUpgradeAuth reports whether a proxy upgrade carries the credentials
+// in UPGRADE_AUTH: Basic credentials when it is user:password, and a bearer
+// token otherwise.
+func validUpgradeAuth(r *http.Request) bool {
+    if !strings.Contains(upgradeAuth, ":") {
+        return validBearerToken(r, upgradeAuth)
+    }
+    want := "Basic " + base64.StdEncoding.EncodeToString([]byte(upgradeAuth))
+    return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// validBearerToken reports whether the request's Authorization header
+// carries token as a bearer token.
+func validBearerToken(r *http.Request, token string) bool {
+    got := r.Header.Get("Authorization")
+    return subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) == 1
+}
+
+// handleHealth reports liveness for platform health checks. It never
+// attempts a WebSocket upgrade. The status is "quiesced" rather than "ok"
+// while new sessions are refused through /admin/quiesce.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+    status := "ok"
+    if quiesced.Load() {
+        status = "quiesced"
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Status            string `json:"status"`
+        UptimeSeconds     int64  `json:"uptime_seconds"`
+        ActiveConnections int64  `json:"active_connections"`
+        ActivePumps       int64  `json:"active_pumps"`
+    }{
+        Status:            status,
+        UptimeSeconds:     int64(time.Since(startTime).Seconds()),
+        ActiveConnections: activeConnections.Load(),
+        ActivePumps:       activePumps.Load(),
+    })
+}
+
+// handleLive answers 200 for as long as the process is serving at all, so
+// that an orchestrator only restarts a server that has stopped responding.
+func handleLive(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("ok\n"))
+}
+
+// handleReady answers 200 only while the server takes new sessions: once
+// every listener is bound, and not while quiesced or shutting down, so that
+// an orchestrator routes traffic elsewhere at those times.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+    switch {
+    case draining.Load():
+        http.Error(w, "shutting down", http.StatusServiceUnavailable)
+    case quiesced.Load():
+        http.Error(w, "quiesced", http.StatusServiceUnavailable)
+    case !ready.Load():
+        http.Error(w, "starting", http.StatusServiceUnavailable)
+    default:
+        w.Write([]byte("ok\n"))
+    }
+}
+
+// handleVersion reports the build that is running.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Version   string `json:"version"`
+        Commit    string `json:"commit"`
+        BuildDate string `json:"build_date"`
+        GoVersion string `json:"go_version"`
+    }{
+        Version:   version,
+        Commit:    commit,
+        BuildDate: buildDate,
+        GoVersion: runtime.Version(),
+    })
+}
+
+// overloadRetryAfter is the least backoff suggested to clients turned away
+// because the server is at MAX_CONNS or MAX_PUMPS.
+const overloadRetryAfter = 5 * time.Second
+
+// retryAfter returns the backoff in seconds to suggest to a client turned
+// away for being over capacity: overloadRetryAfter plus up to as much again
+// at random, so that the clients refused together do not all come back at
+// the same moment.
+func retryAfter() int {
+    base := int(overloadRetryAfter / time.Second)
+    return base + mathrand.IntN(base+1)
+}
+
+// overloaded refuses a request because the server is over capacity, with a
+// Retry-After header telling the client when to try again.
+func overloaded(w http.ResponseWriter) {
+    w.Header().Set("Retry-After", strconv.Itoa(retryAfter()))
+    http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+}
+
+// acquirePumps reserves one of the MAX_PUMPS pump pairs for a session about
+// to start its pumps. It reports false when all are taken; otherwise release
+// must be called once both pumps have finished. handleRequest already turns
+// clients away while the ceiling is reached, but only this reservation
+// enforces it.
+func acquirePumps() (release func(), ok bool) {
+    if n := activePumps.Add(1); maxPumps > 0 && n > maxPumps {
+        activePumps.Add(-1)
+        return nil, false
+    }
+    return func() { activePumps.Add(-1) }, true
+}
+
+// acquireSlot reserves one of the MAX_CONNS session slots. It reports false
+// when all slots are taken; otherwise release must be called once the
+// session ends.
+func acquireSlot() (release func(), ok bool) {
+    if connSlots == nil {
+        return func() {}, true
+    }
+    select {
+    case connSlots <- struct{}{}:
+        return func() { <-connSlots }, true
+    default:
+        return nil, false
+    }
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request, handle requestHandler) {
+    sessions.Add(1)
+    defer sessions.Done()
+
+    release, ok := acquireSlot()
+    if !ok {
+        overloaded(w)
+        return
+    }
+    defer release()
+
+    early, fromProtocol, err := earlyData(r)
+    if err != nil {
+        http.Error(w, "Invalid early data", http.StatusBadRequest)
+        return
+    }
+    // Clients that carry early data in Sec-WebSocket-Protocol expect it
+    // echoed back as the selected subprotocol. Otherwise the first of the
+    // client's subprotocols listed in WS_SUBPROTOCOLS is selected. This is
+    // done here rather than through upgrader.Subprotocols, which would
+    // override the echo.
+    var responseHeader http.Header
+    if fromProtocol {
+        responseHeader = http.Header{"Sec-WebSocket-Protocol": {r.Header.Get("Sec-WebSocket-Protocol")}}
+    } else if proto := selectSubprotocol(r); proto != "" {
+        responseHeader = http.Header{"Sec-WebSocket-Protocol": {proto}}
+    }
+
+    // A request that cannot be upgraded has already been answered and
+    // logged by upgradeError.
+    ws, err := upgrader.Upgrade(w, r, responseHeader)
+    if err != nil {
+        return
+    }
+    conn := &clientConn{Conn: ws}
+    conn.client, conn.local = requestAddrs(r)
+    if obfsKey != nil {
+        conn.obfs = &obfsCodec{}
+    }
+    defer conn.Close()
+
+    defer trackSession(conn)()
+
+    logger := slog.With("conn_id", newConnID(), "client_ip", clientIP(r))
+    if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+        logger = logger.With("client_cert", r.TLS.PeerCertificates[0].Subject.String())
+    }
+    logger.Debug("New WebSocket connection established", "remote_addr", r.RemoteAddr)
+    defer recoverPanic(logger, nil)
+
+    // Larger frames fail the read and gorilla/websocket closes the
+    // connection with CloseMessageTooBig, both here and in the pumps.
+    conn.SetReadLimit(maxMessageSize)
+
+    // A client must send its request header within HANDSHAKE_TIMEOUT of
+    // the upgrade. Until it does, pongs cannot move the read deadline past
+    // handshakeDeadline. Pong handlers run inside reads, so handshakeDone
+    // is only touched by one goroutine at a time.
+    var handshakeDeadline time.Time
+    handshakeDone := handshakeTimeout == 0 || early != nil
+    readDeadline := func() time.Time {
+        var deadline time.Time
+        if pingInterval > 0 {
+            deadline = time.Now().Add(pingInterval + pongTimeout)
+        }
+        if !handshakeDone && (deadline.IsZero() || deadline.After(handshakeDeadline)) {
+            deadline = handshakeDeadline
+        }
+        return deadline
+    }
+    if handshakeTimeout > 0 {
+        handshakeDeadline = time.Now().Add(handshakeTimeout)
+    }
+    conn.setPongDeadline(readDeadline())
+
+    if pingInterval > 0 {
+        // Every pong moves the read deadline forward; a client that stops
+        // answering pings fails its next read and the session closes.
+        conn.SetPongHandler(func(string) error {
+            return conn.setPongDeadline(readDeadline())
+        })
+
+        done := make(chan struct{})
+        defer close(done)
+        sessions.Add(1)
+        go func() {
+            defer sessions.Done()
+            keepAlive(conn, done, logger)
+        }()
+    }
+
+    // pending holds the start of a request header split across messages.
+    var pending []byte
+    for {
+        // Early data stands in for the first message.
+        messageType, message := websocket.BinaryMessage, early
+        early = nil
+        if message == nil {
+            messageType, message, err = conn.ReadMessage()
+        } else {
+            message, err = conn.open(message)
+        }
+        if errors.Is(err, websocket.ErrReadLimit) {
+            logger.Warn("Message exceeds MAX_MESSAGE_SIZE, closing", "limit", maxMessageSize)
+            return
+        }
+        var netErr net.Error
+        if !handshakeDone && errors.As(err, &netErr) && netErr.Timeout() {
+            if pending == nil {
+                logger.Warn("No request header within HANDSHAKE_TIMEOUT, closing", "timeout", handshakeTimeout)
+                return
+            }
+            logger.Warn("Request header incomplete within HANDSHAKE_TIMEOUT, closing", "timeout", handshakeTimeout, "length", len(pending))
+            logger.Debug("Malformed request header", "prefix", hex.EncodeToString(pending[:min(len(pending), loggedHeaderBytes)]))
+            if !probeResist {
+                closeMessage := websocket.FormatCloseMessage(closeMalformedHeader, closeReasons[closeMalformedHeader])
+                conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+            }
+            return
+        }
+        if err != nil {
+            if isNormalClose(err) {
+                logger.Debug("Client closed the connection", "error", err)
+            } else {
+                logger.Warn("Read error", "error", err)
+            }
+            return
+        }
+
+        if messageType != websocket.BinaryMessage {
+            logger.Debug("Received non-binary message")
+            continue
+        }
+
+        if !handshakeDone {
+            handshakeDone = true
+            conn.setPongDeadline(readDeadline())
+        }
+
+        if pending != nil {
+            message = append(pending, message...)
+            pending = nil
+        }
+
+        err := handle(conn, message, logger)
+        if errors.Is(err, errShortHeader) && int64(len(message)) < maxMessageSize {
+            // Wait for the rest of the header, still within the time
+            // HANDSHAKE_TIMEOUT allowed for all of it.
+            pending = message
+            handshakeDone = handshakeTimeout == 0
+            conn.setPongDeadline(readDeadline())
+            continue
+        }
+        if err != nil {
+            if errors.Is(err, websocket.ErrReadLimit) {
+                logger.Warn("Message exceeds MAX_MESSAGE_SIZE, closing", "limit", maxMessageSize)
+                return
+            }
+            if isNormalClose(err) {
+                logger.Debug("Session closed", "error", err)
+                return
+            }
+            if probeResist && errors.Is(err, errAuthFailed) {
+                logger.Warn("Proxy error, stalling the client", "error", err)
+                stallProbe(conn)
+                return
+            }
+            var pe *proxyError
+            refused := errors.As(err, &pe)
+            if refused && pe.code == closeMalformedHeader {
+                logger.Warn("Request header parse error", "error", err)
+                logger.Debug("Malformed request header", "prefix", hex.EncodeToString(message[:min(len(message), loggedHeaderBytes)]))
+            } else {
+                logger.Warn("Proxy error", "error", err)
+            }
+
+            if refused {
+                reason := closeReasons[pe.code]
+                if pe.code == closeOverloaded {
+                    reason = fmt.Sprintf("%s, retry after %ds", reason, retryAfter())
+                }
+                closeMessage := websocket.FormatCloseMessage(pe.code, reason)
+                conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+            }
+            return
+        }
+    }
+}
+
+// probeStallMin and probeStallMax bound how long PROBE_RESIST keeps a client
+// that failed to authenticate connected. They are only changed by tests.
+var (
+    probeStallMin = 5 * time.Second
+    probeStallMax = 30 * time.Second
+)
+
+// stallProbe keeps the connection of a client that failed to authenticate
+// open for a random time, discarding whatever it sends, and then drops it
+// without a close frame. A prober sees what a session with a target that
+// never answers looks like, rather than an immediate close that tells it
+// the credentials were wrong.
+func stallProbe(conn *clientConn) {
+    conn.SetPongHandler(nil)
+    conn.setPongDeadline(time.Time{})
+    conn.SetReadDeadline(time.Now().Add(probeStallMin + mathrand.N(probeStallMax-probeStallMin)))
+    for {
+        if _, _, err := conn.Conn.ReadMessage(); err != nil {
+            return
+        }
+    }
+}
+
+// trackSession counts conn as an open connection and arranges for it to be
+// closed when the shutdown grace period expires. The returned function
+// undoes both and must be called when the session ends.
+func trackSession(conn io.Closer) (untrack func()) {
+    connectionsTotal.Inc()
+    activeConnections.Add(1)
+    stop := context.AfterFunc(sessionCtx, func() { conn.Close() })
+    return func() {
+        stop()
+        activeConnections.Add(-1)
+    }
+}
+
+// keepAlive pings the client every pingInterval until done is closed, so
+// that NATs and load balancers along the way do not drop idle tunnels.
+func keepAlive(conn *clientConn, done <-chan struct{}, logger *slog.Logger) {
+    ticker := time.NewTicker(pingInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongTimeout)); err != nil {
+                logger.Debug("Ping failed", "error", err)
+                return
+            }
+        }
+    }
+}
+
+// parseAddons returns the flow named in the protobuf-encoded VLESS addons,
+// or an empty string when there is none. Fields other than the flow are
+// skipped.
+func parseAddons(b []byte) (string, error) {
+    var flow string
+    for len(b) > 0 {
+        key, n := binary.Uvarint(b)
+        if n <= 0 {
+            return "", fmt.Errorf("malformed addons")
+        }
+        b = b[n:]
+
+        switch field, wireType := key>>3, key&7; wireType {
+        case 0:
+            if _, n = binary.Uvarint(b); n <= 0 {
+                return "", fmt.Errorf("malformed addons")
+            }
+            b = b[n:]
+        case 2:
+            l, n := binary.Uvarint(b)
+            if n <= 0 || l > uint64(len(b)-n) {
+                return "", fmt.Errorf("malformed addons")
+            }
+            if field == 1 {
+                flow = string(b[n : n+int(l)])
+            }
+            b = b[n+int(l):]
+        default:
+            return "", fmt.Errorf("malformed addons: unsupported wire type %d", wireType)
+        }
+    }
+    return flow, nil
+}
+
+// newConnID returns a short random identifier used to correlate the log
+// lines of one session.
+func newConnID() string {
+    var b [4]byte
+    rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
+func handleProxyRequest(wsConn *clientConn, message []byte, logger *slog.Logger) error {
+    if isTrojanRequest(message) {
+        return handleTrojanRequest(wsConn, message, logger)
+    }
+    // A message that cannot be the start of a VLESS header is refused at
+    // once rather than waited on. A prober gets nothing that sets it apart
+    // from a failed authentication, though.
+    if len(message) > 0 && message[0] != vlessVersion && !probeResist {
+        return malformedHeader(fmt.Sprintf("unsupported VLESS version %d", message[0]))
+    }
+    if len(message) < 18 {
+        return newProxyError(closeMalformedHeader, errShortHeader)
+    }
+
+    // The UUID is checked before the rest of the header is parsed, so that
+    // a client that cannot authenticate learns nothing about the parser.
+    user, ok := validateUUID(message[1:17])
+    if !ok {
+        authFailures.Inc()
+        return fmt.Errorf("%w: invalid UUID", errAuthFailed)
+    }
+    sess := newSession(user, logger)
+
+    req, rest, err := parseVlessHeader(message)
+    if err != nil {
+        return err
+    }
+    version, command, host, targetPort := req.version, req.command, req.host, req.port
+    if command == commandMux {
+        logger.Debug("Connection details", "user", user, "command", command, "network", "mux")
+        return handleMux(wsConn, version, rest, sess)
+    }
+    if targetPort == 0 {
+        logger.Warn("Target port 0 rejected")
+        return newProxyError(closeBadCommand, fmt.Errorf("target port 0 is not valid"))
+    }
+
+    network, ok := commandNetworks[command]
+    if !ok {
+        return newProxyError(closeBadCommand, fmt.Errorf("command %d carries no connection", command))
+    }
+    sess.network = network
+    logger.Debug("Connection details", "user", user, hostAttr("host", host), "port", targetPort, "atyp", req.atyp, "command", command, "network", network)
+
+    sess.target = net.JoinHostPort(host, strconv.Itoa(int(targetPort)))
+    target, err := checkTarget(host, targetPort, logger)
+    if err != nil {
+        return err
+    }
+    sess.route = target.route
+
+    if network == "udp" {
+        return handleUDPProxy(wsConn, version, target.ips, target.port, rest, sess)
+    }
+
+    return proxyTCP(clientSide{
+        conn:    wsConn,
+        initial: rest,
+        up:      &wsStream{conn: wsConn},
+        down:    &wsStream{conn: wsConn},
+        respond: func() error { return writeResponse(wsConn, version) },
+    }, target.ips, target.port, sess)
+}
+
+// vlessHeader is a parsed VLESS request header.
+type vlessHeader struct {
+    version byte
+    id      []byte
+    command byte
+    port    uint16
+    atyp    byte
+    host    string
+}
+
+// parseVlessHeader parses the VLESS request header at the start of message
+// and returns it with the data that follows it. Every length read from the
+// message is checked against what is left of it before it is used, and each
+// is at most 255, so no offset can run past the message or overflow. A
+// message that ends inside the header fails with an error wrapping
+// errShortHeader; every error is a proxyError carrying its close code. A mux
+// request ends after its command, and is returned without a target.
+func parseVlessHeader(message []byte) (vlessHeader, []byte, error) {
+    var req vlessHeader
+    if len(message) < 18 {
+        return req, nil, newProxyError(closeMalformedHeader, errShortHeader)
+    }
+    req.version = message[0]
+    if req.version != vlessVersion {
+        return req, nil, malformedHeader(fmt.Sprintf("unsupported VLESS version %d", req.version))
+    }
+    req.id = message[1:17]
+
+    addonLen := int(message[17])
+    i := 18
+    if len(message)-i < addonLen+1 {
+        return req, nil, newProxyError(closeMalformedHeader, fmt.Errorf("%w for command", errShortHeader))
+    }
+    flow, err := parseAddons(message[i : i+addonLen])
+    if err != nil {
+        return req, nil, newProxyError(closeMalformedHeader, err)
+    }
+    if flow != "" {
+        return req, nil, newProxyError(closeBadCommand, fmt.Errorf("unsupported flow %q", flow))
+    }
+    i += addonLen
+
+    req.command = message[i]
+    i++
+    switch req.command {
+    case commandTCP, commandUDP:
+    case commandMux:
+        // A mux request has no target: each of its substreams names its own.
+        return req, message[i:], nil
+    default:
+        return req, nil, newProxyError(closeBadCommand, fmt.Errorf("unknown command %d", req.command))
+    }
+
+    if len(message)-i < 3 {
+        return req, nil, newProxyError(closeMalformedHeader, fmt.Errorf("%w for port and address type", errShortHeader))
+    }
+    req.port = binary.BigEndian.Uint16(message[i : i+2])
+    req.atyp = message[i+2]
+    i += 3
+
+    var addrLen int
+    switch req.atyp {
+    case 1:
+        addrLen = net.IPv4len
+    case 2:
+        if len(message)-i < 1 {
+            return req, nil, newProxyError(closeMalformedHeader, fmt.Errorf("%w for domain length", errShortHeader))
+        }
+        addrLen = int(message[i])
+        i++
+        if addrLen == 0 {
+            return req, nil, malformedHeader("empty domain name")
+        }
+    case 3:
+        addrLen = net.IPv6len
+    default:
+        return req, nil, malformedHeader("unknown address type")
+    }
+    if len(message)-i < addrLen {
+        return req, nil, newProxyError(closeMalformedHeader, fmt.Errorf("%w for address", errShortHeader))
+    }
+    if req.atyp == 2 {
+        req.host = normalizeHost(string(message[i : i+addrLen]))
+    } else {
+        req.host = net.IP(message[i : i+addrLen]).String()
+    }
+    i += addrLen
+
+    return req, message[i:], nil
+}
+
+// checkedTarget is where a target that passed checkTarget is dialed.
+type checkedTarget struct {
+    ips  []net.IP
+    port uint16
+
+    // route is the address ROUTE_MAP sends the target to, or "" when it is
+    // dialed as requested.
+    route string
+}
+
+// checkTarget applies the host rules and ROUTE_MAP to a requested target
+// and resolves it, returning where it may be dialed. Every frontend checks
+// its targets here. The host rules apply to the host the client asked for;
+// a route is the operator's own choice of address, so it is dialed even
+// where ALLOW_PRIVATE would refuse it, as a sink on loopback is. A target,
+// routed or not, is never this server itself.
+func checkTarget(host string, port uint16, logger *slog.Logger) (checkedTarget, error) {
+    if !hostAllowed(host) {
+        logger.Warn("Destination rejected by host rules", hostAttr("host", host))
+        return checkedTarget{}, newProxyError(closeBlockedHost, errors.New("destination is not allowed"))
+    }
+
+    target := checkedTarget{port: port}
+    private := allowPrivate
+    if routeHost, routePort, ok := routeTarget(host, port); ok {
+        target.route = net.JoinHostPort(routeHost, strconv.Itoa(int(routePort)))
+        logger.Debug("Destination rerouted by ROUTE_MAP", targetAttr("target", net.JoinHostPort(host, strconv.Itoa(int(port)))), targetAttr("route", target.route))
+        host, target.port, private = routeHost, routePort, true
     }
-    uuid = strings.ReplaceAll(uuid, "-", "")
+
+    ips, err := lookupTarget(host, private)
+    if errors.Is(err, errPrivateTarget) {
+        logger.Warn("Destination is a private address, rejected", hostAttr("host", host))
+        return checkedTarget{}, newProxyError(closeBlockedHost, err)
+    }
+    if err != nil {
+        logger.Warn("Destination could not be resolved", hostAttr("host", host), "error", err)
+        return checkedTarget{}, newProxyError(closeDialFailed, err)
+    }
+    if isSelfTarget(ips, target.port) {
+        logger.Warn("Destination is this server, rejected", hostAttr("host", host), "port", target.port)
+        return checkedTarget{}, newProxyError(closeBlockedHost, fmt.Errorf("destination port %d is this server", target.port))
+    }
+    target.ips = ips
+    return target, nil
 }
 
-func main() {
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
+// clientSide is the client's half of a TCP session, as the protocol the
+// client spoke presents it once the request header has been parsed.
+type clientSide struct {
+    conn *clientConn
+
+    // initial is the data that came with the request header, up the rest
+    // of the client's data and down the way to send the target's data back.
+    initial []byte
+    up      io.Reader
+    down    io.Writer
+
+    // respond sends the protocol's response header.
+    respond func() error
+}
+
+// proxyTCP connects a client to the TCP target at ips and port and pumps
+// data both ways until the session ends.
+func proxyTCP(client clientSide, ips []net.IP, port uint16, sess *session) (err error) {
+    defer func() { sess.end(err) }()
+    if err := checkQuota(); err != nil {
+        return err
+    }
+    release, ok := acquirePumps()
+    if !ok {
+        return newProxyError(closeOverloaded, fmt.Errorf("MAX_PUMPS reached"))
+    }
+    defer release()
+    wsConn := client.conn
+
+    // The data that came with the request is sniffed, along with what
+    // follows it, before the target is dialed; without any, what the client
+    // sends once it has the response is.
+    up := client.up
+    if sniff {
+        sniffer := newSniffReader(client.up, sess.logger)
+        defer func() { sess.sniffed = sniffer.sniffed() }()
+        if len(client.initial) > 0 {
+            initial, err := sniffer.sniff(client.initial)
+            client.initial = initial
+            if err != nil {
+                return err
+            }
+        }
+        up = sniffer
+    }
+
+    tcpConn, err := dialTarget("tcp", ips, port)
+    if err != nil {
+        dialFailures.Inc()
+        return newProxyError(closeDialFailed, fmt.Errorf("failed to connect to target: %w", err))
+    }
+    defer tcpConn.Close()
+    if err := writeProxyHeader(tcpConn, wsConn.client, wsConn.local); err != nil {
+        return fmt.Errorf("failed to send PROXY header to target: %w", err)
+    }
+
+    if err := client.respond(); err != nil {
+        return err
+    }
+
+    if len(client.initial) > 0 {
+        if _, err := tcpConn.Write(client.initial); err != nil {
+            return fmt.Errorf("failed to write initial data to target: %w", err)
+        }
+        sess.countUp(len(client.initial))
+    }
+
+    idle := idleDeadline{wsConn, tcpConn}
+    idle.extend()
+
+    // The reply to a client's close frame is sent once the target has
+    // finished, so that its remaining response can still be delivered.
+    wsConn.SetCloseHandler(func(int, string) error { return nil })
+
+    ctx, cancel := cancelOnClose(wsConn, tcpConn)
+    defer cancel()
+    defer limitSession(wsConn, cancel, sess)()
+
+    errChan := make(chan error, 2)
+
+    go proxyWebSocketToTCP(ctx, up, tcpConn, idle, errChan, sess)
+    go proxyTCPToWebSocket(ctx, tcpConn, client.down, idle, errChan, sess)
+
+    err = <-errChan
+    if errors.Is(err, errClientClosed) {
+        err = <-errChan
+        closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+        wsConn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+    } else {
+        cancel()
+        <-errChan
     }
+    return idleError(err)
+}
 
-    http.HandleFunc("/", handleRequest)
-   log.Printf("Server is running on port %s", port)
-    log.Fatal(http.ListenAndServe(":"+port, nil))
+// cancelOnClose returns a context for a proxy session that closes conns
+// when it is cancelled, or when the server stops all sessions. Cancelling it
+// once one direction of the session fails ends the other direction promptly
+// instead of leaving it blocked until its own I/O fails.
+func cancelOnClose(conns ...io.Closer) (context.Context, context.CancelFunc) {
+    ctx, cancel := context.WithCancel(sessionCtx)
+    context.AfterFunc(ctx, func() {
+        for _, c := range conns {
+            c.Close()
+        }
+    })
+    return ctx, cancel
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) {
-    if websocket.IsWebSocketUpgrade(r) {
-        handleWebSocket(w, r)
-        return
+// limitSession ends a session that is still running after MAX_SESSION,
+// telling the client why with a close frame before cancelling it. The
+// returned function stops the timer once the session has ended by itself.
+func limitSession(wsConn *clientConn, cancel context.CancelFunc, sess *session) (stop func()) {
+    if maxSession == 0 {
+        return func() {}
     }
+    timer := time.AfterFunc(maxSession, func() {
+        sess.logger.Info("Session reached MAX_SESSION, closing", "limit", maxSession)
+        closeMessage := websocket.FormatCloseMessage(closeSessionLimit, closeReasons[closeSessionLimit])
+        wsConn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+        cancel()
+    })
+    return func() { timer.Stop() }
+}
 
-    w.WriteHeader(http.StatusOK)
-    w.Write([]byte("Server is running"))
+// limitTunnel ends a session of a plain TCP frontend that is still running
+// after MAX_SESSION by closing its connections: such a client cannot be told
+// why. The returned function stops the timer once the session has ended by
+// itself.
+func limitTunnel(sess *session, conns ...io.Closer) (stop func()) {
+    if maxSession == 0 {
+        return func() {}
+    }
+    timer := time.AfterFunc(maxSession, func() {
+        sess.logger.Info("Session reached MAX_SESSION, closing", "limit", maxSession)
+        for _, c := range conns {
+            c.Close()
+        }
+    })
+    return func() { timer.Stop() }
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-       log.Println("WebSocket upgrade error:", err)
-        return
+// pumpError returns the context's error in place of err once the session
+// has been cancelled, since err is then only the result of the cancellation
+// closing the connections.
+func pumpError(ctx context.Context, err error) error {
+    if ctx.Err() != nil {
+        return ctx.Err()
     }
-    defer conn.Close()
+    return err
+}
+
+// writeResponse sends the VLESS response header. It is only written once the
+// target has been dialed, so that a client is never told that a connection
+// succeeded when it did not.
+func writeResponse(wsConn *clientConn, version byte) error {
+    if err := writeData(wsConn, []byte{version, 0}); err != nil {
+        return fmt.Errorf("failed to send response: %w", err)
+    }
+    return nil
+}
 
-   log.Println("New WebSocket connection established")
+// resolveTarget resolves host to the IP addresses that may be dialed, limited
+// to the address family selected by DIAL_NETWORK. Unless allowPrivate is set,
+// loopback, private, link-local and unspecified addresses are refused so that
+// clients cannot reach the host's internal network or the cloud metadata
+// service. Dialing the checked IPs rather than the name keeps a second DNS
+// lookup from bypassing the check.
+func resolveTarget(host string) ([]net.IP, error) {
+    return lookupTarget(host, allowPrivate)
+}
 
-    for {
-        messageType, message, err := conn.ReadMessage()
+// lookupTarget is resolveTarget, refusing private addresses unless private
+// is set.
+func lookupTarget(host string, private bool) ([]net.IP, error) {
+    var ips []net.IP
+    if ip := net.ParseIP(host); ip != nil {
+        ips = []net.IP{ip}
+    } else {
+        ctx := context.Background()
+        if dialer.Timeout > 0 {
+            var cancel context.CancelFunc
+            ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+            defer cancel()
+        }
+
+        var err error
+        ips, err = resolver.LookupIP(ctx, host)
         if err != nil {
-           log.Println("Read error:", err)
-            return
+            return nil, hideTarget(fmt.Errorf("failed to resolve target: %w", err), host)
         }
+    }
 
-        if messageType != websocket.BinaryMessage {
-           log.Println("Received non-binary message")
+    var allowed []net.IP
+    blocked := false
+    for _, ip := range ips {
+        if dialFamily != "" && ipFamily(ip) != dialFamily {
             continue
         }
-
-        if err := handleProxyRequest(conn, message); err != nil {
-           log.Println("Proxy error:", err)
-            return
+        if !private && isPrivateIP(ip) {
+            blocked = true
+            continue
         }
+        allowed = append(allowed, ip)
+    }
+
+    switch {
+    case len(allowed) > 0:
+        return allowed, nil
+    case blocked:
+        return nil, fmt.Errorf("target: %w", errPrivateTarget)
+    default:
+        return nil, fmt.Errorf("target has no IPv%s address", dialFamily)
     }
 }
 
-func handleProxyRequest(wsConn *websocket.Conn, message []byte) error {
-    if len(message) < 18 {
-        return fmt.Errorf("message too short")
+// ipFamily returns "4" for IPv4 (including IPv4-mapped) addresses and "6"
+// for IPv6 ones, matching the suffixes of the "tcp4" and "tcp6" networks.
+func ipFamily(ip net.IP) string {
+    if ip.To4() != nil {
+        return "4"
     }
+    return "6"
+}
 
-    version := message[0]
-    id := message[1:17]
+// dialTarget connects to the target, retrying up to DIAL_RETRIES times with
+// exponential backoff when the target refuses the connection or the dial
+// times out. No backoff sleeps past maxDialRetryTime: the last one is cut
+// short so that a final attempt is made at the deadline. The error it
+// returns does not name the target.
+func dialTarget(network string, ips []net.IP, port uint16) (net.Conn, error) {
+    deadline := time.Now().Add(maxDialRetryTime)
+    backoff := dialBackoff
+    for attempt := 0; ; attempt++ {
+        conn, err := dialOnce(network, ips, port)
+        if tcpConn, ok := conn.(*net.TCPConn); ok {
+            tuneTCP(tcpConn)
+        }
+        remaining := time.Until(deadline)
+        if err == nil || attempt >= dialRetries || !retryableDialError(err) || remaining <= 0 {
+            return conn, hideAddrs(err, ips)
+        }
+        time.Sleep(min(backoff, remaining))
+        backoff *= 2
+    }
+}
 
-    if !validateUUID(id) {
-        return fmt.Errorf("invalid UUID")
+// tuneTCP disables Nagle's algorithm on a target connection, so that
+// interactive traffic is not held back, and sets its keepalive period to
+// TCP_KEEPALIVE so that dead targets are noticed. A zero period disables
+// keepalives.
+func tuneTCP(conn *net.TCPConn) {
+    conn.SetNoDelay(true)
+    if tcpKeepAlive == 0 {
+        conn.SetKeepAlive(false)
+        return
     }
+    conn.SetKeepAlive(true)
+    conn.SetKeepAlivePeriod(tcpKeepAlive)
+}
+
+func retryableDialError(err error) bool {
+    var netErr net.Error
+    return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &netErr) && netErr.Timeout()
+}
 
-    i := int(message[17]) + 19
-    if len(message) < i+3 {
-        return fmt.Errorf("message too short")
+// dialOnce connects to ips in turn on port over network ("tcp" or "udp"),
+// restricted to the family selected by DIAL_NETWORK, and returns the first
+// connection established or the error of the last address tried. With
+// HAPPY_EYEBALLS set, a TCP target that has both IPv4 and IPv6 addresses is
+// dialed over both families at once and the first connection to succeed is
+// used. With UPSTREAM_PROXY or UPSTREAM_WS set, TCP targets are dialed
+// through the upstream and UDP targets cannot be reached.
+func dialOnce(network string, ips []net.IP, port uint16) (net.Conn, error) {
+    var dial func(addr string) (net.Conn, error)
+    switch {
+    case upstreamDialer != nil:
+        if network != "tcp" {
+            return nil, fmt.Errorf("%s targets cannot be reached through the upstream", network)
+        }
+        network += dialFamily
+        dial = func(addr string) (net.Conn, error) {
+            ctx := context.Background()
+            if dialer.Timeout > 0 {
+                var cancel context.CancelFunc
+                ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+                defer cancel()
+            }
+            return upstreamDialer.DialContext(ctx, network, addr)
+        }
+    case targetPool != nil && network == "tcp":
+        network += dialFamily
+        dial = func(addr string) (net.Conn, error) { return targetPool.Dial(network, addr) }
+    default:
+        network += dialFamily
+        d := dialerFor(network)
+        dial = func(addr string) (net.Conn, error) { return d.Dial(network, addr) }
     }
 
-    targetPort := binary.BigEndian.Uint16(message[i : i+2])
-    i += 2
-    atyp := message[i]
-    i++
+    if happyEyeballs && network == "tcp" && upstreamDialer == nil {
+        var v4, v6 net.IP
+        for _, ip := range ips {
+            if ipFamily(ip) == "4" && v4 == nil {
+                v4 = ip
+            } else if ipFamily(ip) == "6" && v6 == nil {
+                v6 = ip
+            }
+        }
+        if v4 != nil && v6 != nil {
+            return dialRace(network, []net.IP{v4, v6}, port)
+        }
+    }
 
-    var host string
-    switch atyp {
-    case 1:
-        if len(message) < i+4 {
-            return fmt.Errorf("message too short for IPv4")
+    err := errors.New("no address to dial")
+    for _, ip := range ips {
+        var conn net.Conn
+        conn, err = dial(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+        if err == nil {
+            return conn, nil
         }
-        host = net.IP(message[i : i+4]).String()
-        i += 4
-    case 2:
-        if len(message) < i+1 {
-            return fmt.Errorf("message too short for domain length")
+    }
+    return nil, err
+}
+
+// dialerFor returns the dialer to use for network, bound to OUTBOUND_IP when
+// one is configured, and dialing from a port of SRC_PORT_RANGE when that is.
+func dialerFor(network string) forwardDialer {
+    d := dialer
+    if outboundIP != nil {
+        bound := *dialer
+        if strings.HasPrefix(network, "udp") {
+            bound.LocalAddr = &net.UDPAddr{IP: outboundIP}
+        } else {
+            bound.LocalAddr = &net.TCPAddr{IP: outboundIP}
         }
-        domainLen := int(message[i])
-        i++
-        if len(message) < i+domainLen {
-            return fmt.Errorf("message too short for domain name")
+        d = &bound
+    }
+    if srcPorts != nil {
+        return portRangeDialer{Dialer: d, ports: srcPorts}
+    }
+    return d
+}
+
+// dialRace dials all of ips in parallel and returns the first connection to
+// be established, closing any that complete later.
+func dialRace(network string, ips []net.IP, port uint16) (net.Conn, error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    d := dialerFor(network)
+    type result struct {
+        conn net.Conn
+        err  error
+    }
+    results := make(chan result, len(ips))
+    for _, ip := range ips {
+        go func(addr string) {
+            conn, err := d.DialContext(ctx, network, addr)
+            results <- result{conn, err}
+        }(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+    }
+
+    var firstErr error
+    for n := range ips {
+        r := <-results
+        if r.err == nil {
+            go func(remaining int) {
+                for range remaining {
+                    if r := <-results; r.conn != nil {
+                        r.conn.Close()
+                    }
+                }
+            }(len(ips) - n - 1)
+            return r.conn, nil
         }
-        host = string(message[i : i+domainLen])
-        i += domainLen
-    case 3:
-        if len(message) < i+16 {
-            return fmt.Errorf("message too short for IPv6")
+        if firstErr == nil {
+            firstErr = r.err
         }
-        host = net.IP(message[i : i+16]).String()
-        i += 16
-    default:
-        return fmt.Errorf("unknown address type")
     }
+    return nil, firstErr
+}
 
-   log.Printf("Connection details: host=%s, port=%d, atyp=%d", host, targetPort, atyp)
+// isSelfTarget reports whether port on any of ips is one of this server's
+// own listeners, so that a client cannot make the proxy connect to itself
+// over and over.
+func isSelfTarget(ips []net.IP, port uint16) bool {
+    if !slices.Contains(listenPorts(), port) {
+        return false
+    }
+    addrs, _ := net.InterfaceAddrs()
+    for _, ip := range ips {
+        if ip.IsLoopback() || ip.IsUnspecified() {
+            return true
+        }
+        for _, addr := range addrs {
+            if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+                return true
+            }
+        }
+    }
+    return false
+}
 
-    if err := wsConn.WriteMessage(websocket.BinaryMessage, []byte{version, 0}); err != nil {
-        return fmt.Errorf("failed to send response: %w", err)
+// listenPorts returns the TCP ports this server listens on.
+func listenPorts() []uint16 {
+    var list []uint16
+    for _, port := range ports {
+        n, _ := strconv.ParseUint(port, 10, 16)
+        list = append(list, uint16(n))
     }
+    if _, port, err := net.SplitHostPort(socks5Addr); err == nil {
+        n, _ := strconv.ParseUint(port, 10, 16)
+        list = append(list, uint16(n))
+    }
+    return list
+}
+
+func isPrivateIP(ip net.IP) bool {
+    return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+        ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
 
-    tcpConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, targetPort))
+// handleUDPProxy relays VLESS UDP traffic. In both directions every datagram
+// is carried on the WebSocket as a 2-byte big-endian length followed by the
+// payload.
+func handleUDPProxy(wsConn *clientConn, version byte, ips []net.IP, port uint16, initial []byte, sess *session) (err error) {
+    defer func() { sess.end(err) }()
+    if err := checkQuota(); err != nil {
+        return err
+    }
+    release, ok := acquirePumps()
+    if !ok {
+        return newProxyError(closeOverloaded, fmt.Errorf("MAX_PUMPS reached"))
+    }
+    defer release()
+    udpConn, err := dialTarget("udp", ips, port)
     if err != nil {
-        return fmt.Errorf("failed to connect to target: %w", err)
+        dialFailures.Inc()
+        return newProxyError(closeDialFailed, fmt.Errorf("failed to connect to target: %w", err))
     }
-    defer tcpConn.Close()
+    defer udpConn.Close()
 
-    if len(message) > i {
-        if _, err := tcpConn.Write(message[i:]); err != nil {
-            return fmt.Errorf("failed to write initial data to target: %w", err)
-        }
+    if err := writeResponse(wsConn, version); err != nil {
+        return err
+    }
+
+    // Each direction is held to RATE_BPS of its own, one packet at a time.
+    up, down := newPacketThrottle(), newPacketThrottle()
+    pending, err := writeUDPPackets(udpConn, initial, up, sess)
+    if err != nil {
+        return err
     }
 
+    idle := idleDeadline{wsConn, udpConn}
+    idle.extend()
+
+    ctx, cancel := cancelOnClose(wsConn, udpConn)
+    defer cancel()
+    defer limitSession(wsConn, cancel, sess)()
+
     errChan := make(chan error, 2)
 
-    go proxyWebSocketToTCP(wsConn, tcpConn, errChan)
-    go proxyTCPToWebSocket(tcpConn, wsConn, errChan)
+    go proxyWebSocketToUDP(ctx, wsConn, udpConn, pending, up, idle, errChan, sess)
+    go proxyUDPToWebSocket(ctx, udpConn, wsConn, down, idle, errChan, sess)
 
     err = <-errChan
-    return err
+    cancel()
+    <-errChan
+    return idleError(err)
+}
+
+// writeUDPPackets sends every complete length-prefixed packet in data as a
+// single datagram, once throttle allows it, and returns the bytes of a
+// trailing incomplete packet.
+func writeUDPPackets(udpConn net.Conn, data []byte, throttle *packetThrottle, sess *session) ([]byte, error) {
+    for len(data) >= 2 {
+        n := int(binary.BigEndian.Uint16(data[:2]))
+        if len(data) < n+2 {
+            break
+        }
+        throttle.wait(n)
+        if _, err := udpConn.Write(data[2 : n+2]); err != nil {
+            return nil, fmt.Errorf("UDP write error: %w", err)
+        }
+        sess.countUp(n)
+        data = data[n+2:]
+    }
+    return data, nil
 }
 
-func proxyWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, errChan chan<- error) {
+func proxyWebSocketToUDP(ctx context.Context, wsConn *clientConn, udpConn net.Conn, pending []byte, throttle *packetThrottle, idle idleDeadline, errChan chan<- error, sess *session) {
+    defer recoverPanic(sess.logger, errChan)
+    err := pumpError(ctx, copyWebSocketToUDP(wsConn, udpConn, pending, throttle, idle, sess))
+    sess.logger.Debug("WebSocket to UDP pump finished", "error", err)
+    errChan <- err
+}
+
+func copyWebSocketToUDP(wsConn *clientConn, udpConn net.Conn, pending []byte, throttle *packetThrottle, idle idleDeadline, sess *session) error {
     for {
-        _, message, err := wsConn.ReadMessage()
+        messageType, message, err := wsConn.ReadMessage()
         if err != nil {
-            errChan <- fmt.Errorf("WebSocket read error: %w", err)
-            return
+            return fmt.Errorf("WebSocket read error: %w", err)
+        }
+        idle.extend()
+        // As in wsStream, text messages are not part of the packet stream.
+        if messageType != websocket.BinaryMessage {
+            continue
         }
 
-        if _, err := tcpConn.Write(message); err != nil {
-            errChan <- fmt.Errorf("TCP write error: %w", err)
-            return
+        pending, err = writeUDPPackets(udpConn, append(pending, message...), throttle, sess)
+        if err != nil {
+            return err
         }
     }
 }
 
-func proxyTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, errChan chan<- error) {
-    buffer := make([]byte, 4096)
+func proxyUDPToWebSocket(ctx context.Context, udpConn net.Conn, wsConn *clientConn, throttle *packetThrottle, idle idleDeadline, errChan chan<- error, sess *session) {
+    defer recoverPanic(sess.logger, errChan)
+    err := pumpError(ctx, copyUDPToWebSocket(udpConn, wsConn, throttle, idle, sess))
+    sess.logger.Debug("UDP to WebSocket pump finished", "error", err)
+    errChan <- err
+}
+
+func copyUDPToWebSocket(udpConn net.Conn, wsConn *clientConn, throttle *packetThrottle, idle idleDeadline, sess *session) error {
+    buffer := make([]byte, 2+65535)
     for {
-        n, err := tcpConn.Read(buffer)
+        // A packet that arrives together with an error is still
+        // delivered before the error ends the session.
+        n, err := udpConn.Read(buffer[2:])
+        if n > 0 {
+            idle.extend()
+
+            throttle.wait(n)
+            binary.BigEndian.PutUint16(buffer[:2], uint16(n))
+            if err := writeData(wsConn, buffer[:n+2]); err != nil {
+                return fmt.Errorf("WebSocket write error: %w", err)
+            }
+            sess.countDown(n)
+        }
         if err != nil {
-            errChan <- fmt.Errorf("TCP read error: %w", err)
-            return
+            return fmt.Errorf("UDP read error: %w", err)
         }
+    }
+}
+
+func proxyWebSocketToTCP(ctx context.Context, up io.Reader, tcpConn net.Conn, idle idleDeadline, errChan chan<- error, sess *session) {
+    defer recoverPanic(sess.logger, errChan)
+    err := pumpError(ctx, pump(tcpConn, up, idle, sess.countUp))
+    sess.logger.Debug("WebSocket to TCP pump finished", "error", err)
 
-        if err := wsConn.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
-            errChan <- fmt.Errorf("WebSocket write error: %w", err)
+    // A normal or going-away close from the client, or the end of its data
+    // in a protocol that marks it, only ends its half of the session.
+    // Forward it to the target as a half-close and let the other direction
+    // keep running until the target is done as well.
+    if errors.Is(err, io.EOF) || websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+        if cw, ok := tcpConn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+            errChan <- errClientClosed
             return
         }
     }
+    errChan <- fmt.Errorf("WebSocket to TCP copy error: %w", err)
+}
+
+func proxyTCPToWebSocket(ctx context.Context, tcpConn net.Conn, down io.Writer, idle idleDeadline, errChan chan<- error, sess *session) {
+    defer recoverPanic(sess.logger, errChan)
+    var coalescer *coalescingWriter
+    if coalesceWindow > 0 {
+        coalescer = newCoalescingWriter(down, coalesceWindow)
+        down = coalescer
+    }
+    err := pump(down, tcpConn, idle, sess.countDown)
+    if coalescer != nil {
+        // The last of the target's data still goes out after it has
+        // finished.
+        if flushErr := coalescer.flush(); flushErr != nil && errors.Is(err, io.EOF) {
+            err = flushErr
+        }
+    }
+    err = pumpError(ctx, err)
+    sess.logger.Debug("TCP to WebSocket pump finished", "error", err)
+    errChan <- fmt.Errorf("TCP to WebSocket copy error: %w", err)
+}
+
+// recoverPanic keeps a panic in a session, such as a bounds bug hit by a
+// crafted message, from taking the whole process down. Deferred at the top
+// of a session goroutine, it logs the panic and its stack and, for a pump,
+// reports it on errChan so that the session ends as it would on any other
+// error. The deferred closes of the session then release its connections.
+func recoverPanic(logger *slog.Logger, errChan chan<- error) {
+    v := recover()
+    if v == nil {
+        return
+    }
+    logger.Error("Panic in session", "panic", v, "stack", string(debug.Stack()))
+    if errChan != nil {
+        errChan <- fmt.Errorf("panic: %v", v)
+    }
+}
+
+// pump copies src to dst through a pooled buffer until either side fails,
+// extending the session's idle deadline on every read and passing the number
+// of bytes written to count. It reads no faster than RATE_BPS and
+// GLOBAL_RATE_BPS allow. A clean end of src is reported as io.EOF.
+func pump(dst io.Writer, src io.Reader, idle idleDeadline, count func(int)) error {
+    buffer := bufferPool.Get().(*[]byte)
+    defer bufferPool.Put(buffer)
+
+    // The wrappers also hide any ReadFrom or WriteTo methods of the
+    // connections, so io.CopyBuffer always uses the pooled buffer. It
+    // writes out the bytes of a read that also returns io.EOF before
+    // stopping, so the last of the target's data is never dropped.
+    _, err := io.CopyBuffer(&countingWriter{w: dst, count: count}, &idleReader{r: newSessionThrottle(src), idle: idle}, (*buffer)[:min(len(*buffer), maxInflight)])
+    if err == nil {
+        err = io.EOF
+    }
+    return err
+}
+
+// session is the state shared by the pumps of one proxied connection.
+type session struct {
+    // user is the label of the authenticated user, or empty when the
+    // frontend has no users.
+    user   string
+    logger *slog.Logger
+
+    // target is the host:port the client asked for, once it is known, and
+    // network the network it is dialed on, "tcp" unless the client asked
+    // for UDP.
+    target  string
+    network string
+
+    // route is the address ROUTE_MAP sent target to instead, if any.
+    route string
+
+    // sniffed is the server name SNIFF found in the client's first data.
+    sniffed string
+
+    start time.Time
+    up    atomic.Int64
+    down  atomic.Int64
+}
+
+func newSession(user string, logger *slog.Logger) *session {
+    return &session{user: user, logger: logger, network: "tcp", start: time.Now()}
+}
+
+// countUp records n bytes sent from the client to the target.
+func (s *session) countUp(n int) {
+    s.up.Add(int64(n))
+    totalBytesUp.Add(int64(n))
+    bytesUp.Add(float64(n))
+    if quota != nil {
+        quota.add(n)
+    }
+    traffic.add(s.user, int64(n), 0)
+}
+
+// countDown records n bytes sent from the target to the client.
+func (s *session) countDown(n int) {
+    s.down.Add(int64(n))
+    totalBytesDown.Add(int64(n))
+    bytesDown.Add(float64(n))
+    if quota != nil {
+        quota.add(n)
+    }
+    traffic.add(s.user, 0, int64(n))
+}
+
+// end writes the access log line of the session, which closed because of
+// err, to ACCESS_LOG_FILE when one is set. A session that ended abnormally
+// is logged as a warning.
+func (s *session) end(err error) {
+    reason, level := "closed", slog.LevelInfo
+    if err != nil && !errors.Is(err, io.EOF) {
+        reason = err.Error()
+    }
+    if !isNormalClose(err) {
+        level = slog.LevelWarn
+    }
+    sessionsServed.Add(1)
+    sessionsTotal.WithLabelValues(s.network).Inc()
+    args := []any{
+        "user", s.user,
+        targetAttr("target", s.target),
+        "network", s.network,
+        "bytes_up", s.up.Load(),
+        "bytes_down", s.down.Load(),
+        "duration", time.Since(s.start).String(),
+        "reason", reason,
+    }
+    if s.route != "" {
+        args = append(args, targetAttr("route", s.route))
+    }
+    if s.sniffed != "" {
+        args = append(args, hostAttr("sniffed", s.sniffed))
+    }
+    s.logger.Log(accessLogContext, level, "Session ended", args...)
+}
+
+// countingWriter passes the number of bytes written through it to count.
+type countingWriter struct {
+    w     io.Writer
+    count func(int)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+    n, err := cw.w.Write(p)
+    cw.count(n)
+    return n, err
+}
+
+// idleDeadline holds both ends of a session. Whenever data arrives on either
+// end the read deadlines of both are pushed forward, so a session only times
+// out once nothing has flowed in either direction for idleTimeout.
+type idleDeadline []interface{ SetReadDeadline(time.Time) error }
+
+func (d idleDeadline) extend() {
+    if idleTimeout <= 0 {
+        return
+    }
+    t := time.Now().Add(idleTimeout)
+    for _, c := range d {
+        c.SetReadDeadline(t)
+    }
+}
+
+// idleError replaces a deadline error from a pump with one naming the idle
+// timeout as the reason the session closed.
+func idleError(err error) error {
+    // gorilla/websocket hides the underlying error, so check for any
+    // net.Error timeout rather than os.ErrDeadlineExceeded.
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return fmt.Errorf("session idle for %s, closing", idleTimeout)
+    }
+    return err
+}
+
+// idleReader extends the session deadlines after every successful read.
+type idleReader struct {
+    r    io.Reader
+    idle idleDeadline
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+    n, err := r.r.Read(p)
+    if n > 0 {
+        r.idle.extend()
+    }
+    return n, err
+}
+
+// clientConn is a client's WebSocket connection. gorilla/websocket allows
+// only one writer at a time, so every write, data or control, goes through
+// writeMu; that keeps the pings from keepAlive, the pumps' data and the
+// close frames from ever being interleaved.
+//
+// With OBFS_KEY set, obfs opens the binary messages read from the client
+// and seals the data written to it.
+type clientConn struct {
+    *websocket.Conn
+    writeMu sync.Mutex
+    obfs    *obfsCodec
+
+    // client and local are the addresses of the client and of this server
+    // for SEND_PROXY_PROTO, when known.
+    client *net.TCPAddr
+    local  *net.TCPAddr
+
+    // A read is held to the earlier of two deadlines: readDeadline, which
+    // the session's idle deadline sets, and pongDeadline, by which the
+    // client must have answered a ping or sent its request header.
+    deadlineMu   sync.Mutex
+    readDeadline time.Time
+    pongDeadline time.Time
+}
+
+// SetReadDeadline sets the deadline for reads from the client, which the
+// pong deadline can still bring forward.
+func (c *clientConn) SetReadDeadline(t time.Time) error {
+    c.deadlineMu.Lock()
+    defer c.deadlineMu.Unlock()
+    c.readDeadline = t
+    return c.Conn.SetReadDeadline(earliest(c.readDeadline, c.pongDeadline))
+}
+
+// setPongDeadline sets the time by which the client must next answer a
+// ping, or send its request header; the zero time clears it.
+func (c *clientConn) setPongDeadline(t time.Time) error {
+    c.deadlineMu.Lock()
+    defer c.deadlineMu.Unlock()
+    c.pongDeadline = t
+    return c.Conn.SetReadDeadline(earliest(c.readDeadline, c.pongDeadline))
+}
+
+// earliest returns the earlier of two deadlines, where the zero time is no
+// deadline at all.
+func earliest(a, b time.Time) time.Time {
+    if a.IsZero() || !b.IsZero() && b.Before(a) {
+        return b
+    }
+    return a
+}
+
+func (c *clientConn) ReadMessage() (int, []byte, error) {
+    messageType, message, err := c.Conn.ReadMessage()
+    if err != nil || messageType != websocket.BinaryMessage {
+        return messageType, message, err
+    }
+    message, err = c.open(message)
+    return messageType, message, err
+}
+
+// NextReader reads obfuscated messages whole, since they can only be
+// opened once all of it has arrived.
+func (c *clientConn) NextReader() (int, io.Reader, error) {
+    if c.obfs == nil {
+        return c.Conn.NextReader()
+    }
+    messageType, message, err := c.ReadMessage()
+    if err != nil {
+        return messageType, nil, err
+    }
+    return messageType, bytes.NewReader(message), nil
+}
+
+// open returns the payload of a binary message from the client, which only
+// differs from the message with OBFS_KEY set.
+func (c *clientConn) open(message []byte) ([]byte, error) {
+    if c.obfs == nil {
+        return message, nil
+    }
+    return c.obfs.open(message)
+}
+
+func (c *clientConn) WriteMessage(messageType int, data []byte) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *clientConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    return c.Conn.WriteControl(messageType, data, deadline)
+}
+
+// wsStream adapts a WebSocket connection to io.Reader and io.Writer. Read
+// returns the payloads of consecutive binary messages as one byte stream and
+// every Write is sent as a single binary message. Text messages, which some
+// browser clients send as keepalives, are not part of the stream and are
+// skipped; control frames never reach it, as gorilla/websocket handles them
+// itself.
+type wsStream struct {
+    conn   *clientConn
+    reader io.Reader
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+    for {
+        if s.reader == nil {
+            messageType, r, err := s.conn.NextReader()
+            if err != nil {
+                return 0, err
+            }
+            if messageType != websocket.BinaryMessage {
+                continue
+            }
+            s.reader = r
+        }
+
+        n, err := s.reader.Read(p)
+        if err == io.EOF {
+            s.reader = nil
+            if n == 0 {
+                continue
+            }
+            err = nil
+        }
+        return n, err
+    }
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+    if err := writeData(s.conn, p); err != nil {
+        return 0, err
+    }
+    return len(p), nil
 }
 
-func validateUUID(id []byte) bool {
-    for i, v := range id {
-        if v != hexToByte(uuid[i*2:i*2+2]) {
-            return false
+// writeData sends data to the client as one binary message. A client that
+// does not take it within WRITE_TIMEOUT fails the write, and with it the
+// session, instead of stalling the target side and pinning its buffers.
+// The deadline only applies to data messages: WriteControl, used for pings
+// and close frames, takes a deadline of its own.
+//
+// When the client negotiated permessage-deflate (WS_COMPRESS), only messages
+// of at least COMPRESS_MIN bytes are compressed. Deflate costs CPU on every
+// message and saves little on small frames or on data that is already
+// compressed or encrypted, which is most tunnelled TLS traffic, so the
+// threshold keeps the cost to the messages where it can pay off.
+func writeData(conn *clientConn, data []byte) error {
+    conn.writeMu.Lock()
+    defer conn.writeMu.Unlock()
+
+    if conn.obfs != nil {
+        var err error
+        if data, err = conn.obfs.seal(data); err != nil {
+            return err
         }
     }
-    return true
+    conn.EnableWriteCompression(len(data) >= compressMin)
+
+    if writeTimeout > 0 {
+        conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+    }
+    err := conn.Conn.WriteMessage(websocket.BinaryMessage, data)
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return fmt.Errorf("%w within %s", errWriteTimeout, writeTimeout)
+    }
+    return err
 }
 
-func hexToByte(hex string) byte {
-    var b byte
-    fmt.Sscanf(hex, "%02x", &b)
-    return b
+// validateUUID returns the label of the configured user whose UUID matches
+// id. Every configured UUID is compared in constant time, so neither the
+// position of a mismatch nor which entry matched is revealed through timing.
+func validateUUID(id []byte) (string, bool) {
+    var label string
+    found := 0
+    for uid, name := range users {
+        if subtle.ConstantTimeCompare(id, uid[:]) == 1 {
+            label = name
+            found = 1
+        }
+    }
+    return label, found == 1
 }
@@ -0,0 +1,2392 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "maps"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "testing"
+    "testing/iotest"
+    "time"
+
+    "github.com/gorilla/websocket"
+    dto "github.com/prometheus/client_model/go"
+    "golang.org/x/net/http2"
+)
+
+// testUser is the ID the tests authenticate with, the only user configured
+// while they run.
+var testUser [16]byte
+
+func TestMain(m *testing.M) {
+    if os.Getenv("TEST_MAIN") == "1" {
+        main()
+        return
+    }
+    testUser, _ = parseUUID(defaultUUID)
+    users = map[[16]byte]string{testUser: "test"}
+    // The targets of the tests listen on loopback.
+    allowPrivate = true
+    slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+    os.Exit(m.Run())
+}
+
+// newTestServer starts the proxy's HTTP handler on a loopback listener.
+func newTestServer(t testing.TB) *httptest.Server {
+    srv := httptest.NewServer(http.HandlerFunc(handleRequest))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+// newTestHandlerServer starts the handler main serves, with the features
+// the environment enables, on a loopback listener.
+func newTestHandlerServer(t testing.TB) *httptest.Server {
+    srv := httptest.NewServer(newHandler())
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+// dialProxy opens a WebSocket to path on srv.
+func dialProxy(t testing.TB, srv *httptest.Server, path string) *websocket.Conn {
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ws.Close() })
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    return ws
+}
+
+// udpEcho starts a UDP server that sends every datagram back, and returns
+// its port.
+func udpEcho(t testing.TB) uint16 {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { pc.Close() })
+    go func() {
+        buf := make([]byte, 65535)
+        for {
+            n, addr, err := pc.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            pc.WriteTo(buf[:n], addr)
+        }
+    }()
+    return uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// tcpEcho starts a TCP server that sends everything back until the client
+// closes, and returns its port.
+func tcpEcho(t testing.TB) uint16 {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// runStartup runs the configuration checks of init, which end the process
+// on an invalid setting, in a new test process with env added to the
+// environment, and returns its output and how it exited.
+func runStartup(t testing.TB, env ...string) (string, error) {
+    t.Helper()
+    cmd := exec.Command(os.Args[0], "-test.run=^$")
+    cmd.Env = append(os.Environ(), env...)
+    out, err := cmd.CombinedOutput()
+    return string(out), err
+}
+
+// effectiveConfig returns the "Effective configuration" record in out, the
+// output of runStartup, or nil.
+func effectiveConfig(out string) map[string]any {
+    return outputRecord(out, "Effective configuration")
+}
+
+// outputRecord returns the first record with msg in out, the output of a
+// server run in a child process, or nil.
+func outputRecord(out, msg string) map[string]any {
+    for _, line := range strings.Split(out, "\n") {
+        var record map[string]any
+        if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == msg {
+            return record
+        }
+    }
+    return nil
+}
+
+// mainProcess is a server running main in a child process, configured by
+// its environment.
+type mainProcess struct {
+    cmd *exec.Cmd
+    out bytes.Buffer
+}
+
+// startMain starts the server with env added to the environment and waits
+// until it accepts connections on addr.
+func startMain(t testing.TB, addr string, env ...string) *mainProcess {
+    t.Helper()
+    p := &mainProcess{cmd: exec.Command(os.Args[0], "-test.run=^$")}
+    p.cmd.Env = append(append(os.Environ(), "TEST_MAIN=1"), env...)
+    p.cmd.Stdout, p.cmd.Stderr = &p.out, &p.out
+    if err := p.cmd.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { p.stop() })
+
+    for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        if conn, err := net.Dial("tcp", addr); err == nil {
+            conn.Close()
+            return p
+        }
+        if time.Now().After(deadline) {
+            p.stop()
+            t.Fatalf("server not listening on %s: %s", addr, p.out.String())
+        }
+    }
+}
+
+// stop shuts the server down as a SIGTERM does and returns its output.
+func (p *mainProcess) stop() string {
+    if p.cmd.ProcessState == nil {
+        p.cmd.Process.Signal(syscall.SIGTERM)
+        p.cmd.Wait()
+    }
+    return p.out.String()
+}
+
+// readResponse reads the VLESS response header from ws.
+func readResponse(t testing.TB, ws *websocket.Conn) {
+    t.Helper()
+    _, message, err := ws.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(message, []byte{vlessVersion, 0}) {
+        t.Fatalf("response header %x, want %x", message, []byte{vlessVersion, 0})
+    }
+}
+
+// expectClose reads from ws until it is closed, and fails unless it was
+// closed with code.
+func expectClose(t testing.TB, ws *websocket.Conn, code int) {
+    t.Helper()
+    for {
+        _, message, err := ws.ReadMessage()
+        if err == nil {
+            if len(message) == 2 && message[0] == vlessVersion {
+                t.Fatalf("got a success response before the close")
+            }
+            continue
+        }
+        if !websocket.IsCloseError(err, code) {
+            t.Fatalf("got %v, want close code %d", err, code)
+        }
+        return
+    }
+}
+
+// logRecords collects the JSON log lines of the code under test.
+type logRecords struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (l *logRecords) Write(p []byte) (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.buf.Write(p)
+}
+
+// records returns the lines logged so far, decoded.
+func (l *logRecords) records() []map[string]any {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    var records []map[string]any
+    for _, line := range bytes.Split(l.buf.Bytes(), []byte("\n")) {
+        var record map[string]any
+        if json.Unmarshal(line, &record) == nil {
+            records = append(records, record)
+        }
+    }
+    return records
+}
+
+// find returns the first record with msg, or nil.
+func (l *logRecords) find(msg string) map[string]any {
+    for _, record := range l.records() {
+        if record["msg"] == msg {
+            return record
+        }
+    }
+    return nil
+}
+
+// wait returns the first record with msg, waiting up to five seconds for
+// it to be logged.
+func (l *logRecords) wait(t testing.TB, msg string) map[string]any {
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if record := l.find(msg); record != nil {
+            return record
+        }
+    }
+    t.Fatalf("%q not logged", msg)
+    return nil
+}
+
+// captureLogs sends everything logged at debug level and above to the
+// returned records for the rest of the test.
+func captureLogs(t testing.TB) *logRecords {
+    logs := &logRecords{}
+    saved := slog.Default()
+    slog.SetDefault(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+    t.Cleanup(func() { slog.SetDefault(saved) })
+    return logs
+}
+
+// udpPacket frames payload as a VLESS UDP packet.
+func udpPacket(payload string) []byte {
+    return append(binary.BigEndian.AppendUint16(nil, uint16(len(payload))), payload...)
+}
+
+// testRequest builds a VLESS request header for command to host and port,
+// sent with the address type its form calls for, followed by payload.
+func testRequest(id [16]byte, command byte, host string, port uint16, payload []byte) []byte {
+    m := append([]byte{vlessVersion}, id[:]...)
+    m = append(m, 0, command)
+    if command == commandMux {
+        return append(m, payload...)
+    }
+    m = binary.BigEndian.AppendUint16(m, port)
+    switch ip := net.ParseIP(host); {
+    case ip == nil:
+        m = append(m, 2, byte(len(host)))
+        m = append(m, host...)
+    case ip.To4() != nil:
+        m = append(m, 1)
+        m = append(m, ip.To4()...)
+    default:
+        m = append(m, 3)
+        m = append(m, ip.To16()...)
+    }
+    return append(m, payload...)
+}
+
+func FuzzParseHeader(f *testing.F) {
+    var id [16]byte
+    seeds := [][]byte{
+        testRequest(id, commandTCP, "127.0.0.1", 80, []byte("GET / HTTP/1.1\r\n\r\n")),
+        testRequest(id, commandTCP, "example.com", 443, nil),
+        testRequest(id, commandTCP, "2001:db8::1", 443, nil),
+        testRequest(id, commandUDP, "8.8.8.8", 53, []byte{0, 2, 1, 2}),
+        testRequest(id, commandMux, "", 0, []byte{0, 4, 0, 1, 1, 0}),
+    }
+    // Every valid header cut short, at each byte.
+    valid := testRequest(id, commandTCP, "example.com", 443, nil)
+    for i := range valid {
+        seeds = append(seeds, valid[:i])
+    }
+    // Lengths that claim more than the message holds.
+    seeds = append(seeds,
+        append(append([]byte{vlessVersion}, id[:]...), 255, commandTCP),
+        append(append([]byte{vlessVersion}, id[:]...), 0, commandTCP, 0, 80, 2, 255, 'a'),
+        append(append([]byte{vlessVersion}, id[:]...), 0, commandTCP, 0, 80, 2, 0),
+        testRequest(id, commandTCP, "example.com", 443, bytes.Repeat([]byte{0xff}, 64<<10)),
+        append(append([]byte{vlessVersion}, id[:]...), 0, 99, 0, 80, 1, 127, 0, 0, 1),
+        append(append([]byte{1}, id[:]...), 0, commandTCP, 0, 80, 1, 127, 0, 0, 1),
+    )
+    for _, seed := range seeds {
+        f.Add(seed)
+    }
+
+    f.Fuzz(func(t *testing.T, message []byte) {
+        req, rest, err := parseVlessHeader(message)
+        if err != nil {
+            var pe *proxyError
+            if !errors.As(err, &pe) {
+                t.Fatalf("error %v does not carry a close code", err)
+            }
+            return
+        }
+        if req.version != vlessVersion || len(req.id) != 16 {
+            t.Fatalf("accepted header with version %d and ID of %d bytes", req.version, len(req.id))
+        }
+        if len(rest) > len(message)-19 || !bytes.HasSuffix(message, rest) {
+            t.Fatalf("data after the header is not the end of the message")
+        }
+        switch req.command {
+        case commandTCP, commandUDP:
+            if req.host == "" {
+                t.Fatalf("accepted %d command without a host", req.command)
+            }
+        case commandMux:
+        default:
+            t.Fatalf("accepted unknown command %d", req.command)
+        }
+    })
+}
+
+func TestParseVlessHeaderBounds(t *testing.T) {
+    var id [16]byte
+    valid := testRequest(id, commandTCP, "example.com", 443, []byte("data"))
+    header := valid[:len(valid)-len("data")]
+    for i := range header {
+        if _, _, err := parseVlessHeader(header[:i]); !errors.Is(err, errShortHeader) {
+            t.Errorf("header cut to %d bytes: got %v", i, err)
+        }
+    }
+    req, rest, err := parseVlessHeader(valid)
+    if err != nil || req.host != "example.com" || req.port != 443 || string(rest) != "data" {
+        t.Errorf("got %+v, %q, %v", req, rest, err)
+    }
+
+    prefix := append([]byte{vlessVersion}, id[:]...)
+    for name, message := range map[string][]byte{
+        "addons past the end":      append(append(prefix, 255), bytes.Repeat([]byte{0}, 100)...),
+        "domain past the end":      append(append(prefix, 0, commandTCP, 1, 187, 2, 255), "example.com"...),
+        "addon length past addons": append(append(prefix, 2, 0x0a, 0x7f), commandTCP, 1, 187, 1, 127, 0, 0, 1),
+    } {
+        if _, _, err := parseVlessHeader(message); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+}
+
+// FuzzParseAddons checks that no addons, however their lengths are
+// crafted, panic the parser.
+func FuzzParseAddons(f *testing.F) {
+    f.Add([]byte{})
+    f.Add([]byte{0x0a, 4, 'x', 't', 'l', 's'})
+    f.Add([]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f})
+    f.Add([]byte{0x10, 0x80})
+    f.Fuzz(func(t *testing.T, addons []byte) {
+        if flow, err := parseAddons(addons); err == nil && len(flow) > len(addons) {
+            t.Fatalf("flow %q is longer than the addons", flow)
+        }
+    })
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+
+    request := testRequest(testUser, commandUDP, "127.0.0.1", udpEcho(t), udpPacket("ping"))
+    if err := ws.WriteMessage(websocket.BinaryMessage, request); err != nil {
+        t.Fatal(err)
+    }
+    readResponse(t, ws)
+
+    // Two datagrams in one message, the second split over the next.
+    second := udpPacket("second")
+    ws.WriteMessage(websocket.BinaryMessage, append(udpPacket("first"), second[:3]...))
+    ws.WriteMessage(websocket.BinaryMessage, second[3:])
+
+    for _, want := range []string{"ping", "first", "second"} {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(message, udpPacket(want)) {
+            t.Fatalf("got %q, want %q", message, udpPacket(want))
+        }
+    }
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("before")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "before" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+
+    defer draining.Store(false)
+    stopped := make(chan struct{})
+    go func() {
+        shutdown([]*http.Server{srv.Config})
+        close(stopped)
+    }()
+    for !draining.Load() {
+        time.Sleep(time.Millisecond)
+    }
+
+    // The session still runs while the server shuts down.
+    ws.WriteMessage(websocket.BinaryMessage, []byte("after"))
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "after" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    select {
+    case <-stopped:
+        t.Fatal("shutdown returned with a session still running")
+    default:
+    }
+
+    ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+    select {
+    case <-stopped:
+    case <-time.After(5 * time.Second):
+        t.Fatal("shutdown did not return once the session ended")
+    }
+}
+
+// hexToByte and sscanfValidateUUID are the per-request parsing that
+// validateUUID replaced, kept to benchmark against.
+func hexToByte(s string) byte {
+    var b byte
+    fmt.Sscanf(s, "%02x", &b)
+    return b
+}
+
+func sscanfValidateUUID(id []byte, uuid string) bool {
+    uuid = strings.ReplaceAll(uuid, "-", "")
+    for i := range 16 {
+        if id[i] != hexToByte(uuid[i*2:i*2+2]) {
+            return false
+        }
+    }
+    return true
+}
+
+func BenchmarkValidateUUID(b *testing.B) {
+    b.Run("sscanf", func(b *testing.B) {
+        for range b.N {
+            sscanfValidateUUID(testUser[:], defaultUUID)
+        }
+    })
+    b.Run("decoded", func(b *testing.B) {
+        for range b.N {
+            validateUUID(testUser[:])
+        }
+    })
+}
+
+func TestInvalidUUIDRejectedAtStartup(t *testing.T) {
+    for _, uuid := range []string{
+        "de04add9-5c68-8bab-950c-08cd5320df1",
+        "de04add9-5c68-8bab-950c-08cd5320dfzz",
+        "de04add9",
+    } {
+        out, err := runStartup(t, "UUID="+uuid)
+        if err == nil {
+            t.Errorf("UUID %q accepted", uuid)
+        } else if !strings.Contains(out, "Invalid user configuration") {
+            t.Errorf("UUID %q: unexpected output %s", uuid, out)
+        }
+    }
+    if out, err := runStartup(t, "UUID="+defaultUUID); err != nil {
+        t.Errorf("valid UUID rejected: %s", out)
+    }
+}
+
+// setVar sets *p to v for the rest of the test. The old value is only
+// restored once the sessions the test started have ended, since they may
+// still read it.
+func setVar[T any](t testing.TB, p *T, v T) {
+    saved := *p
+    *p = v
+    t.Cleanup(func() {
+        endSessions()
+        *p = saved
+    })
+}
+
+// endSessions closes the connections of every session still running, as
+// the end of the shutdown grace period does, and waits for them to end.
+func endSessions() {
+    cancelSessions()
+    sessions.Wait()
+    sessionCtx, cancelSessions = context.WithCancel(context.Background())
+}
+
+// withUsers replaces the configured users for the rest of the test.
+func withUsers(t testing.TB, list string) {
+    t.Helper()
+    parsed, err := parseUsers(list)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setVar(t, &users, parsed)
+}
+
+func TestValidateUUID(t *testing.T) {
+    if label, ok := validateUUID(testUser[:]); !ok || label != "test" {
+        t.Errorf("configured UUID: got %q, %v", label, ok)
+    }
+    for i := range testUser {
+        other := testUser
+        other[i] ^= 0x80
+        if _, ok := validateUUID(other[:]); ok {
+            t.Errorf("UUID differing in byte %d accepted", i)
+        }
+    }
+    if _, ok := validateUUID(testUser[:15]); ok {
+        t.Error("short ID accepted")
+    }
+}
+
+func TestMultipleUsers(t *testing.T) {
+    alice, _ := parseUUID("11111111-1111-1111-1111-111111111111")
+    bob, _ := parseUUID("22222222-2222-2222-2222-222222222222")
+    stranger, _ := parseUUID("33333333-3333-3333-3333-333333333333")
+
+    t.Run("one", func(t *testing.T) {
+        withUsers(t, "11111111-1111-1111-1111-111111111111")
+        if label, ok := validateUUID(alice[:]); !ok || label != "user1" {
+            t.Errorf("got %q, %v", label, ok)
+        }
+        if _, ok := validateUUID(bob[:]); ok {
+            t.Error("unconfigured UUID accepted")
+        }
+    })
+
+    t.Run("several", func(t *testing.T) {
+        withUsers(t, "alice:11111111-1111-1111-1111-111111111111, bob:22222222222222222222222222222222")
+        srv := newTestServer(t)
+        port := tcpEcho(t)
+        for id, want := range map[[16]byte]string{alice: "alice", bob: "bob"} {
+            if label, ok := validateUUID(id[:]); !ok || label != want {
+                t.Errorf("got %q, %v, want %q", label, ok, want)
+            }
+            ws := dialProxy(t, srv, "/")
+            ws.WriteMessage(websocket.BinaryMessage, testRequest(id, commandTCP, "127.0.0.1", port, []byte(want)))
+            readResponse(t, ws)
+            if _, message, err := ws.ReadMessage(); err != nil || string(message) != want {
+                t.Errorf("%s: got %q, %v", want, message, err)
+            }
+        }
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(stranger, commandTCP, "127.0.0.1", port, nil))
+        if _, _, err := ws.ReadMessage(); err == nil {
+            t.Error("unconfigured UUID was served")
+        }
+    })
+
+    t.Run("none", func(t *testing.T) {
+        parsed, err := parseUsers("")
+        if err != nil || len(parsed) != 0 {
+            t.Fatalf("got %v, %v", parsed, err)
+        }
+        // Without any UUID the default one is served, with a warning.
+        out, err := runStartup(t, "UUID=", "UUIDS=")
+        if err != nil || !strings.Contains(out, "No UUID configured") {
+            t.Errorf("got %v: %s", err, out)
+        }
+    })
+}
+
+func TestWSPath(t *testing.T) {
+    setVar(t, &wsPath, "/secret")
+    srv := newTestServer(t)
+    url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+    _, resp, err := websocket.DefaultDialer.Dial(url+"/", nil)
+    if err == nil {
+        t.Fatal("upgrade at the wrong path succeeded")
+    }
+    body, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK || string(body) != rootResponse ||
+        !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+        t.Errorf("wrong path: got %d %q (%s)", resp.StatusCode, body, resp.Header.Get("Content-Type"))
+    }
+
+    ws := dialProxy(t, srv, "/secret")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+}
+
+// BenchmarkPump reports the allocations per MiB relayed by pump, and by a
+// copy that allocates its buffers as the relay did before pooling: one per
+// connection and one per chunk read.
+func BenchmarkPump(b *testing.B) {
+    data := make([]byte, 1<<20)
+    b.Run("pooled", func(b *testing.B) {
+        b.SetBytes(int64(len(data)))
+        b.ReportAllocs()
+        for range b.N {
+            pump(io.Discard, bytes.NewReader(data), nil, func(int) {})
+        }
+    })
+    b.Run("allocating", func(b *testing.B) {
+        b.SetBytes(int64(len(data)))
+        b.ReportAllocs()
+        for range b.N {
+            src := bytes.NewReader(data)
+            buffer := make([]byte, 4096)
+            for {
+                n, err := src.Read(buffer)
+                if err != nil {
+                    break
+                }
+                chunk := make([]byte, n)
+                copy(chunk, buffer[:n])
+                io.Discard.Write(chunk)
+            }
+        }
+    })
+}
+
+func TestIdleTimeout(t *testing.T) {
+    setVar(t, &idleTimeout, 200*time.Millisecond)
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+    ws.ReadMessage()
+
+    start := time.Now()
+    for {
+        if _, _, err := ws.ReadMessage(); err != nil {
+            break
+        }
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Errorf("idle session closed after %s", elapsed)
+    }
+}
+
+func TestPrivateTargetsBlocked(t *testing.T) {
+    setVar(t, &allowPrivate, false)
+
+    for _, host := range []string{"127.0.0.1", "10.0.0.1", "169.254.169.254", "::1", "fd00::1"} {
+        if _, err := resolveTarget(host); !errors.Is(err, errPrivateTarget) {
+            t.Errorf("%s: got %v, want errPrivateTarget", host, err)
+        }
+    }
+    for _, host := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+        if ips, err := resolveTarget(host); err != nil || len(ips) != 1 {
+            t.Errorf("%s: got %v, %v", host, ips, err)
+        }
+    }
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    expectClose(t, ws, closeBlockedHost)
+}
+
+func TestHealth(t *testing.T) {
+    srv := newTestHandlerServer(t)
+    health := func() map[string]any {
+        t.Helper()
+        resp, err := http.Get(srv.URL + "/health")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+            t.Fatalf("got %d, %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+        }
+        var body map[string]any
+        if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+            t.Fatal(err)
+        }
+        for _, key := range []string{"status", "uptime_seconds", "active_connections"} {
+            if _, ok := body[key]; !ok {
+                t.Fatalf("%s missing from %v", key, body)
+            }
+        }
+        return body
+    }
+
+    before := health()
+    if before["status"] != "ok" {
+        t.Errorf("status %v", before["status"])
+    }
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+    if during := health(); during["active_connections"].(float64) != before["active_connections"].(float64)+1 {
+        t.Errorf("active_connections %v with a session open, %v before", during["active_connections"], before["active_connections"])
+    }
+}
+
+func TestLogFields(t *testing.T) {
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hi")))
+    readResponse(t, ws)
+
+    record := logs.find("Connection details")
+    if record == nil {
+        t.Fatal("no Connection details record")
+    }
+    if record["level"] != "DEBUG" || record["host"] != "127.0.0.1" || record["port"] != float64(port) ||
+        record["atyp"] != float64(1) || record["conn_id"] == nil {
+        t.Errorf("got %v", record)
+    }
+}
+
+func TestConnIDs(t *testing.T) {
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+    ports := []uint16{tcpEcho(t), tcpEcho(t)}
+    var conns []*websocket.Conn
+    for _, port := range ports {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hi")))
+        readResponse(t, ws)
+        conns = append(conns, ws)
+    }
+    for _, ws := range conns {
+        ws.ReadMessage()
+        ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+        ws.ReadMessage()
+    }
+    time.Sleep(50 * time.Millisecond)
+
+    // Each connection's ID is the one on the line naming its target.
+    ids := map[any]uint16{}
+    for _, record := range logs.records() {
+        if record["msg"] == "Connection details" {
+            ids[record["conn_id"]] = uint16(record["port"].(float64))
+        }
+    }
+    if len(ids) != 2 {
+        t.Fatalf("got connection IDs %v, want two", ids)
+    }
+    sessionLines := 0
+    for _, record := range logs.records() {
+        id, ok := record["conn_id"]
+        if !ok {
+            continue
+        }
+        port, known := ids[id]
+        if !known {
+            t.Errorf("line with unknown conn_id: %v", record)
+        }
+        if target, ok := record["target"].(string); ok && !strings.HasSuffix(target, fmt.Sprintf(":%d", port)) {
+            t.Errorf("line for %s carries the ID of the session to port %d", target, port)
+        }
+        sessionLines++
+    }
+    if sessionLines < 6 {
+        t.Errorf("only %d lines carry a conn_id", sessionLines)
+    }
+}
+
+// tcpServer starts a TCP server that serves every connection with handle,
+// and returns its port.
+func tcpServer(t testing.TB, handle func(net.Conn)) uint16 {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                handle(conn)
+            }()
+        }
+    }()
+    return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// closedPort returns a loopback port that nothing listens on, so that
+// connections to it are refused.
+func closedPort(t testing.TB) uint16 {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ln.Close()
+    return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHalfClose(t *testing.T) {
+    // The target only answers once it has read everything the client sent.
+    port := tcpServer(t, func(conn net.Conn) {
+        request, _ := io.ReadAll(conn)
+        conn.Write(append([]byte("got "), request...))
+    })
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("request")))
+    readResponse(t, ws)
+    ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+    _, message, err := ws.ReadMessage()
+    if err != nil || string(message) != "got request" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+        t.Errorf("got %v, want a normal close", err)
+    }
+}
+
+func TestFallbackProxy(t *testing.T) {
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "upstream %s %s", r.Host, r.URL.Path)
+    }))
+    t.Cleanup(upstream.Close)
+    proxy, err := newFallbackProxy(upstream.URL)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setVar(t, &fallback, proxy)
+
+    srv := newTestServer(t)
+    resp, err := http.Get(srv.URL + "/index.html")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if want := "upstream " + strings.TrimPrefix(upstream.URL, "http://") + " /index.html"; string(body) != want {
+        t.Errorf("got %q, want %q", body, want)
+    }
+}
+
+func TestMaxConns(t *testing.T) {
+    setVar(t, &connSlots, make(chan struct{}, 1))
+    srv := newTestServer(t)
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+    port := tcpEcho(t)
+
+    first := dialProxy(t, srv, "/")
+    first.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hi")))
+    readResponse(t, first)
+
+    _, resp, err := websocket.DefaultDialer.Dial(url, nil)
+    if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+        t.Fatalf("second upgrade: got %v, %v", resp, err)
+    }
+
+    first.Close()
+    for deadline := time.Now().Add(5 * time.Second); len(connSlots) > 0; time.Sleep(10 * time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatal("slot not released after the first session closed")
+        }
+    }
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hi")))
+    readResponse(t, ws)
+}
+
+func TestCommandByte(t *testing.T) {
+    valid := testRequest(testUser, commandTCP, "127.0.0.1", 80, nil)
+    req, _, err := parseVlessHeader(valid)
+    if err != nil || req.command != commandTCP || req.host != "127.0.0.1" || req.port != 80 {
+        t.Errorf("command 1: got %+v, %v", req, err)
+    }
+
+    var perr *proxyError
+    _, _, err = parseVlessHeader(testRequest(testUser, 99, "127.0.0.1", 80, nil))
+    if !errors.As(err, &perr) || perr.code != closeBadCommand || !strings.Contains(err.Error(), "99") {
+        t.Errorf("command 99: got %v", err)
+    }
+    _, _, err = parseVlessHeader(valid[:18])
+    if !errors.Is(err, errShortHeader) || !errors.As(err, &perr) || perr.code != closeMalformedHeader {
+        t.Errorf("truncated before the command: got %v", err)
+    }
+
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, 99, "127.0.0.1", tcpEcho(t), nil))
+    expectClose(t, ws, closeBadCommand)
+}
+
+func TestClosedPortGetsNoResponse(t *testing.T) {
+    port := closedPort(t)
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hi")))
+    expectClose(t, ws, closeDialFailed)
+}
+
+func TestDialNetwork(t *testing.T) {
+    stubResolver(t, time.Minute, 0, func(string) ([]net.IP, error) {
+        return []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}, nil
+    })
+    setVar(t, &dialFamily, "4")
+
+    ips, err := resolveTarget("dual.test")
+    if err != nil || len(ips) != 1 || ips[0].To4() == nil {
+        t.Fatalf("got %v, %v, want only the IPv4 address", ips, err)
+    }
+    // The target listens on IPv4 only: an IPv6 dial could not reach it.
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "dual.test", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+        t.Errorf("got %q, %v", message, err)
+    }
+}
+
+func TestDialTriesEveryAddress(t *testing.T) {
+    port := tcpEcho(t)
+    // Nothing listens on 127.0.0.2 at the port of the echo server.
+    conn, err := dialTarget("tcp", []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}, port)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.Close()
+    if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv4(127, 0, 0, 1)) {
+        t.Errorf("connected to %v", got)
+    }
+
+    if _, err := dialTarget("tcp", []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}, closedPort(t)); err == nil {
+        t.Error("no error when every address refuses")
+    }
+}
+
+func TestPings(t *testing.T) {
+    setVar(t, &pingInterval, 20*time.Millisecond)
+    setVar(t, &pongTimeout, 100*time.Millisecond)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    // A client that answers pings keeps its idle session.
+    ws := dialProxy(t, srv, "/")
+    pings := make(chan struct{}, 16)
+    ws.SetPingHandler(func(data string) error {
+        select {
+        case pings <- struct{}{}:
+        default:
+        }
+        return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+    })
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    go ws.ReadMessage()
+    for i := 0; i < 10; i++ {
+        select {
+        case <-pings:
+        case <-time.After(time.Second):
+            t.Fatalf("only %d pings on an idle connection", i)
+        }
+    }
+
+    // One that does not is closed once PONG_TIMEOUT has passed.
+    silent := dialProxy(t, srv, "/")
+    silent.SetPingHandler(func(string) error { return nil })
+    silent.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, silent)
+    silent.SetReadDeadline(time.Now().Add(time.Second))
+    var netErr net.Error
+    if _, _, err := silent.ReadMessage(); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+        t.Errorf("connection that never answered a ping stayed open: %v", err)
+    }
+}
+
+// BenchmarkWSBuffers measures a download through the proxy with the
+// WebSocket buffers at the library's 1 KiB and at the 32 KiB default.
+func BenchmarkWSBuffers(b *testing.B) {
+    data := make([]byte, 4<<20)
+    port := tcpServer(b, func(conn net.Conn) { conn.Write(data) })
+    for _, size := range []int{1024, 32 * 1024} {
+        b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+            u := upgrader
+            u.ReadBufferSize, u.WriteBufferSize = size, size
+            setVar(b, &upgrader, u)
+            srv := newTestServer(b)
+            dialer := websocket.Dialer{ReadBufferSize: size, WriteBufferSize: size}
+            url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+
+            b.SetBytes(int64(len(data)))
+            for range b.N {
+                ws, _, err := dialer.Dial(url, nil)
+                if err != nil {
+                    b.Fatal(err)
+                }
+                ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+                readResponse(b, ws)
+                for n := 0; n < len(data); {
+                    _, message, err := ws.ReadMessage()
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                    n += len(message)
+                }
+                ws.Close()
+            }
+        })
+    }
+}
+
+func TestCheckOrigin(t *testing.T) {
+    srv := newTestServer(t)
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+    upgrade := func(origin string) bool {
+        t.Helper()
+        ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+        if err == nil {
+            ws.Close()
+        }
+        return err == nil
+    }
+
+    setVar(t, &allowedOrigins, nil)
+    if !upgrade("https://anywhere.example") {
+        t.Error("origin refused with ALLOWED_ORIGINS empty")
+    }
+    allowedOrigins = []string{"https://app.example"}
+    if !upgrade("https://app.example") {
+        t.Error("allowed origin refused")
+    }
+    if upgrade("https://evil.example") {
+        t.Error("disallowed origin accepted")
+    }
+    allowedOrigins = []string{"*"}
+    if !upgrade("https://evil.example") {
+        t.Error("origin refused with the * wildcard")
+    }
+}
+
+func TestMaxMessageSize(t *testing.T) {
+    setVar(t, &maxMessageSize, 1024)
+    srv := newTestServer(t)
+    oversized := make([]byte, 2048)
+
+    // As the request header,
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, append(testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil), oversized...))
+    expectClose(t, ws, websocket.CloseMessageTooBig)
+
+    // and once the session has started.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    readResponse(t, ws)
+    ws.WriteMessage(websocket.BinaryMessage, oversized)
+    for {
+        _, _, err := ws.ReadMessage()
+        if err != nil {
+            if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+                t.Errorf("got %v, want close code %d", err, websocket.CloseMessageTooBig)
+            }
+            break
+        }
+    }
+}
+
+func TestAddons(t *testing.T) {
+    withAddons := func(addons []byte) []byte {
+        m := testRequest(testUser, commandTCP, "127.0.0.1", 80, nil)
+        return append(append(append(m[:17:17], byte(len(addons))), addons...), m[18:]...)
+    }
+    var perr *proxyError
+
+    if req, _, err := parseVlessHeader(withAddons(nil)); err != nil || req.host != "127.0.0.1" {
+        t.Errorf("empty addons: got %+v, %v", req, err)
+    }
+    // Fields other than the flow, here a varint field 2, are skipped.
+    if req, _, err := parseVlessHeader(withAddons([]byte{2 << 3, 1})); err != nil || req.port != 80 {
+        t.Errorf("addons without a flow: got %+v, %v", req, err)
+    }
+    flow := append([]byte{1<<3 | 2, 16}, "xtls-rprx-vision"...)
+    _, _, err := parseVlessHeader(withAddons(flow))
+    if !errors.As(err, &perr) || perr.code != closeBadCommand || !strings.Contains(err.Error(), "xtls-rprx-vision") {
+        t.Errorf("flow: got %v", err)
+    }
+    _, _, err = parseVlessHeader(withAddons([]byte{1<<3 | 2, 40, 'x'}))
+    if !errors.As(err, &perr) || perr.code != closeMalformedHeader {
+        t.Errorf("truncated addons: got %v", err)
+    }
+}
+
+// countDials makes the dialer call before for every connection attempt,
+// numbered from 1, for the rest of the test.
+func countDials(t testing.TB, before func(attempt int, address string)) {
+    d := *dialer
+    attempts := 0
+    d.Control = func(_, address string, _ syscall.RawConn) error {
+        attempts++
+        before(attempts, address)
+        return nil
+    }
+    setVar(t, &dialer, &d)
+}
+
+func TestDialRetry(t *testing.T) {
+    setVar(t, &dialRetries, dialRetries)
+    setVar(t, &dialBackoff, dialBackoff)
+    target := []net.IP{net.IPv4(127, 0, 0, 1)}
+
+    // The target only starts listening on the third attempt.
+    t.Run("recovers", func(t *testing.T) {
+        dialRetries, dialBackoff = 5, time.Millisecond
+        port := closedPort(t)
+        var attempts int
+        countDials(t, func(attempt int, address string) {
+            attempts = attempt
+            if attempt == 3 {
+                ln, err := net.Listen("tcp", address)
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                t.Cleanup(func() { ln.Close() })
+            }
+        })
+        conn, err := dialTarget("tcp", target, port)
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn.Close()
+        if attempts != 3 {
+            t.Errorf("connected after %d attempts, want 3", attempts)
+        }
+    })
+
+    t.Run("no retries", func(t *testing.T) {
+        dialRetries = 0
+        var attempts int
+        countDials(t, func(attempt int, _ string) { attempts = attempt })
+        if _, err := dialTarget("tcp", target, closedPort(t)); err == nil || attempts != 1 {
+            t.Errorf("got %v after %d attempts", err, attempts)
+        }
+    })
+
+    // Backoffs of 50ms and 100ms would end at 150ms; the second is cut
+    // short at the 120ms the retries may take, for a last attempt then.
+    t.Run("capped", func(t *testing.T) {
+        dialRetries, dialBackoff = 100, 50*time.Millisecond
+        setVar(t, &maxDialRetryTime, 120*time.Millisecond)
+        var attempts int
+        countDials(t, func(attempt int, _ string) { attempts = attempt })
+        start := time.Now()
+        _, err := dialTarget("tcp", target, closedPort(t))
+        elapsed := time.Since(start)
+        if err == nil || attempts != 3 || elapsed < maxDialRetryTime || elapsed > maxDialRetryTime+100*time.Millisecond {
+            t.Errorf("got %v after %d attempts in %s", err, attempts, elapsed)
+        }
+    })
+}
+
+func TestUnixSocket(t *testing.T) {
+    dir, err := os.MkdirTemp("", "proxy")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    setVar(t, &unixSocket, dir+"/proxy.sock")
+    setVar(t, &unixSocketMode, 0o660)
+    // A socket file left behind by an earlier run.
+    os.WriteFile(unixSocket, nil, 0o600)
+
+    ln, err := listen("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := &http.Server{Handler: http.HandlerFunc(handleRequest)}
+    go srv.Serve(ln)
+    t.Cleanup(func() { srv.Close() })
+    if info, err := os.Stat(unixSocket); err != nil || info.Mode().Perm() != 0o660 {
+        t.Errorf("socket mode: got %v, %v", info.Mode(), err)
+    }
+
+    d := websocket.Dialer{NetDial: func(string, string) (net.Conn, error) { return net.Dial("unix", unixSocket) }}
+    ws, _, err := d.Dial("ws://proxy/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hi" {
+        t.Errorf("got %q, %v", message, err)
+    }
+}
+
+func TestH2C(t *testing.T) {
+    t.Setenv("H2C", "1")
+    srv := newTestHandlerServer(t)
+
+    // HTTP/2 with prior knowledge, over plain TCP.
+    client := &http.Client{Transport: &http2.Transport{
+        AllowHTTP: true,
+        DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+            return (&net.Dialer{}).DialContext(ctx, network, addr)
+        },
+    }}
+    resp, err := client.Get(srv.URL + "/health")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+        t.Errorf("got %s %d", resp.Proto, resp.StatusCode)
+    }
+
+    // WebSocket upgrades still arrive over HTTP/1.1.
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hi")))
+    readResponse(t, ws)
+}
+
+func TestCloseReasons(t *testing.T) {
+    setVar(t, &denyHosts, parseHostPatterns("blocked.example"))
+    srv := newTestServer(t)
+
+    for _, c := range []struct {
+        request []byte
+        code    int
+    }{
+        {testRequest(testUser, commandTCP, "blocked.example", 443, nil), closeBlockedHost},
+        {testRequest(testUser, commandTCP, "127.0.0.1", closedPort(t), nil), closeDialFailed},
+        {testRequest(testUser, 7, "127.0.0.1", 443, nil), closeBadCommand},
+    } {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, c.request)
+        _, _, err := ws.ReadMessage()
+        var ce *websocket.CloseError
+        if !errors.As(err, &ce) || ce.Code != c.code || ce.Text != closeReasons[c.code] {
+            t.Errorf("got %v, want close code %d %q", err, c.code, closeReasons[c.code])
+        }
+    }
+}
+
+func TestStartupValidation(t *testing.T) {
+    for _, value := range []string{"lots", "0", "-1"} {
+        out, err := runStartup(t, "BUFFER_SIZE="+value)
+        if err == nil || !strings.Contains(out, "Invalid BUFFER_SIZE") {
+            t.Errorf("BUFFER_SIZE=%s: got %v: %s", value, err, out)
+        }
+    }
+
+    out, err := runStartup(t, "BUFFER_SIZE=65536", "WS_PATH=/tunnel")
+    if err != nil {
+        t.Fatalf("valid configuration refused: %v: %s", err, out)
+    }
+    summary := effectiveConfig(out)
+    if summary == nil || summary["buffer_size"] != float64(65536) || summary["ws_path"] != "/tunnel" {
+        t.Errorf("configuration summary: got %v", summary)
+    }
+}
+
+func TestPorts(t *testing.T) {
+    first, second := closedPort(t), closedPort(t)
+    // main listens on the ports in order, so the second is the last.
+    p := startMain(t, fmt.Sprintf("127.0.0.1:%d", second),
+        fmt.Sprintf("PORTS=%d,%d", first, second), "BIND_ADDR=127.0.0.1")
+    for _, port := range []uint16{first, second} {
+        resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/health", port))
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            t.Errorf("port %d: got %d", port, resp.StatusCode)
+        }
+    }
+
+    p.stop()
+    for _, port := range []uint16{first, second} {
+        if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+            conn.Close()
+            t.Errorf("port %d still open after shutdown", port)
+        }
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    request := func(header http.Header) *http.Request {
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        r.RemoteAddr = "192.0.2.10:4321"
+        r.Header = header
+        return r
+    }
+    spoofed := http.Header{"X-Forwarded-For": {"198.51.100.7, 203.0.113.5"}, "X-Real-Ip": {"203.0.113.9"}}
+
+    setVar(t, &trustProxy, false)
+    if ip := clientIP(request(spoofed)); ip != "192.0.2.10" {
+        t.Errorf("untrusted: got %s", ip)
+    }
+
+    trustProxy = true
+    for _, c := range []struct {
+        header http.Header
+        want   string
+    }{
+        // Only the last hop was added by the trusted proxy.
+        {spoofed, "203.0.113.5"},
+        {http.Header{"X-Forwarded-For": {"198.51.100.7", "203.0.113.5"}}, "203.0.113.5"},
+        {http.Header{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9"},
+        {http.Header{"X-Forwarded-For": {"not-an-ip"}}, "192.0.2.10"},
+        {http.Header{}, "192.0.2.10"},
+    } {
+        if ip := clientIP(request(c.header)); ip != c.want {
+            t.Errorf("%v: got %s, want %s", c.header, ip, c.want)
+        }
+    }
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+    setVar(t, &handshakeTimeout, 100*time.Millisecond)
+    srv := newTestServer(t)
+
+    idle := dialProxy(t, srv, "/")
+    start := time.Now()
+    if _, _, err := idle.ReadMessage(); err == nil || time.Since(start) > 2*time.Second {
+        t.Errorf("connection without a request header: got %v after %s", err, time.Since(start))
+    }
+
+    // Once the session has started, the timeout no longer applies.
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    readResponse(t, ws)
+    time.Sleep(3 * handshakeTimeout)
+    ws.WriteMessage(websocket.BinaryMessage, []byte("still here"))
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "still here" {
+        t.Errorf("session after the handshake timeout: got %q, %v", message, err)
+    }
+}
+
+func TestTargetPortChecks(t *testing.T) {
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", 0, nil))
+    expectClose(t, ws, closeBadCommand)
+
+    // The server is told it listens on the port of the test server.
+    _, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+    setVar(t, &ports, []string{port})
+    self, _ := strconv.ParseUint(port, 10, 16)
+    for _, host := range []string{"127.0.0.1", "0.0.0.0", "localhost"} {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, host, uint16(self), nil))
+        expectClose(t, ws, closeBlockedHost)
+    }
+}
+
+func TestShortMessage(t *testing.T) {
+    setVar(t, &handshakeTimeout, 200*time.Millisecond)
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+
+    // Five bytes that are not VLESS are refused at once,
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, []byte{0x16, 0x03, 0x01, 0x02, 0x00})
+    start := time.Now()
+    expectClose(t, ws, closeMalformedHeader)
+    if elapsed := time.Since(start); elapsed >= handshakeTimeout {
+        t.Errorf("refused after %s", elapsed)
+    }
+    if r := logs.find("Request header parse error"); r == nil || !strings.Contains(r["error"].(string), "unsupported VLESS version 22") {
+        t.Errorf("parse error log: %v", r)
+    }
+    if r := logs.find("Malformed request header"); r == nil || r["prefix"] != "1603010200" {
+        t.Errorf("header prefix log: %v", r)
+    }
+
+    // and the start of a VLESS header is waited on until HANDSHAKE_TIMEOUT.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", 80, nil)[:5])
+    expectClose(t, ws, closeMalformedHeader)
+    if logs.find("Request header incomplete within HANDSHAKE_TIMEOUT, closing") == nil {
+        t.Error("incomplete header not logged")
+    }
+}
+
+func TestEarlyData(t *testing.T) {
+    received := make(chan string, 2)
+    port := tcpServer(t, func(conn net.Conn) {
+        buf := make([]byte, 64)
+        n, _ := conn.Read(buf)
+        received <- string(buf[:n])
+    })
+    srv := newTestServer(t)
+    base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+
+    request := testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("early"))
+    ed := base64.RawURLEncoding.EncodeToString(request)
+    for name, dial := range map[string]func() (*websocket.Conn, *http.Response, error){
+        "query":    func() (*websocket.Conn, *http.Response, error) { return websocket.DefaultDialer.Dial(base+"?ed="+ed, nil) },
+        "protocol": func() (*websocket.Conn, *http.Response, error) { return (&websocket.Dialer{Subprotocols: []string{ed}}).Dial(base, nil) },
+    } {
+        ws, _, err := dial()
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        defer ws.Close()
+        select {
+        case got := <-received:
+            if got != "early" {
+                t.Errorf("%s: target got %q", name, got)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("%s: early data never reached the target", name)
+        }
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        readResponse(t, ws)
+    }
+}
+
+func TestSplitHeader(t *testing.T) {
+    received := make(chan string, 1)
+    port := tcpServer(t, func(conn net.Conn) {
+        data, _ := io.ReadAll(conn)
+        received <- string(data)
+    })
+    srv := newTestServer(t)
+    header := testRequest(testUser, commandTCP, "127.0.0.1", port, nil)
+
+    for _, c := range []struct {
+        name     string
+        messages [][]byte
+        want     string
+    }{
+        // The header cut in two, with the payload after its second part.
+        {"header across frames", [][]byte{header[:10], append(header[10:len(header):len(header)], "payload"...)}, "payload"},
+        // The whole header first: the next message is payload, even though
+        // it too starts with a valid header.
+        {"payload in the next frame", [][]byte{header, append(header[:len(header):len(header)], "payload"...)}, string(header) + "payload"},
+    } {
+        ws := dialProxy(t, srv, "/")
+        for _, message := range c.messages {
+            ws.WriteMessage(websocket.BinaryMessage, message)
+        }
+        readResponse(t, ws)
+        ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+        select {
+        case got := <-received:
+            if got != c.want {
+                t.Errorf("%s: target got %q, want %q", c.name, got, c.want)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("%s: target got nothing", c.name)
+        }
+    }
+}
+
+func TestPumpsExitTogether(t *testing.T) {
+    srv := newTestServer(t)
+    // The target resets the connection once the session has started.
+    port := tcpServer(t, func(conn net.Conn) {
+        conn.Write([]byte("bye"))
+        conn.(*net.TCPConn).SetLinger(0)
+    })
+    before := runtime.NumGoroutine()
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    // The client sends nothing, so nothing but the cancellation can end
+    // the pump reading from it.
+    start := time.Now()
+    for _, _, err := ws.ReadMessage(); err == nil; _, _, err = ws.ReadMessage() {
+    }
+    for runtime.NumGoroutine() > before {
+        if time.Since(start) > 2*time.Second {
+            t.Fatalf("%d goroutines still running, %d before the session", runtime.NumGoroutine(), before)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestFinalReadForwarded(t *testing.T) {
+    // A reader that returns its last data together with io.EOF.
+    var out bytes.Buffer
+    err := pump(&out, iotest.DataErrReader(strings.NewReader("last bytes")), nil, func(int) {})
+    if !errors.Is(err, io.EOF) || out.String() != "last bytes" {
+        t.Errorf("got %q, %v", out.String(), err)
+    }
+
+    data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+    port := tcpServer(t, func(conn net.Conn) { conn.Write(data) })
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    var got []byte
+    for {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            break
+        }
+        got = append(got, message...)
+    }
+    if !bytes.Equal(got, data) {
+        t.Errorf("got %d of the %d bytes the target sent before closing", len(got), len(data))
+    }
+}
+
+func TestWriteTimeout(t *testing.T) {
+    setVar(t, &writeTimeout, 200*time.Millisecond)
+    logs := captureLogs(t)
+    closed := make(chan time.Time, 1)
+    port := tcpServer(t, func(conn net.Conn) {
+        chunk := make([]byte, 64<<10)
+        for {
+            if _, err := conn.Write(chunk); err != nil {
+                closed <- time.Now()
+                return
+            }
+        }
+    })
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+
+    // The client reads nothing more, so the proxy's writes to it stall
+    // once the socket buffers have filled.
+    select {
+    case <-closed:
+    case <-time.After(10 * time.Second):
+        t.Fatal("session with a client that stopped reading was never closed")
+    }
+    if r := logs.wait(t, "Session ended"); !strings.Contains(r["reason"].(string), errWriteTimeout.Error()) {
+        t.Errorf("session ended: %v", r["reason"])
+    }
+}
+
+// TestConcurrentWrites hammers one connection with data and pings at once.
+// Run it with -race: gorilla/websocket allows only one writer at a time.
+func TestConcurrentWrites(t *testing.T) {
+    conns := make(chan *clientConn, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        conns <- &clientConn{Conn: ws}
+    }))
+    t.Cleanup(srv.Close)
+    client := dialProxy(t, srv, "/")
+    pings := 0
+    client.SetPingHandler(func(string) error { pings++; return nil })
+    conn := <-conns
+    defer conn.Close()
+
+    const writers, messages = 4, 200
+    var wg sync.WaitGroup
+    for w := range writers {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            for i := range messages {
+                if err := writeData(conn, []byte(fmt.Sprintf("%d:%d", w, i))); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for range messages {
+                if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+    }
+
+    next := make([]int, writers)
+    for range writers * messages {
+        _, message, err := client.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var w, i int
+        if _, err := fmt.Sscanf(string(message), "%d:%d", &w, &i); err != nil || w >= writers || i != next[w] {
+            t.Fatalf("corrupt or out of order message %q", message)
+        }
+        next[w]++
+    }
+    wg.Wait()
+    if pings == 0 {
+        t.Error("no pings received")
+    }
+}
+
+func TestMaxSession(t *testing.T) {
+    setVar(t, &maxSession, 200*time.Millisecond)
+    srv := newTestServer(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    readResponse(t, ws)
+    start := time.Now()
+
+    // The session never goes idle: the client keeps echoing data.
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        ticker := time.NewTicker(20 * time.Millisecond)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                if ws.WriteMessage(websocket.BinaryMessage, []byte("ping")) != nil {
+                    return
+                }
+            }
+        }
+    }()
+    expectClose(t, ws, closeSessionLimit)
+    if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+        t.Errorf("session closed after %v, want about %v", elapsed, maxSession)
+    }
+
+    // A CONNECT tunnel has its connections closed instead.
+    connectSrv := httptest.NewServer(connectHandler(http.NotFoundHandler()))
+    t.Cleanup(connectSrv.Close)
+    _, br, resp := connectTo(t, connectSrv, fmt.Sprintf("127.0.0.1:%d", tcpEcho(t)), "")
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("CONNECT: got %d", resp.StatusCode)
+    }
+    start = time.Now()
+    if _, err := br.ReadByte(); err == nil || time.Since(start) > 2*time.Second {
+        t.Errorf("CONNECT tunnel still open after MAX_SESSION: %v", err)
+    }
+}
+
+func TestValidateMode(t *testing.T) {
+    out, err := runStartup(t, "TEST_MAIN=1", "VALIDATE=1", "WS_PATH=/tunnel")
+    if err != nil || !strings.Contains(out, "Configuration is valid") {
+        t.Fatalf("valid configuration: got %v: %s", err, out)
+    }
+    if summary := effectiveConfig(out); summary == nil || summary["ws_path"] != "/tunnel" {
+        t.Errorf("configuration summary: got %v", summary)
+    }
+
+    for name, env := range map[string][]string{
+        "bad setting":     {"BUFFER_SIZE=0"},
+        "missing TLS key": {"TLS_CERT=" + filepath.Join(t.TempDir(), "cert.pem"), "TLS_KEY=" + filepath.Join(t.TempDir(), "key.pem")},
+    } {
+        out, err := runStartup(t, append([]string{"TEST_MAIN=1", "VALIDATE=1"}, env...)...)
+        if err == nil || strings.Contains(out, "Configuration is valid") {
+            t.Errorf("%s: got %v: %s", name, err, out)
+        }
+    }
+}
+
+func TestSessionSummary(t *testing.T) {
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hello")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hello" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+    r := logs.wait(t, "Session ended")
+    if r["user"] != "test" || r["target"] != fmt.Sprintf("127.0.0.1:%d", port) || r["network"] != "tcp" ||
+        r["bytes_up"] != float64(5) || r["bytes_down"] != float64(5) || r["reason"] != "closed" || r["level"] != "INFO" {
+        t.Errorf("got %v", r)
+    }
+    if _, ok := r["conn_id"].(string); !ok {
+        t.Errorf("no conn_id in %v", r)
+    }
+    if d, err := time.ParseDuration(fmt.Sprint(r["duration"])); err != nil || d <= 0 || d > 5*time.Second {
+        t.Errorf("duration %v", r["duration"])
+    }
+}
+
+func TestCompression(t *testing.T) {
+    payload := bytes.Repeat([]byte("compressible "), 1000)
+    for _, enabled := range []bool{false, true} {
+        setVar(t, &upgrader.EnableCompression, enabled)
+        srv := newTestServer(t)
+        dialer := websocket.Dialer{EnableCompression: true}
+        ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer ws.Close()
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if got := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); got != enabled {
+            t.Errorf("WS_COMPRESS=%v: negotiated compression %v", enabled, got)
+        }
+
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), payload))
+        readResponse(t, ws)
+        var echo []byte
+        for len(echo) < len(payload) {
+            _, message, err := ws.ReadMessage()
+            if err != nil {
+                t.Fatal(err)
+            }
+            echo = append(echo, message...)
+        }
+        if !bytes.Equal(echo, payload) {
+            t.Errorf("WS_COMPRESS=%v: echo differs", enabled)
+        }
+    }
+}
+
+func TestPanicRecovery(t *testing.T) {
+    logs := captureLogs(t)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        handleWebSocket(w, r, func(wsConn *clientConn, message []byte, logger *slog.Logger) error {
+            if string(message) == "panic" {
+                var header []byte
+                _ = header[len(message)]
+            }
+            return handleProxyRequest(wsConn, message, logger)
+        })
+    }))
+    t.Cleanup(srv.Close)
+    port := tcpEcho(t)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, []byte("panic"))
+    if _, _, err := ws.ReadMessage(); err == nil {
+        t.Fatal("connection still open after a panic")
+    }
+    r := logs.wait(t, "Panic in session")
+    if _, ok := r["conn_id"].(string); !ok || !strings.Contains(fmt.Sprint(r["stack"]), "TestPanicRecovery") {
+        t.Errorf("got %v", r)
+    }
+
+    // The server still serves the next session.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("ping")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Errorf("got %q, %v", message, err)
+    }
+}
+
+func TestMalformedUpgrade(t *testing.T) {
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+    for name, header := range map[string]http.Header{
+        "old version": {"Sec-Websocket-Version": {"8"}, "Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}},
+        "missing key": {"Sec-Websocket-Version": {"13"}},
+    } {
+        req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+        req.Header = header
+        req.Header.Set("Connection", "Upgrade")
+        req.Header.Set("Upgrade", "websocket")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest || !strings.HasPrefix(string(body), "Bad Request: websocket: ") ||
+            resp.Header.Get("Sec-WebSocket-Version") != "13" {
+            t.Errorf("%s: got %d %q", name, resp.StatusCode, body)
+        }
+    }
+    if r := logs.find("WebSocket upgrade error"); r == nil || r["client_ip"] != "127.0.0.1" || r["status"] != float64(400) {
+        t.Errorf("logged %v", r)
+    }
+}
+
+func TestRootResponse(t *testing.T) {
+    get := func(url string) (int, string) {
+        t.Helper()
+        resp, err := http.Get(url)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(body)
+    }
+
+    port := closedPort(t)
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    p := startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ROOT_RESPONSE=hello")
+    if status, body := get("http://" + addr + "/"); status != http.StatusOK || body != "hello" {
+        t.Errorf("ROOT_RESPONSE=hello: got %d %q", status, body)
+    }
+    p.stop()
+
+    // A 404 looks like a server with nothing on it, and upgrades still work.
+    startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ROOT_STATUS=404", "ALLOW_PRIVATE=1")
+    if status, body := get("http://" + addr + "/"); status != http.StatusNotFound || body != "404 page not found\n" {
+        t.Errorf("ROOT_STATUS=404: got %d %q", status, body)
+    }
+    ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    readResponse(t, ws)
+}
+
+func TestIPv6Target(t *testing.T) {
+    ln, err := net.Listen("tcp", "[::1]:0")
+    if err != nil {
+        t.Skipf("no IPv6 loopback: %v", err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    port := uint16(ln.Addr().(*net.TCPAddr).Port)
+    logs := captureLogs(t)
+    srv := newTestServer(t)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "::1", port, []byte("ping")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    ws.Close()
+    if r := logs.wait(t, "Session ended"); r["target"] != fmt.Sprintf("[::1]:%d", port) {
+        t.Errorf("target %v", r["target"])
+    }
+}
+
+func TestIPAsDomainName(t *testing.T) {
+    setVar(t, &allowPrivate, false)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    for _, host := range []string{"127.0.0.1", "[::1]", "::ffff:127.0.0.1"} {
+        m := append([]byte{vlessVersion}, testUser[:]...)
+        m = binary.BigEndian.AppendUint16(append(m, 0, commandTCP), port)
+        m = append(append(m, 2, byte(len(host))), host...)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, m)
+        expectClose(t, ws, closeBlockedHost)
+    }
+
+    // DENY_HOSTS matches the address however the client spelt it.
+    setVar(t, &allowPrivate, true)
+    setVar(t, &denyHosts, parseHostPatterns("127.0.0.1"))
+    for _, host := range []string{"127.0.0.1", "::ffff:127.0.0.1"} {
+        if hostAllowed(normalizeHost(host)) {
+            t.Errorf("%s allowed", host)
+        }
+    }
+}
+
+func TestMaxPumps(t *testing.T) {
+    setVar(t, &maxPumps, 1)
+    srv := newTestHandlerServer(t)
+    port := tcpEcho(t)
+    activePumps := func() float64 {
+        t.Helper()
+        resp, err := http.Get(srv.URL + "/health")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        var health map[string]any
+        json.NewDecoder(resp.Body).Decode(&health)
+        return health["active_pumps"].(float64)
+    }
+    open := func() (*websocket.Conn, error) {
+        ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+        if err != nil {
+            if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+                t.Fatalf("refused with %v, %v", resp, err)
+            }
+            return nil, err
+        }
+        t.Cleanup(func() { ws.Close() })
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+        readResponse(t, ws)
+        return ws, nil
+    }
+
+    first, err := open()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n := activePumps(); n != 1 {
+        t.Errorf("active_pumps %v, want 1", n)
+    }
+    if _, err := open(); err == nil {
+        t.Fatal("second session started past MAX_PUMPS")
+    }
+
+    first.Close()
+    for deadline := time.Now().Add(5 * time.Second); activePumps() != 0; time.Sleep(10 * time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatal("pumps of the closed session still counted")
+        }
+    }
+    if _, err := open(); err != nil {
+        t.Errorf("session refused after the first closed: %v", err)
+    }
+}
+
+func TestSubprotocols(t *testing.T) {
+    srv := newTestServer(t)
+    dialer := websocket.Dialer{Subprotocols: []string{"chat", "binary"}}
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+
+    for _, tt := range []struct {
+        configured []string
+        want       string
+    }{
+        {nil, ""},
+        {[]string{"binary"}, "binary"},
+        {[]string{"vless"}, ""},
+    } {
+        setVar(t, &wsSubprotocols, tt.configured)
+        ws, _, err := dialer.Dial(url, nil)
+        if err != nil {
+            t.Fatalf("WS_SUBPROTOCOLS=%v: %v", tt.configured, err)
+        }
+        ws.Close()
+        if got := ws.Subprotocol(); got != tt.want {
+            t.Errorf("WS_SUBPROTOCOLS=%v: negotiated %q, want %q", tt.configured, got, tt.want)
+        }
+    }
+}
+
+func TestVersion(t *testing.T) {
+    setVar(t, &version, "1.2.3")
+    setVar(t, &commit, "abc1234")
+    setVar(t, &buildDate, "2024-01-02T03:04:05Z")
+    srv := newTestHandlerServer(t)
+
+    resp, err := http.Get(srv.URL + "/version")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var info map[string]string
+    if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{"version": "1.2.3", "commit": "abc1234", "build_date": "2024-01-02T03:04:05Z", "go_version": runtime.Version()}
+    if resp.Header.Get("Content-Type") != "application/json" || !maps.Equal(info, want) {
+        t.Errorf("got %v", info)
+    }
+
+    out, _ := runStartup(t)
+    if !strings.Contains(out, `"msg":"Build","version":"dev","commit":"unknown"`) {
+        t.Errorf("build not logged at startup: %s", out)
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    base := int(overloadRetryAfter / time.Second)
+    inRange := func(s string) bool {
+        n, err := strconv.Atoi(s)
+        return err == nil && n >= base && n <= 2*base
+    }
+
+    // MAX_CONNS=1 with its one slot taken.
+    setVar(t, &connSlots, make(chan struct{}, 1))
+    connSlots <- struct{}{}
+    srv := newTestServer(t)
+    _, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+    if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable || !inRange(resp.Header.Get("Retry-After")) {
+        t.Fatalf("rejected upgrade: got %v, %v", resp, err)
+    }
+    <-connSlots
+
+    // MAX_PUMPS reached between the upgrade and the request.
+    setVar(t, &maxPumps, 1)
+    ws := dialProxy(t, srv, "/")
+    activePumps.Add(1)
+    defer activePumps.Add(-1)
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), nil))
+    _, _, err = ws.ReadMessage()
+    var ce *websocket.CloseError
+    if !errors.As(err, &ce) || ce.Code != closeOverloaded {
+        t.Fatalf("got %v, want close code %d", err, closeOverloaded)
+    }
+    if after, ok := strings.CutPrefix(ce.Text, "server overloaded, retry after "); !ok || !inRange(strings.TrimSuffix(after, "s")) {
+        t.Errorf("close reason %q", ce.Text)
+    }
+}
+
+func TestEnvSecret(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "secret")
+    if err := os.WriteFile(path, []byte("  from file\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    setVar(t, &fileConfig, map[string]string{"TROJAN_PASSWORD": "from config"})
+
+    if got := envSecret("TROJAN_PASSWORD"); got != "from config" {
+        t.Errorf("CONFIG_FILE only: got %q", got)
+    }
+    t.Setenv("TROJAN_PASSWORD_FILE", path)
+    if got := envSecret("TROJAN_PASSWORD"); got != "from file" {
+        t.Errorf("file over CONFIG_FILE: got %q", got)
+    }
+    t.Setenv("TROJAN_PASSWORD", "from env")
+    if got := envSecret("TROJAN_PASSWORD"); got != "from env" {
+        t.Errorf("env over file: got %q", got)
+    }
+}
+
+func TestUUIDFile(t *testing.T) {
+    const uuid = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+    id, _ := parseUUID(uuid)
+    path := filepath.Join(t.TempDir(), "uuid")
+    if err := os.WriteFile(path, []byte(uuid+"\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    port := closedPort(t)
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1", "UUID_FILE="+path)
+    echo := tcpEcho(t)
+
+    for _, user := range [][16]byte{id, testUser} {
+        ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer ws.Close()
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(user, commandTCP, "127.0.0.1", echo, nil))
+        if user == id {
+            readResponse(t, ws)
+        } else if _, _, err := ws.ReadMessage(); err == nil {
+            t.Error("default UUID accepted with UUID_FILE set")
+        }
+    }
+
+    if out, err := runStartup(t, "UUID_FILE="+filepath.Join(t.TempDir(), "missing")); err == nil || !strings.Contains(out, "Failed to read UUID_FILE") {
+        t.Errorf("missing file: got %v: %s", err, out)
+    }
+}
+
+func TestProbeResist(t *testing.T) {
+    setVar(t, &probeStallMin, 300*time.Millisecond)
+    setVar(t, &probeStallMax, 400*time.Millisecond)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    var stranger [16]byte
+    closedAfter := func() (time.Duration, error) {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(stranger, commandTCP, "127.0.0.1", port, nil))
+        start := time.Now()
+        _, _, err := ws.ReadMessage()
+        return time.Since(start), err
+    }
+
+    if elapsed, err := closedAfter(); elapsed >= probeStallMin {
+        t.Errorf("without PROBE_RESIST: closed after %v, %v", elapsed, err)
+    }
+
+    // A valid session to a target that has not answered yet stays open;
+    // so must the connection of a client with an unknown UUID, and it
+    // ends without a close frame naming the reason. The first probe's
+    // session may still be reading PROBE_RESIST until it has ended.
+    endSessions()
+    setVar(t, &probeResist, true)
+    valid := dialProxy(t, srv, "/")
+    valid.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1",
+        tcpServer(t, func(conn net.Conn) { io.Copy(io.Discard, conn) }), nil))
+    readResponse(t, valid)
+    valid.SetReadDeadline(time.Now().Add(probeStallMin))
+    var ne net.Error
+    if _, _, err := valid.ReadMessage(); !errors.As(err, &ne) || !ne.Timeout() {
+        t.Fatalf("valid session: got %v", err)
+    }
+
+    elapsed, err := closedAfter()
+    if elapsed < probeStallMin || elapsed > 2*time.Second {
+        t.Errorf("probe closed after %v, want %v to %v", elapsed, probeStallMin, probeStallMax)
+    }
+    if !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+        t.Errorf("probe got %v, want the connection dropped without a close frame", err)
+    }
+}
+
+func TestUpgradeAuth(t *testing.T) {
+    srv := newTestServer(t)
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+    basic := func(creds string) string { return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds)) }
+
+    for _, tt := range []struct {
+        upgradeAuth, authorization string
+        ok                         bool
+        challenge                  string
+    }{
+        {"", "", true, ""},
+        {"token", "Bearer token", true, ""},
+        {"token", "", false, "Bearer"},
+        {"token", "Bearer wrong", false, "Bearer"},
+        {"user:pass", basic("user:pass"), true, ""},
+        {"user:pass", "", false, `Basic realm="proxy"`},
+        {"user:pass", basic("user:wrong"), false, `Basic realm="proxy"`},
+    } {
+        setVar(t, &upgradeAuth, tt.upgradeAuth)
+        header := http.Header{}
+        if tt.authorization != "" {
+            header.Set("Authorization", tt.authorization)
+        }
+        ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+        if tt.ok {
+            if err != nil {
+                t.Errorf("UPGRADE_AUTH=%q, %q: %v", tt.upgradeAuth, tt.authorization, err)
+            } else {
+                ws.Close()
+            }
+            continue
+        }
+        if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != tt.challenge {
+            t.Errorf("UPGRADE_AUTH=%q, %q: got %v, %v", tt.upgradeAuth, tt.authorization, resp, err)
+        }
+    }
+}
+
+func TestCleanCloseNotLoggedAsError(t *testing.T) {
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    session := func(end func(ws *websocket.Conn)) (*logRecords, map[string]any) {
+        logs := captureLogs(t)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+        readResponse(t, ws)
+        end(ws)
+        return logs, logs.wait(t, "Session ended")
+    }
+
+    for _, code := range []int{websocket.CloseNormalClosure, websocket.CloseGoingAway} {
+        logs, ended := session(func(ws *websocket.Conn) {
+            ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+        })
+        if ended["level"] != "INFO" || ended["reason"] != "closed" {
+            t.Errorf("close %d: got %v", code, ended)
+        }
+        for _, r := range logs.records() {
+            if r["level"] == "WARN" || r["level"] == "ERROR" {
+                t.Errorf("close %d: logged %v", code, r)
+            }
+        }
+    }
+
+    // A client that drops the connection without closing is a failure.
+    _, ended := session(func(ws *websocket.Conn) { ws.UnderlyingConn().Close() })
+    if ended["level"] != "WARN" || ended["reason"] == "closed" {
+        t.Errorf("dropped connection: got %v", ended)
+    }
+}
+
+func TestReadiness(t *testing.T) {
+    srv := newTestHandlerServer(t)
+    savedReady := ready.Load()
+    t.Cleanup(func() {
+        ready.Store(savedReady)
+        draining.Store(false)
+        quiesced.Store(false)
+    })
+    status := func(path string) int {
+        t.Helper()
+        resp, err := http.Get(srv.URL + path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+
+    for _, state := range []struct {
+        name  string
+        set   func()
+        ready int
+    }{
+        {"starting", func() { ready.Store(false) }, http.StatusServiceUnavailable},
+        {"serving", func() { ready.Store(true) }, http.StatusOK},
+        {"quiesced", func() { quiesced.Store(true) }, http.StatusServiceUnavailable},
+        {"resumed", func() { quiesced.Store(false) }, http.StatusOK},
+        {"draining", func() { draining.Store(true) }, http.StatusServiceUnavailable},
+    } {
+        state.set()
+        if got := status("/readyz"); got != state.ready {
+            t.Errorf("%s: /readyz got %d, want %d", state.name, got, state.ready)
+        }
+        if got := status("/livez"); got != http.StatusOK {
+            t.Errorf("%s: /livez got %d", state.name, got)
+        }
+    }
+}
+
+func TestShutdownSummary(t *testing.T) {
+    port := closedPort(t)
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    p := startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1")
+    echo := tcpEcho(t)
+    for range 2 {
+        ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", echo, []byte("ping")))
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+            t.Fatalf("got %q, %v", message, err)
+        }
+        ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+        ws.ReadMessage()
+        ws.Close()
+    }
+
+    out := p.stop()
+    summary := outputRecord(out, "Server stopped")
+    if summary == nil {
+        t.Fatalf("no summary logged: %s", out)
+    }
+    if summary["reason"] != "signal" || summary["signal"] != "terminated" || summary["sessions"] != float64(2) ||
+        summary["bytes_up"] != float64(8) || summary["bytes_down"] != float64(8) || summary["uptime"] == nil {
+        t.Errorf("summary: got %v", summary)
+    }
+}
+
+func TestCommandNetwork(t *testing.T) {
+    srv := newTestServer(t)
+    var dialed atomic.Value
+    d := *dialer
+    d.Control = func(network, _ string, _ syscall.RawConn) error {
+        dialed.Store(network)
+        return nil
+    }
+    setVar(t, &dialer, &d)
+    sessions := func(network string) float64 {
+        var m dto.Metric
+        sessionsTotal.WithLabelValues(network).Write(&m)
+        return m.GetCounter().GetValue()
+    }
+
+    for _, tc := range []struct {
+        command byte
+        port    uint16
+        payload []byte
+        network string
+    }{
+        {commandTCP, tcpEcho(t), []byte("ping"), "tcp"},
+        {commandUDP, udpEcho(t), udpPacket("ping"), "udp"},
+    } {
+        before := sessions(tc.network)
+        logs := captureLogs(t)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, tc.command, "127.0.0.1", tc.port, tc.payload))
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || !bytes.Equal(message, tc.payload) {
+            t.Fatalf("command %d: got %q, %v", tc.command, message, err)
+        }
+        ws.Close()
+        logs.wait(t, "Session ended")
+
+        if got, _ := dialed.Load().(string); !strings.HasPrefix(got, tc.network) {
+            t.Errorf("command %d: dialed %q, want %s", tc.command, got, tc.network)
+        }
+        if details := logs.find("Connection details"); details["network"] != tc.network {
+            t.Errorf("command %d: logged network %v", tc.command, details["network"])
+        }
+        if got := sessions(tc.network); got != before+1 {
+            t.Errorf("command %d: %s sessions went from %v to %v", tc.command, tc.network, before, got)
+        }
+    }
+}
+
+func TestTextMessagesSkipped(t *testing.T) {
+    srv := newTestServer(t)
+
+    received := make(chan []byte, 1)
+    port := tcpServer(t, func(conn net.Conn) {
+        data, _ := io.ReadAll(conn)
+        received <- data
+    })
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("abc")))
+    readResponse(t, ws)
+    ws.WriteMessage(websocket.TextMessage, []byte("keepalive"))
+    ws.WriteMessage(websocket.BinaryMessage, []byte("def"))
+    ws.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second))
+    ws.WriteMessage(websocket.TextMessage, []byte("keepalive"))
+    ws.WriteMessage(websocket.BinaryMessage, []byte("ghi"))
+    ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+    select {
+    case data := <-received:
+        if string(data) != "abcdefghi" {
+            t.Errorf("TCP target got %q", data)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("TCP target did not see the end of the stream")
+    }
+
+    // A text message, even in the middle of a datagram, is not part of it.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandUDP, "127.0.0.1", udpEcho(t), nil))
+    readResponse(t, ws)
+    packet := udpPacket("datagram")
+    ws.WriteMessage(websocket.BinaryMessage, packet[:4])
+    ws.WriteMessage(websocket.TextMessage, []byte("keepalive"))
+    ws.WriteMessage(websocket.BinaryMessage, packet[4:])
+    if _, message, err := ws.ReadMessage(); err != nil || !bytes.Equal(message, packet) {
+        t.Errorf("UDP: got %q, %v", message, err)
+    }
+}
+
+func TestVLESSVersion(t *testing.T) {
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+
+    // Version 1 is refused as VLESS, even with Trojan served beside it.
+    for _, key := range [][]byte{nil, newTrojanKey("secret")} {
+        setVar(t, &trojanKey, key)
+        logs := captureLogs(t)
+        request := testRequest(testUser, commandTCP, "127.0.0.1", port, nil)
+        request[0] = 1
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, request)
+        expectClose(t, ws, closeMalformedHeader)
+        if r := logs.find("Request header parse error"); r == nil || !strings.Contains(r["error"].(string), "unsupported VLESS version 1") {
+            t.Errorf("trojan %v: parse error log: %v", key != nil, r)
+        }
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+    connectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "proxy_connections_total",
+        Help: "WebSocket connections accepted.",
+    })
+    bytesProxied = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "proxy_bytes_total",
+        Help: "Bytes proxied, by direction: up is client to target, down is target to client.",
+    }, []string{"direction"})
+    sessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "proxy_sessions_total",
+        Help: "Proxy sessions ended, by the network of their target.",
+    }, []string{"network"})
+    dialFailures = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "proxy_dial_failures_total",
+        Help: "Target connections that could not be established.",
+    })
+    authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "proxy_auth_failures_total",
+        Help: "Requests rejected because of an unknown UUID.",
+    })
+
+    bytesUp   = bytesProxied.WithLabelValues("up")
+    bytesDown = bytesProxied.WithLabelValues("down")
+)
+
+// registerMetrics registers the proxy metrics and serves them on /metrics
+// of mux.
+func registerMetrics(mux *http.ServeMux) {
+    prometheus.MustRegister(
+        connectionsTotal,
+        bytesProxied,
+        sessionsTotal,
+        dialFailures,
+        authFailures,
+        prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+            Name: "proxy_active_connections",
+            Help: "WebSocket connections currently open.",
+        }, func() float64 {
+            return float64(activeConnections.Load())
+        }),
+    )
+    mux.Handle("/metrics", promhttp.Handler())
+}
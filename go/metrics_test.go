@@ -0,0 +1,58 @@
+package main
+
+import (
+    "bufio"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+// scrapeMetric returns the value of the sample named metric on /metrics of
+// the server at url.
+func scrapeMetric(t *testing.T, url, metric string) float64 {
+    t.Helper()
+    resp, err := http.Get(url + "/metrics")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        if value, ok := strings.CutPrefix(scanner.Text(), metric+" "); ok {
+            v, err := strconv.ParseFloat(value, 64)
+            if err != nil {
+                t.Fatal(err)
+            }
+            return v
+        }
+    }
+    t.Fatalf("%s not found on /metrics", metric)
+    return 0
+}
+
+func TestMetrics(t *testing.T) {
+    t.Setenv("METRICS", "1")
+    srv := newTestHandlerServer(t)
+    up := scrapeMetric(t, srv.URL, `proxy_bytes_total{direction="up"}`)
+    down := scrapeMetric(t, srv.URL, `proxy_bytes_total{direction="down"}`)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("hello")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "hello" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+
+    if got := scrapeMetric(t, srv.URL, `proxy_bytes_total{direction="up"}`); got != up+5 {
+        t.Errorf("bytes up went from %v to %v, want +5", up, got)
+    }
+    if got := scrapeMetric(t, srv.URL, `proxy_bytes_total{direction="down"}`); got != down+5 {
+        t.Errorf("bytes down went from %v to %v, want +5", down, got)
+    }
+    if got := scrapeMetric(t, srv.URL, "proxy_active_connections"); got < 1 {
+        t.Errorf("proxy_active_connections %v with a session open", got)
+    }
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// A VLESS request with the mux command carries no target of its own. The
+// rest of the client's data is a sequence of Mux.Cool frames, each one
+// belonging to one of many substreams to targets of their own:
+//
+//   - 2 bytes, big-endian: the length of the metadata that follows.
+//   - The metadata: a 2-byte substream ID, a status byte and an option
+//     byte. A New frame goes on with the network (1 for TCP, 2 for UDP), a
+//     2-byte port, an address type (1 IPv4, 2 domain name, 3 IPv6) and the
+//     address; anything after that is ignored.
+//   - When the option has muxOptionData set: a 2-byte length and the data.
+//
+// The server answers with Keep frames carrying the targets' data and an End
+// frame once a target has finished. For UDP every frame carries one packet.
+const (
+    muxStatusNew       = 1
+    muxStatusKeep      = 2
+    muxStatusEnd       = 3
+    muxStatusKeepAlive = 4
+
+    muxOptionData  = 1
+    muxOptionError = 2
+
+    muxNetworkTCP = 1
+    muxNetworkUDP = 2
+)
+
+// maxMuxStreams bounds the substreams open at once on one connection.
+const maxMuxStreams = 128
+
+// muxStreamQueue is how many frames of data may wait for a substream that
+// is still dialing or writing to its target before the reading of frames,
+// and with it every substream of the connection, waits too.
+const muxStreamQueue = 16
+
+// maxMuxData is the most data one frame can carry.
+const maxMuxData = 65535
+
+// muxSession is one mux connection and the substreams open on it.
+type muxSession struct {
+    wsConn *clientConn
+    sess   *session
+    idle   idleDeadline
+    cancel context.CancelFunc
+
+    mu      sync.Mutex
+    closed  bool
+    streams map[uint16]*muxStream
+    running sync.WaitGroup
+}
+
+// muxStream is one substream. Only the frame reader sends on data, and
+// closes it when the client ends the substream; done is closed once the
+// substream has finished, after which it takes no more data. refused is set
+// when SNIFF turns the substream down after its target has been dialed.
+type muxStream struct {
+    id      uint16
+    network string
+    data    chan []byte
+    done    chan struct{}
+    ended   bool
+    conn    net.Conn
+    refused atomic.Bool
+}
+
+// handleMux serves a VLESS mux request, of which initial is the first of
+// the data after the header, until the client's connection ends.
+func handleMux(wsConn *clientConn, version byte, initial []byte, sess *session) (err error) {
+    defer func() { sess.end(err) }()
+    if err := checkQuota(); err != nil {
+        return err
+    }
+    sess.target, sess.network = "mux", "mux"
+    if err := writeResponse(wsConn, version); err != nil {
+        return err
+    }
+
+    ctx, cancel := cancelOnClose(wsConn)
+    defer cancel()
+    defer limitSession(wsConn, cancel, sess)()
+
+    m := &muxSession{
+        wsConn:  wsConn,
+        sess:    sess,
+        idle:    idleDeadline{wsConn},
+        cancel:  cancel,
+        streams: make(map[uint16]*muxStream),
+    }
+    m.idle.extend()
+    up := &idleReader{r: newSessionThrottle(io.MultiReader(bytes.NewReader(initial), &wsStream{conn: wsConn})), idle: m.idle}
+    err = m.demux(up)
+
+    m.closeAll()
+    m.running.Wait()
+    return pumpError(ctx, idleError(err))
+}
+
+// demux reads the client's frames and hands each to its substream until the
+// connection fails or a frame cannot be parsed.
+func (m *muxSession) demux(r io.Reader) error {
+    var head [2]byte
+    for {
+        if _, err := io.ReadFull(r, head[:]); err != nil {
+            return err
+        }
+        meta := make([]byte, binary.BigEndian.Uint16(head[:]))
+        if _, err := io.ReadFull(r, meta); err != nil {
+            return err
+        }
+        if len(meta) < 4 {
+            return fmt.Errorf("mux frame metadata of %d bytes is too short", len(meta))
+        }
+        id, status, option := binary.BigEndian.Uint16(meta), meta[2], meta[3]
+
+        var data []byte
+        if option&muxOptionData != 0 {
+            if _, err := io.ReadFull(r, head[:]); err != nil {
+                return err
+            }
+            data = make([]byte, binary.BigEndian.Uint16(head[:]))
+            if _, err := io.ReadFull(r, data); err != nil {
+                return err
+            }
+        }
+
+        switch status {
+        case muxStatusNew:
+            m.open(id, meta[4:], data)
+        case muxStatusKeep:
+            m.send(id, data)
+        case muxStatusEnd:
+            m.endStream(id)
+        case muxStatusKeepAlive:
+        default:
+            return fmt.Errorf("unknown mux frame status %d", status)
+        }
+    }
+}
+
+// open starts the substream id to the target in meta, with data as the
+// first of the data for it.
+func (m *muxSession) open(id uint16, meta, data []byte) {
+    network, host, port, err := parseMuxTarget(meta)
+    if err != nil {
+        m.sess.logger.Warn("Mux stream refused", "stream", id, "error", err)
+        m.writeFrame(id, muxStatusEnd, muxOptionError, nil)
+        return
+    }
+
+    m.mu.Lock()
+    if m.streams[id] != nil || len(m.streams) >= maxMuxStreams {
+        m.mu.Unlock()
+        m.sess.logger.Warn("Mux stream refused", "stream", id, "error", "stream already open or too many streams")
+        m.writeFrame(id, muxStatusEnd, muxOptionError, nil)
+        return
+    }
+    st := &muxStream{id: id, network: network, data: make(chan []byte, muxStreamQueue), done: make(chan struct{})}
+    m.streams[id] = st
+    m.running.Add(1)
+    m.mu.Unlock()
+
+    m.sess.logger.Debug("Mux stream opened", "stream", id, "network", network, hostAttr("host", host), "port", port)
+    go m.run(st, host, port)
+    m.send(id, data)
+}
+
+// parseMuxTarget parses the target of a New frame from the metadata after
+// its option byte.
+func parseMuxTarget(meta []byte) (network, host string, port uint16, err error) {
+    if len(meta) < 4 {
+        return "", "", 0, fmt.Errorf("%w for mux target", errShortHeader)
+    }
+    switch meta[0] {
+    case muxNetworkTCP:
+        network = "tcp"
+    case muxNetworkUDP:
+        network = "udp"
+    default:
+        return "", "", 0, fmt.Errorf("unknown mux network %d", meta[0])
+    }
+    port = binary.BigEndian.Uint16(meta[1:3])
+    if port == 0 {
+        return "", "", 0, fmt.Errorf("target port 0 is not valid")
+    }
+
+    atyp, addr := meta[3], meta[4:]
+    switch atyp {
+    case 1, 3:
+        n := net.IPv4len
+        if atyp == 3 {
+            n = net.IPv6len
+        }
+        if len(addr) < n {
+            return "", "", 0, fmt.Errorf("%w for mux address", errShortHeader)
+        }
+        host = net.IP(addr[:n]).String()
+    case 2:
+        if len(addr) < 1 || len(addr) < 1+int(addr[0]) || addr[0] == 0 {
+            return "", "", 0, fmt.Errorf("%w for mux domain name", errShortHeader)
+        }
+        host = normalizeHost(string(addr[1 : 1+int(addr[0])]))
+    default:
+        return "", "", 0, fmt.Errorf("unknown mux address type %d", atyp)
+    }
+    return network, host, port, nil
+}
+
+// send queues data for the substream id. Data for a substream that has
+// already finished, or that was never opened, is dropped.
+func (m *muxSession) send(id uint16, data []byte) {
+    if len(data) == 0 {
+        return
+    }
+    m.mu.Lock()
+    st := m.streams[id]
+    m.mu.Unlock()
+    if st == nil || st.ended {
+        return
+    }
+    select {
+    case st.data <- data:
+    case <-st.done:
+    }
+}
+
+// endStream passes the client's end of the substream id on to it.
+func (m *muxSession) endStream(id uint16) {
+    m.mu.Lock()
+    st := m.streams[id]
+    m.mu.Unlock()
+    if st != nil && !st.ended {
+        st.ended = true
+        close(st.data)
+    }
+}
+
+// closeAll ends every substream once the connection is gone. It is only
+// called after demux has returned, so nothing sends on data any more.
+func (m *muxSession) closeAll() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.closed = true
+    for _, st := range m.streams {
+        if !st.ended {
+            st.ended = true
+            close(st.data)
+        }
+        if st.conn != nil {
+            st.conn.Close()
+        }
+    }
+}
+
+// run dials the target of st and pumps data both ways until both the client
+// and the target have finished with it, or the target has finished and
+// ended the substream with its End frame. It holds one of the MAX_PUMPS
+// pump pairs all the while.
+func (m *muxSession) run(st *muxStream, host string, port uint16) {
+    defer m.running.Done()
+    defer recoverPanic(m.sess.logger, nil)
+    defer m.remove(st)
+    logger := m.sess.logger.With("stream", st.id)
+
+    release, ok := acquirePumps()
+    if !ok {
+        logger.Warn("Mux stream failed", "error", "MAX_PUMPS reached")
+        m.writeFrame(st.id, muxStatusEnd, muxOptionError, nil)
+        return
+    }
+    defer release()
+
+    conn, err := m.dial(st, host, port)
+    if err != nil {
+        logger.Warn("Mux stream failed", hostAttr("host", host), "port", port, "error", err)
+        m.writeFrame(st.id, muxStatusEnd, muxOptionError, nil)
+        return
+    }
+    defer conn.Close()
+    // Every substream times out on its own once nothing has flowed on it for
+    // IDLE_TIMEOUT, leaving the others running.
+    idle := idleDeadline{conn}
+    idle.extend()
+
+    var downErr error
+    downDone := make(chan struct{})
+    go func() {
+        defer close(downDone)
+        defer recoverPanic(logger, nil)
+        downErr = m.pumpDown(st, conn, idle)
+    }()
+
+    // Under SNIFF, the start of a TCP substream is held back until it has
+    // been sniffed, as that of any TCP session is.
+    data, open := []byte(nil), true
+    if sniff && st.network == "tcp" {
+        data, open = m.sniffStream(st, downDone)
+        if _, err := checkSniffed(data, logger); err != nil {
+            logger.Warn("Mux stream refused", "error", err)
+            st.refused.Store(true)
+            conn.Close()
+            <-downDone
+            return
+        }
+    }
+
+    for {
+        if len(data) > 0 {
+            if _, err := conn.Write(data); err != nil {
+                logger.Debug("Mux stream write error", "error", err)
+                conn.Close()
+                <-downDone
+                return
+            }
+            idle.extend()
+            m.sess.countUp(len(data))
+        }
+        if !open {
+            // The client is done with the substream: let a TCP target
+            // finish its response, and stop waiting for more UDP packets.
+            if cw, ok := conn.(interface{ CloseWrite() error }); !ok || st.network != "tcp" || cw.CloseWrite() != nil {
+                conn.Close()
+            }
+            <-downDone
+            logger.Debug("Mux stream closed", "error", idleError(downErr))
+            return
+        }
+        select {
+        case data, open = <-st.data:
+        case <-downDone:
+            logger.Debug("Mux stream closed", "error", idleError(downErr))
+            return
+        }
+    }
+}
+
+// sniffStream gathers the start of the TCP substream st for SNIFF, within
+// the limits of any session or until stop is closed. It also reports
+// whether the client has yet to end the substream.
+func (m *muxSession) sniffStream(st *muxStream, stop <-chan struct{}) ([]byte, bool) {
+    var data []byte
+    timeout := time.NewTimer(sniffWait)
+    defer timeout.Stop()
+    for !sniffComplete(data) && len(data) < maxSniffData {
+        select {
+        case more, ok := <-st.data:
+            if !ok {
+                return data, false
+            }
+            data = append(data, more...)
+        case <-timeout.C:
+            return data, true
+        case <-stop:
+            return data, true
+        }
+    }
+    return data, true
+}
+
+// dial connects st to its target, within the same limits as any session.
+func (m *muxSession) dial(st *muxStream, host string, port uint16) (net.Conn, error) {
+    if err := checkQuota(); err != nil {
+        return nil, err
+    }
+    target, err := checkTarget(host, port, m.sess.logger)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := dialTarget(st.network, target.ips, target.port)
+    if err != nil {
+        dialFailures.Inc()
+        return nil, fmt.Errorf("failed to connect to target: %w", err)
+    }
+    if st.network == "tcp" {
+        if err := writeProxyHeader(conn, m.wsConn.client, m.wsConn.local); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("failed to send PROXY header to target: %w", err)
+        }
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.closed {
+        conn.Close()
+        return nil, errors.New("connection closed")
+    }
+    st.conn = conn
+    return conn, nil
+}
+
+// pumpDown sends the target's data to the client in Keep frames, and an End
+// frame once the target has finished, returning why it did.
+func (m *muxSession) pumpDown(st *muxStream, conn net.Conn, idle idleDeadline) error {
+    buffer := make([]byte, 8+min(bufferSize, maxMuxData))
+    // A UDP packet is held back whole rather than cut to the limiter's
+    // burst.
+    r, packets := newSessionThrottle(conn), (*packetThrottle)(nil)
+    if st.network == "udp" {
+        buffer = make([]byte, 8+maxMuxData)
+        r, packets = conn, newPacketThrottle()
+    }
+    for {
+        n, err := r.Read(buffer[8:])
+        if n > 0 {
+            m.idle.extend()
+            idle.extend()
+            packets.wait(n)
+            if err := m.writeFrame(st.id, muxStatusKeep, muxOptionData, buffer[8:8+n]); err != nil {
+                return err
+            }
+            m.sess.countDown(n)
+        }
+        if err != nil {
+            var option byte
+            if st.refused.Load() || !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+                option = muxOptionError
+            }
+            m.writeFrame(st.id, muxStatusEnd, option, nil)
+            return err
+        }
+    }
+}
+
+// writeFrame sends one frame to the client as one message. A failed write
+// means the connection is gone and ends the whole session.
+func (m *muxSession) writeFrame(id uint16, status, option byte, data []byte) error {
+    frame := make([]byte, 0, 8+len(data))
+    frame = binary.BigEndian.AppendUint16(frame, 4)
+    frame = binary.BigEndian.AppendUint16(frame, id)
+    frame = append(frame, status, option)
+    if option&muxOptionData != 0 {
+        frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+        frame = append(frame, data...)
+    }
+    err := writeData(m.wsConn, frame)
+    if err != nil {
+        m.cancel()
+    }
+    return err
+}
+
+// remove forgets st once it has finished.
+func (m *muxSession) remove(st *muxStream) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.streams[st.id] == st {
+        delete(m.streams, st.id)
+    }
+    close(st.done)
+}
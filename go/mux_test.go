@@ -0,0 +1,204 @@
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// taggedEcho starts a TCP target that echoes every read prefixed with tag,
+// so that the replies show which target sent them.
+func taggedEcho(t testing.TB, tag string) uint16 {
+    return tcpServer(t, func(conn net.Conn) {
+        b := make([]byte, 1024)
+        for {
+            n, err := conn.Read(b)
+            if n > 0 {
+                conn.Write(append([]byte(tag), b[:n]...))
+            }
+            if err != nil {
+                return
+            }
+        }
+    })
+}
+
+// muxFrame builds a Mux.Cool frame. target is only given for New frames.
+func muxFrame(id uint16, status, option byte, target, data []byte) []byte {
+    meta := binary.BigEndian.AppendUint16(nil, id)
+    meta = append(append(meta, status, option), target...)
+    frame := append(binary.BigEndian.AppendUint16(nil, uint16(len(meta))), meta...)
+    if option&muxOptionData != 0 {
+        frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+        frame = append(frame, data...)
+    }
+    return frame
+}
+
+// muxTarget is the target of a New frame for a TCP substream to
+// 127.0.0.1:port.
+func muxTarget(port uint16) []byte {
+    return append(binary.BigEndian.AppendUint16([]byte{muxNetworkTCP}, port), 1, 127, 0, 0, 1)
+}
+
+// muxReply is a frame sent by the server.
+type muxReply struct {
+    id             uint16
+    status, option byte
+    data           string
+}
+
+// readMuxFrame reads the next frame from ws. The server sends every frame
+// as a message of its own.
+func readMuxFrame(t testing.TB, ws *websocket.Conn) muxReply {
+    t.Helper()
+    _, message, err := ws.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(message) < 6 || binary.BigEndian.Uint16(message) != 4 {
+        t.Fatalf("malformed frame %x", message)
+    }
+    reply := muxReply{id: binary.BigEndian.Uint16(message[2:]), status: message[4], option: message[5]}
+    if reply.option&muxOptionData != 0 {
+        reply.data = string(message[8:])
+    }
+    return reply
+}
+
+// muxSessionConn opens a mux session on srv, with frames sent along with
+// the request.
+func muxSessionConn(t testing.TB, srv *httptest.Server, frames ...[]byte) *websocket.Conn {
+    t.Helper()
+    ws := dialProxy(t, srv, "/")
+    request := testRequest(testUser, commandMux, "", 0, nil)
+    for _, frame := range frames {
+        request = append(request, frame...)
+    }
+    ws.WriteMessage(websocket.BinaryMessage, request)
+    readResponse(t, ws)
+    return ws
+}
+
+func TestMux(t *testing.T) {
+    srv := newTestServer(t)
+    a, b := taggedEcho(t, "A:"), taggedEcho(t, "B:")
+    ws := muxSessionConn(t, srv, muxFrame(1, muxStatusNew, muxOptionData, muxTarget(a), []byte("one")))
+    // The second substream's New frame arrives split over two messages.
+    frame := muxFrame(2, muxStatusNew, muxOptionData, muxTarget(b), []byte("two"))
+    ws.WriteMessage(websocket.BinaryMessage, frame[:5])
+    ws.WriteMessage(websocket.BinaryMessage, frame[5:])
+
+    got := map[uint16]string{}
+    for len(got[1]) < len("A:one") || len(got[2]) < len("B:two") {
+        reply := readMuxFrame(t, ws)
+        if reply.status != muxStatusKeep {
+            t.Fatalf("got %+v", reply)
+        }
+        got[reply.id] += reply.data
+    }
+    if got[1] != "A:one" || got[2] != "B:two" {
+        t.Fatalf("got %v", got)
+    }
+
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(1, muxStatusKeep, muxOptionData, nil, []byte("again")))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{1, muxStatusKeep, muxOptionData, "A:again"}) {
+        t.Errorf("Keep on stream 1: got %+v", reply)
+    }
+
+    // The client ending a substream ends it once its target has finished.
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusEnd, 0, nil, nil))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{id: 2, status: muxStatusEnd}) {
+        t.Errorf("End of stream 2: got %+v", reply)
+    }
+
+    // A target that refuses the connection ends its substream with an
+    // error, and the others go on.
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(3, muxStatusNew, 0, muxTarget(closedPort(t)), nil))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{id: 3, status: muxStatusEnd, option: muxOptionError}) {
+        t.Errorf("refused stream: got %+v", reply)
+    }
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(1, muxStatusKeep, muxOptionData, nil, []byte("still")))
+    if reply := readMuxFrame(t, ws); reply.id != 1 || reply.data != "A:still" {
+        t.Errorf("stream 1 after the refusal: got %+v", reply)
+    }
+
+    // A frame that cannot be parsed ends the whole connection.
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(1, 9, 0, nil, nil))
+    for {
+        if _, _, err := ws.ReadMessage(); err != nil {
+            break
+        }
+    }
+}
+
+func TestMuxIdle(t *testing.T) {
+    setVar(t, &idleTimeout, 200*time.Millisecond)
+    srv := newTestServer(t)
+    port := taggedEcho(t, "")
+    ws := muxSessionConn(t, srv,
+        muxFrame(1, muxStatusNew, 0, muxTarget(port), nil),
+        muxFrame(2, muxStatusNew, muxOptionData, muxTarget(port), []byte("0")))
+
+    // Stream 2 stays busy while stream 1 sees nothing for IDLE_TIMEOUT.
+    start := time.Now()
+    for {
+        reply := readMuxFrame(t, ws)
+        if reply.id == 1 {
+            if reply.status != muxStatusEnd {
+                t.Fatalf("stream 1: got %+v", reply)
+            }
+            if elapsed := time.Since(start); elapsed < idleTimeout {
+                t.Errorf("idle stream ended after %v", elapsed)
+            }
+            break
+        }
+        if reply.status != muxStatusKeep {
+            t.Fatalf("busy stream ended: %+v", reply)
+        }
+        time.Sleep(20 * time.Millisecond)
+        ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusKeep, muxOptionData, nil, []byte("x")))
+    }
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusKeep, muxOptionData, nil, []byte("after")))
+    for echoed := ""; !strings.HasSuffix(echoed, "after"); {
+        reply := readMuxFrame(t, ws)
+        if reply.id != 2 || reply.status != muxStatusKeep {
+            t.Fatalf("busy stream after the idle one ended: %+v", reply)
+        }
+        echoed += reply.data
+    }
+}
+
+func TestMuxPumps(t *testing.T) {
+    setVar(t, &maxPumps, int64(1))
+    srv := newTestServer(t)
+    port := taggedEcho(t, "")
+    ws := muxSessionConn(t, srv, muxFrame(1, muxStatusNew, muxOptionData, muxTarget(port), []byte("one")))
+    if reply := readMuxFrame(t, ws); reply.id != 1 || reply.data != "one" {
+        t.Fatalf("stream 1: got %+v", reply)
+    }
+
+    // The first substream holds the only pump pair for as long as it runs.
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusNew, muxOptionData, muxTarget(port), []byte("two")))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{id: 2, status: muxStatusEnd, option: muxOptionError}) {
+        t.Errorf("stream 2 with the pumps taken: got %+v", reply)
+    }
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(1, muxStatusEnd, 0, nil, nil))
+    if reply := readMuxFrame(t, ws); reply != (muxReply{id: 1, status: muxStatusEnd}) {
+        t.Errorf("End of stream 1: got %+v", reply)
+    }
+    for deadline := time.Now().Add(5 * time.Second); activePumps.Load() != 0; time.Sleep(10 * time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatal("pump pair not released after the stream ended")
+        }
+    }
+    ws.WriteMessage(websocket.BinaryMessage, muxFrame(3, muxStatusNew, muxOptionData, muxTarget(port), []byte("three")))
+    if reply := readMuxFrame(t, ws); reply.id != 3 || reply.data != "three" {
+        t.Errorf("stream 3 once released: got %+v", reply)
+    }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+
+    "golang.org/x/crypto/chacha20poly1305"
+)
+
+// With OBFS_KEY set, the payload of every binary message in both directions
+// is sealed with ChaCha20-Poly1305, so that the proxy protocol inside is not
+// visible to anything that can read the WebSocket frames:
+//
+//   - The client starts its first message with a random 16-byte salt. The
+//     key of the connection is HMAC-SHA256(SHA-256(OBFS_KEY), salt).
+//   - Each message is then the sealed payload: the ciphertext followed by
+//     the 16-byte tag.
+//   - The 12-byte nonce is never sent. Its first byte is 0 for messages
+//     from the client and 1 for those from the server, and its last 8 bytes
+//     are the big-endian count of earlier messages in that direction.
+//
+// Control frames and text messages are left as they are.
+const obfsSaltLen = 16
+
+// obfsKey is SHA-256(OBFS_KEY), or nil when obfuscation is disabled.
+var obfsKey []byte
+
+var errObfsAuth = errors.New("obfuscated message failed authentication")
+
+// obfsCodec seals and opens the messages of one connection. The key is only
+// known once the client's first message has brought the salt.
+type obfsCodec struct {
+    aead     cipher.AEAD
+    readSeq  uint64
+    writeSeq uint64
+}
+
+func newObfsKey(secret string) []byte {
+    sum := sha256.Sum256([]byte(secret))
+    return sum[:]
+}
+
+// open returns the payload of a message from the client. Messages are
+// opened by one reader at a time.
+func (c *obfsCodec) open(message []byte) ([]byte, error) {
+    if c.aead == nil {
+        if len(message) < obfsSaltLen {
+            return nil, errObfsAuth
+        }
+        mac := hmac.New(sha256.New, obfsKey)
+        mac.Write(message[:obfsSaltLen])
+        aead, err := chacha20poly1305.New(mac.Sum(nil))
+        if err != nil {
+            return nil, err
+        }
+        c.aead = aead
+        message = message[obfsSaltLen:]
+    }
+
+    payload, err := c.aead.Open(message[:0], obfsNonce(0, c.readSeq), message, nil)
+    if err != nil {
+        return nil, errObfsAuth
+    }
+    c.readSeq++
+    return payload, nil
+}
+
+// seal returns the message carrying payload to the client. The caller holds
+// the connection's write lock, so messages are sealed in the order they are
+// sent.
+func (c *obfsCodec) seal(payload []byte) ([]byte, error) {
+    if c.aead == nil {
+        return nil, fmt.Errorf("obfuscation key not established")
+    }
+    message := c.aead.Seal(make([]byte, 0, len(payload)+c.aead.Overhead()), obfsNonce(1, c.writeSeq), payload, nil)
+    c.writeSeq++
+    return message, nil
+}
+
+func obfsNonce(direction byte, seq uint64) []byte {
+    nonce := make([]byte, chacha20poly1305.NonceSize)
+    nonce[0] = direction
+    binary.BigEndian.PutUint64(nonce[4:], seq)
+    return nonce
+}
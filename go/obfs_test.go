@@ -0,0 +1,93 @@
+package main
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/sha256"
+    "testing"
+
+    "github.com/gorilla/websocket"
+    "golang.org/x/crypto/chacha20poly1305"
+)
+
+// obfsClient is the client side of OBFS_KEY obfuscation.
+type obfsClient struct {
+    salt              []byte
+    aead              cipher.AEAD
+    readSeq, writeSeq uint64
+}
+
+func newObfsClient(t testing.TB, secret string) *obfsClient {
+    salt := bytes.Repeat([]byte{7}, obfsSaltLen)
+    mac := hmac.New(sha256.New, newObfsKey(secret))
+    mac.Write(salt)
+    aead, err := chacha20poly1305.New(mac.Sum(nil))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &obfsClient{salt: salt, aead: aead}
+}
+
+// seal returns the message carrying payload, starting with the salt when
+// it is the first.
+func (c *obfsClient) seal(payload []byte) []byte {
+    var message []byte
+    if c.writeSeq == 0 {
+        message = append(message, c.salt...)
+    }
+    message = c.aead.Seal(message, obfsNonce(0, c.writeSeq), payload, nil)
+    c.writeSeq++
+    return message
+}
+
+func (c *obfsClient) open(t testing.TB, message []byte) []byte {
+    t.Helper()
+    payload, err := c.aead.Open(nil, obfsNonce(1, c.readSeq), message, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.readSeq++
+    return payload
+}
+
+func TestObfs(t *testing.T) {
+    setVar(t, &obfsKey, newObfsKey("secret"))
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    client := newObfsClient(t, "secret")
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, client.seal(testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hello"))))
+    _, message, err := ws.ReadMessage()
+    if err != nil || !bytes.Equal(client.open(t, message), []byte{vlessVersion, 0}) {
+        t.Fatalf("response header: %v", err)
+    }
+    for _, payload := range []string{"hello", "again"} {
+        if payload != "hello" {
+            ws.WriteMessage(websocket.BinaryMessage, client.seal([]byte(payload)))
+        }
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if bytes.Contains(message, []byte(payload)) {
+            t.Errorf("%q sent in the clear", payload)
+        }
+        if got := client.open(t, message); string(got) != payload {
+            t.Errorf("got %q, want %q", got, payload)
+        }
+    }
+
+    // Neither a plain client nor one with another key gets a session.
+    for name, request := range map[string][]byte{
+        "plain":     testRequest(testUser, commandTCP, "127.0.0.1", port, nil),
+        "wrong key": newObfsClient(t, "other").seal(testRequest(testUser, commandTCP, "127.0.0.1", port, nil)),
+    } {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, request)
+        if _, _, err := ws.ReadMessage(); err == nil {
+            t.Errorf("%s client got a response", name)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "context"
+    "net"
+    "sync"
+    "time"
+)
+
+// dialPool keeps a connection dialed ahead for every address it has been
+// asked for, so that the next session to the same address finds one ready
+// instead of waiting for a dial. A connection is only ever handed to one
+// session; once taken, a replacement is dialed in the background. Spares
+// left unused for longer than idle are closed.
+//
+// It always fronts the dials to UPSTREAM_PROXY and UPSTREAM_WS, whose
+// address never changes, and with POOL_ALL=1 also direct TCP dials to
+// targets, which only pays off where clients keep returning to the same
+// few of them.
+type dialPool struct {
+    forward forwardDialer
+    idle    time.Duration
+
+    mu     sync.Mutex
+    spares map[string]*poolSpare
+}
+
+// poolSpare is the connection dialed ahead for one address. conn is nil
+// while it is being dialed.
+type poolSpare struct {
+    conn   net.Conn
+    expiry *time.Timer
+}
+
+// targetPool is the pool used for direct TCP dials to targets with
+// POOL_ALL=1, or nil.
+var targetPool *dialPool
+
+func newDialPool(forward forwardDialer, idle time.Duration) *dialPool {
+    return &dialPool{forward: forward, idle: idle, spares: make(map[string]*poolSpare)}
+}
+
+func (p *dialPool) Dial(network, addr string) (net.Conn, error) {
+    return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext returns the spare connection to addr when there is one that
+// is still open, and dials it otherwise. A spare is only dialed again behind
+// a connection that was made.
+func (p *dialPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    key := network + " " + addr
+    p.mu.Lock()
+    spare := p.spares[key]
+    if spare != nil && spare.conn != nil {
+        delete(p.spares, key)
+        spare.expiry.Stop()
+    }
+    p.mu.Unlock()
+
+    if spare != nil && spare.conn != nil {
+        if spareOpen(spare.conn) {
+            p.refill(network, addr)
+            return spare.conn, nil
+        }
+        spare.conn.Close()
+    }
+    conn, err := p.forward.DialContext(ctx, network, addr)
+    if err != nil {
+        return nil, err
+    }
+    p.refill(network, addr)
+    return conn, nil
+}
+
+// refill dials a spare connection to addr unless one is already there or
+// on its way.
+func (p *dialPool) refill(network, addr string) {
+    key := network + " " + addr
+    p.mu.Lock()
+    if p.spares[key] != nil {
+        p.mu.Unlock()
+        return
+    }
+    spare := &poolSpare{}
+    p.spares[key] = spare
+    p.mu.Unlock()
+
+    go func() {
+        conn, err := p.forward.Dial(network, addr)
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        if err != nil {
+            delete(p.spares, key)
+            return
+        }
+        spare.conn = conn
+        spare.expiry = time.AfterFunc(p.idle, func() {
+            p.mu.Lock()
+            defer p.mu.Unlock()
+            if p.spares[key] == spare {
+                delete(p.spares, key)
+                conn.Close()
+            }
+        })
+    }()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+    "net"
+    "syscall"
+)
+
+// spareOpen reports whether the far end has not closed conn while it waited
+// in the pool. It peeks at the socket without blocking, so nothing a target
+// that speaks first has sent is taken from the session.
+func spareOpen(conn net.Conn) bool {
+    sc, ok := conn.(syscall.Conn)
+    if !ok {
+        return true
+    }
+    raw, err := sc.SyscallConn()
+    if err != nil {
+        return false
+    }
+    open := true
+    err = raw.Control(func(fd uintptr) {
+        n, _, err := syscall.Recvfrom(int(fd), make([]byte, 1), syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+        open = n > 0 || err == syscall.EAGAIN
+    })
+    return err == nil && open
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// spareAddr waits for p to have a spare connection to addr and returns the
+// local address it was dialed from.
+func spareAddr(t testing.TB, p *dialPool, addr string) string {
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        p.mu.Lock()
+        var conn net.Conn
+        if spare := p.spares["tcp "+addr]; spare != nil {
+            conn = spare.conn
+        }
+        p.mu.Unlock()
+        if conn != nil {
+            return conn.LocalAddr().String()
+        }
+    }
+    t.Fatalf("no spare connection to %s", addr)
+    return ""
+}
+
+func TestPoolAll(t *testing.T) {
+    pool := newDialPool(dialerFor("tcp"), time.Hour)
+    setVar(t, &targetPool, pool)
+    srv := newTestServer(t)
+    // The target answers with the address the connection came from.
+    port := tcpServer(t, func(conn net.Conn) {
+        if _, err := conn.Read(make([]byte, 16)); err == nil {
+            conn.Write([]byte(conn.RemoteAddr().String()))
+        }
+    })
+    target := fmt.Sprintf("127.0.0.1:%d", port)
+
+    session := func() string {
+        t.Helper()
+        ws := dialProxy(t, srv, "/")
+        defer ws.Close()
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("hello")))
+        readResponse(t, ws)
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(message)
+    }
+    first := session()
+    spare := spareAddr(t, pool, target)
+    if spare == first {
+        t.Fatalf("spare is the connection the first session used")
+    }
+    if second := session(); second != spare {
+        t.Errorf("second session came from %s, want the spare from %s", second, spare)
+    }
+    if next := spareAddr(t, pool, target); next == spare {
+        t.Error("spare was not replaced after it was taken")
+    }
+}
+
+func TestPoolIdle(t *testing.T) {
+    pool := newDialPool(dialerFor("tcp"), 50*time.Millisecond)
+    closed := make(chan struct{}, 2)
+    port := tcpServer(t, func(conn net.Conn) {
+        conn.Read(make([]byte, 1))
+        closed <- struct{}{}
+    })
+    target := fmt.Sprintf("127.0.0.1:%d", port)
+
+    // The first dial goes through, and the connection dialed ahead behind
+    // it is closed once left unused for POOL_IDLE.
+    conn, err := pool.Dial("tcp", target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    spareAddr(t, pool, target)
+    select {
+    case <-closed:
+    case <-time.After(5 * time.Second):
+        t.Fatal("idle spare not closed")
+    }
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    if len(pool.spares) != 0 {
+        t.Errorf("%d spares left after they expired", len(pool.spares))
+    }
+}
+
+// TestPoolDeadSpare has the target close the spare connection while it
+// waits in the pool, and checks that the next dial makes a new connection
+// instead of handing out the closed one, and that a failed dial leaves no
+// spare behind it.
+func TestPoolDeadSpare(t *testing.T) {
+    pool := newDialPool(dialerFor("tcp"), time.Hour)
+    var accepted atomic.Int32
+    port := tcpServer(t, func(conn net.Conn) {
+        // The second connection is the spare behind the first.
+        if accepted.Add(1) == 2 {
+            return
+        }
+        b := make([]byte, 16)
+        for {
+            n, err := conn.Read(b)
+            if err != nil {
+                return
+            }
+            conn.Write(b[:n])
+        }
+    })
+    target := fmt.Sprintf("127.0.0.1:%d", port)
+
+    conn, err := pool.Dial("tcp", target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.Close()
+    spare := spareAddr(t, pool, target)
+    time.Sleep(50 * time.Millisecond)
+    conn, err = pool.Dial("tcp", target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if conn.LocalAddr().String() == spare {
+        t.Fatal("closed spare handed out")
+    }
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    conn.Write([]byte("ping"))
+    got := make([]byte, 4)
+    if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+        t.Errorf("new connection got %q, %v", got, err)
+    }
+
+    closed := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+    if _, err := pool.Dial("tcp", closed); err == nil {
+        t.Fatal("dial to a closed port succeeded")
+    }
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+    if pool.spares["tcp "+closed] != nil {
+        t.Error("spare dialed behind a failed dial")
+    }
+}
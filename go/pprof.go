@@ -0,0 +1,34 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "net/http/pprof"
+)
+
+// registerPprof serves the runtime profiles under /debug/pprof/: on the
+// internal listener at addr when one is given, and alongside the proxy on
+// mux otherwise.
+//
+// Importing net/http/pprof also registers the profiles on
+// http.DefaultServeMux, which is why the proxy serves its own mux.
+func registerPprof(mux *http.ServeMux, addr string) {
+    profiles := http.NewServeMux()
+    profiles.HandleFunc("/debug/pprof/", pprof.Index)
+    profiles.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    profiles.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    profiles.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    profiles.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+    if addr == "" {
+        mux.Handle("/debug/pprof/", profiles)
+        return
+    }
+
+    go func() {
+        if err := http.ListenAndServe(addr, profiles); err != nil {
+            fatal("Profiling server error", "error", err)
+        }
+    }()
+    slog.Info("Profiling server is running", "addr", addr)
+}
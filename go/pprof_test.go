@@ -0,0 +1,59 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+// getBody returns the status and body of a GET of url.
+func getBody(t testing.TB, url string) (int, string) {
+    t.Helper()
+    resp, err := http.Get(url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, string(body)
+}
+
+func TestPprof(t *testing.T) {
+    // The root answers 404 here, as a deployment with ROOT_STATUS=404
+    // does, so that a path nothing serves is told apart from the index.
+    setVar(t, &rootStatus, http.StatusNotFound)
+
+    off := newTestHandlerServer(t)
+    if status, _ := getBody(t, off.URL+"/debug/pprof/"); status != http.StatusNotFound {
+        t.Errorf("without PPROF: got %d", status)
+    }
+
+    t.Setenv("PPROF", "1")
+    on := newTestHandlerServer(t)
+    if status, body := getBody(t, on.URL+"/debug/pprof/"); status != http.StatusOK || !strings.Contains(body, "goroutine") {
+        t.Errorf("with PPROF=1: got %d", status)
+    }
+
+    // With PPROF_ADDR the profiles are only served on that address.
+    addr := fmt.Sprintf("127.0.0.1:%d", closedPort(t))
+    t.Setenv("PPROF_ADDR", addr)
+    internal := newTestHandlerServer(t)
+    if status, _ := getBody(t, internal.URL+"/debug/pprof/"); status != http.StatusNotFound {
+        t.Errorf("proxy listener with PPROF_ADDR: got %d", status)
+    }
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        if resp, err := http.Get("http://" + addr + "/debug/pprof/"); err == nil {
+            resp.Body.Close()
+            if resp.StatusCode != http.StatusOK {
+                t.Errorf("PPROF_ADDR: got %d", resp.StatusCode)
+            }
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("profiling server not listening on PPROF_ADDR")
+        }
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+)
+
+// sendProxyProto is the version of the PROXY protocol header written to
+// each target connection before any of the client's data, 1 or 2, or 0 when
+// SEND_PROXY_PROTO is unset. It lets a target behind this server, such as
+// another proxy, see the client's own address rather than the server's.
+var sendProxyProto int
+
+// proxyProtoV2Sig starts every version 2 header.
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func parseProxyProtoVersion(v string) (int, error) {
+    switch v {
+    case "":
+        return 0, nil
+    case "1", "v1":
+        return 1, nil
+    case "2", "v2":
+        return 2, nil
+    default:
+        return 0, fmt.Errorf("must be v1 or v2")
+    }
+}
+
+// requestAddrs returns the address of the client that sent r, as clientIP
+// sees it, and the address of this server it connected to. The port of a
+// client behind TRUST_PROXY is that of the proxy's connection, as its own
+// is not known. Either is nil when it is not a TCP address.
+func requestAddrs(r *http.Request) (client, local *net.TCPAddr) {
+    if ip := net.ParseIP(clientIP(r)); ip != nil {
+        client = &net.TCPAddr{IP: ip}
+        if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+            client.Port, _ = strconv.Atoi(port)
+        }
+    }
+    local, _ = r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+    return client, local
+}
+
+// writeProxyHeader writes the PROXY protocol header for a connection from
+// client to local to w, when SEND_PROXY_PROTO is set. Without both
+// addresses the header says the connection's origin is unknown.
+func writeProxyHeader(w io.Writer, client, local net.Addr) error {
+    if sendProxyProto == 0 {
+        return nil
+    }
+    src, _ := client.(*net.TCPAddr)
+    dst, _ := local.(*net.TCPAddr)
+
+    if sendProxyProto == 1 {
+        _, err := io.WriteString(w, proxyHeaderV1(src, dst))
+        return err
+    }
+    _, err := w.Write(proxyHeaderV2(src, dst))
+    return err
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) string {
+    if src == nil || dst == nil {
+        return "PROXY UNKNOWN\r\n"
+    }
+    srcIP, dstIP, family := proxyHeaderIPs(src, dst)
+    proto := "TCP6"
+    if family == 4 {
+        proto = "TCP4"
+    }
+    return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+    b := append([]byte(nil), proxyProtoV2Sig...)
+    // Version 2, PROXY command.
+    b = append(b, 0x21)
+    if src == nil || dst == nil {
+        return append(b, 0x00, 0, 0)
+    }
+    srcIP, dstIP, family := proxyHeaderIPs(src, dst)
+    if family == 4 {
+        b = append(b, 0x11)
+    } else {
+        b = append(b, 0x21)
+    }
+    b = binary.BigEndian.AppendUint16(b, uint16(2*len(srcIP)+4))
+    b = append(b, srcIP...)
+    b = append(b, dstIP...)
+    b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+    return binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+}
+
+// proxyHeaderIPs returns the addresses of src and dst in the same family,
+// 4 when both are IPv4 and 6, with IPv4 ones mapped, otherwise.
+func proxyHeaderIPs(src, dst *net.TCPAddr) (net.IP, net.IP, int) {
+    if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+        return src4, dst4, 4
+    }
+    return src.IP.To16(), dst.IP.To16(), 6
+}
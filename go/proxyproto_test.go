@@ -0,0 +1,64 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestSendProxyProto(t *testing.T) {
+    srv := newTestServer(t)
+    serverAddr, _ := url.Parse(srv.URL)
+    headers := make(chan []byte, 1)
+    // The target reads the header, whichever its version, and echoes what
+    // follows it.
+    port := tcpServer(t, func(conn net.Conn) {
+        r := bufio.NewReader(conn)
+        var header []byte
+        if sig, _ := r.Peek(len(proxyProtoV2Sig)); bytes.Equal(sig, proxyProtoV2Sig) {
+            header = make([]byte, 16)
+            io.ReadFull(r, header)
+            header = append(header, make([]byte, binary.BigEndian.Uint16(header[14:]))...)
+            io.ReadFull(r, header[16:])
+        } else {
+            header, _ = r.ReadBytes('\n')
+        }
+        headers <- header
+        io.Copy(conn, r)
+    })
+
+    for _, version := range []int{1, 2} {
+        setVar(t, &sendProxyProto, version)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("ping")))
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+            t.Fatalf("v%d: got %q, %v", version, message, err)
+        }
+        client := ws.LocalAddr().(*net.TCPAddr)
+        header := <-headers
+        ws.Close()
+
+        var got string
+        if version == 1 {
+            got = string(header)
+        } else {
+            if len(header) != 28 || header[12] != 0x21 || header[13] != 0x11 {
+                t.Fatalf("v2: header %x", header)
+            }
+            got = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", net.IP(header[16:20]), net.IP(header[20:24]),
+                binary.BigEndian.Uint16(header[24:]), binary.BigEndian.Uint16(header[26:]))
+        }
+        want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %s\r\n", client.Port, serverAddr.Port())
+        if got != want {
+            t.Errorf("v%d: header says %q, want %q", version, got, want)
+        }
+    }
+}
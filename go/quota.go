@@ -0,0 +1,147 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// quotaSaveInterval is how often the quota counter is written to QUOTA_FILE.
+const quotaSaveInterval = time.Minute
+
+// errQuotaExceeded refuses new sessions once QUOTA_BYTES has been used up.
+var errQuotaExceeded = errors.New("data quota exceeded for this period")
+
+// quota is the egress quota set by QUOTA_BYTES, or nil when there is none.
+var quota *egressQuota
+
+// egressQuota counts the bytes proxied in both directions during the
+// current period, a UTC day or month. Once they reach limit, new sessions
+// are refused until the next period begins; sessions already running are
+// left to finish.
+type egressQuota struct {
+    limit  int64
+    period string
+    file   string
+
+    mu    sync.Mutex
+    start time.Time
+    used  int64
+}
+
+// quotaState is the content of QUOTA_FILE.
+type quotaState struct {
+    PeriodStart time.Time `json:"period_start"`
+    Used        int64     `json:"used"`
+}
+
+// newEgressQuota returns a quota of limit bytes per period, "day" or
+// "month". With file set, the count is read back from it, unless it was
+// saved in an earlier period.
+func newEgressQuota(limit int64, period, file string) (*egressQuota, error) {
+    if period != "day" && period != "month" {
+        return nil, fmt.Errorf("invalid QUOTA_PERIOD %q: must be day or month", period)
+    }
+    q := &egressQuota{limit: limit, period: period, file: file}
+    q.start = q.periodStart(time.Now())
+    if file == "" {
+        return q, nil
+    }
+
+    data, err := os.ReadFile(file)
+    if errors.Is(err, fs.ErrNotExist) {
+        return q, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var state quotaState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return nil, fmt.Errorf("%s: %w", file, err)
+    }
+    if state.PeriodStart.Equal(q.start) {
+        q.used = state.Used
+    }
+    return q, nil
+}
+
+// periodStart returns the start of the period that t falls in.
+func (q *egressQuota) periodStart(t time.Time) time.Time {
+    t = t.UTC()
+    if q.period == "day" {
+        return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+    }
+    return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// roll starts a new count when now is past the current period. q.mu must
+// be held.
+func (q *egressQuota) roll(now time.Time) {
+    if start := q.periodStart(now); start.After(q.start) {
+        q.start = start
+        q.used = 0
+    }
+}
+
+func (q *egressQuota) add(n int) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.roll(time.Now())
+    q.used += int64(n)
+}
+
+// exceeded reports whether the quota of the current period is used up.
+func (q *egressQuota) exceeded() bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.roll(time.Now())
+    return q.used >= q.limit
+}
+
+// save writes the count to QUOTA_FILE, through a temporary file so that a
+// crash never leaves it half written.
+func (q *egressQuota) save() error {
+    q.mu.Lock()
+    data, err := json.Marshal(quotaState{PeriodStart: q.start, Used: q.used})
+    q.mu.Unlock()
+    if err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(q.file), ".quota-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), q.file)
+}
+
+// saveEvery saves the count every interval for as long as the server runs.
+func (q *egressQuota) saveEvery(interval time.Duration) {
+    for range time.Tick(interval) {
+        if err := q.save(); err != nil {
+            slog.Warn("Failed to save QUOTA_FILE", "error", err)
+        }
+    }
+}
+
+// checkQuota refuses a new session once the quota is used up.
+func checkQuota() error {
+    if quota != nil && quota.exceeded() {
+        return newProxyError(closeQuotaExceeded, errQuotaExceeded)
+    }
+    return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestQuota(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "quota.json")
+    q, err := newEgressQuota(10, "day", file)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setVar(t, &quota, q)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    session := func() *websocket.Conn {
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("0123456789")))
+        return ws
+    }
+
+    // The session that uses the quota up runs to its end...
+    ws := session()
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "0123456789" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    ws.Close()
+    // ...and the next one is refused.
+    expectClose(t, session(), closeQuotaExceeded)
+
+    // The count is saved, and read back by the next run in the same period.
+    if err := q.save(); err != nil {
+        t.Fatal(err)
+    }
+    if restored, err := newEgressQuota(10, "day", file); err != nil || !restored.exceeded() {
+        t.Errorf("count not restored from QUOTA_FILE: %v", err)
+    }
+
+    // Once the next period begins, sessions are served again.
+    q.mu.Lock()
+    q.start = q.start.AddDate(0, 0, -1)
+    q.mu.Unlock()
+    ws = session()
+    readResponse(t, ws)
+    ws.Close()
+
+    // A count saved in an earlier period is not carried over.
+    q.mu.Lock()
+    q.start, q.used = q.start.AddDate(0, 0, -1), 100
+    q.mu.Unlock()
+    if err := q.save(); err != nil {
+        t.Fatal(err)
+    }
+    if restored, err := newEgressQuota(10, "day", file); err != nil || restored.exceeded() {
+        t.Errorf("count from an earlier period restored: %v", err)
+    }
+
+    if _, err := newEgressQuota(10, "week", ""); err == nil {
+        t.Error("QUOTA_PERIOD=week accepted")
+    }
+    os.WriteFile(file, []byte("{"), 0o600)
+    if _, err := newEgressQuota(10, "day", file); err == nil {
+        t.Error("corrupt QUOTA_FILE accepted")
+    }
+}
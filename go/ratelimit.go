@@ -0,0 +1,72 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// limiterSweepInterval is how often buckets that have refilled completely,
+// and so carry no state worth keeping, are removed.
+const limiterSweepInterval = time.Minute
+
+// ipLimiter is a token-bucket limiter per source IP: each IP may open burst
+// connections at once and rate more per second after that.
+type ipLimiter struct {
+    rate  float64
+    burst float64
+
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+    return &ipLimiter{
+        rate:      rate,
+        burst:     float64(burst),
+        buckets:   make(map[string]*tokenBucket),
+        lastSweep: time.Now(),
+    }
+}
+
+// allow reports whether ip may open another connection now, taking a token
+// from its bucket if so.
+func (l *ipLimiter) allow(ip string) bool {
+    now := time.Now()
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.Sub(l.lastSweep) >= limiterSweepInterval {
+        l.sweep(now)
+    }
+
+    b, ok := l.buckets[ip]
+    if !ok {
+        b = &tokenBucket{tokens: l.burst, last: now}
+        l.buckets[ip] = b
+    }
+    b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+    b.last = now
+
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// sweep removes the buckets that would be full by now. l.mu must be held.
+func (l *ipLimiter) sweep(now time.Time) {
+    for ip, b := range l.buckets {
+        if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+            delete(l.buckets, ip)
+        }
+    }
+    l.lastSweep = now
+}
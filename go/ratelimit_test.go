@@ -0,0 +1,53 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestRateLimit(t *testing.T) {
+    const burst = 3
+    setVar(t, &connLimiter, newIPLimiter(0.001, burst))
+    setVar(t, &trustProxy, true)
+    srv := newTestServer(t)
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+    upgrade := func(ip string) int {
+        t.Helper()
+        ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {ip}})
+        if err == nil {
+            ws.Close()
+        }
+        if resp == nil {
+            t.Fatal(err)
+        }
+        return resp.StatusCode
+    }
+
+    for i := 0; i < burst; i++ {
+        if status := upgrade("203.0.113.1"); status != http.StatusSwitchingProtocols {
+            t.Fatalf("connection %d: got %d", i+1, status)
+        }
+    }
+    if status := upgrade("203.0.113.1"); status != http.StatusTooManyRequests {
+        t.Errorf("connection %d: got %d, want 429", burst+1, status)
+    }
+    if status := upgrade("203.0.113.2"); status != http.StatusSwitchingProtocols {
+        t.Errorf("another IP: got %d", status)
+    }
+}
+
+func TestRateLimitSweep(t *testing.T) {
+    l := newIPLimiter(1000, 1)
+    l.allow("203.0.113.1")
+    time.Sleep(5 * time.Millisecond)
+    // Its bucket has refilled by the next sweep.
+    l.lastSweep = time.Now().Add(-limiterSweepInterval)
+    l.allow("203.0.113.2")
+    if _, ok := l.buckets["203.0.113.1"]; ok || len(l.buckets) != 1 {
+        t.Errorf("buckets after a sweep: %v", l.buckets)
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// routeMap is ROUTE_MAP, the destinations that are dialed at another
+// address than the one the client asked for, such as a sink for ad hosts or
+// a pinned CDN edge. It maps a host, or "*.domain" for every subdomain of
+// domain, to the host:port to dial instead; a host without a port keeps the
+// port of the request. checkTarget applies it on every frontend and to
+// every mux substream; the host rules still apply to the host requested,
+// while ALLOW_PRIVATE does not apply to the address routed to.
+var routeMap map[string]string
+
+// parseRouteMap parses ROUTE_MAP, a JSON object such as
+// {"ads.example.com": "127.0.0.1:9", "*.cdn.example": "edge.example:443"}.
+func parseRouteMap(s string) (map[string]string, error) {
+    var raw map[string]string
+    if err := json.Unmarshal([]byte(s), &raw); err != nil {
+        return nil, err
+    }
+    routes := make(map[string]string, len(raw))
+    for from, to := range raw {
+        if from == "" || to == "" {
+            return nil, fmt.Errorf("empty route %q: %q", from, to)
+        }
+        if host, port, err := net.SplitHostPort(to); err == nil {
+            if host == "" {
+                return nil, fmt.Errorf("route for %s: missing host in %q", from, to)
+            }
+            if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+                return nil, fmt.Errorf("route for %s: invalid port in %q", from, to)
+            }
+        }
+        routes[strings.ToLower(strings.TrimSuffix(from, "."))] = to
+    }
+    return routes, nil
+}
+
+// routeTarget returns the address ROUTE_MAP sends host and port to, and
+// whether it has a route for them at all. An exact host wins over a
+// wildcard, and a longer wildcard over a shorter one.
+func routeTarget(host string, port uint16) (string, uint16, bool) {
+    if len(routeMap) == 0 {
+        return host, port, false
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    to, ok := routeMap[host]
+    for domain := host; !ok; {
+        _, rest, found := strings.Cut(domain, ".")
+        if !found {
+            return host, port, false
+        }
+        to, ok = routeMap["*."+rest]
+        domain = rest
+    }
+
+    toHost, toPort, err := net.SplitHostPort(to)
+    if err != nil {
+        return normalizeHost(to), port, true
+    }
+    p, _ := strconv.Atoi(toPort)
+    return normalizeHost(toHost), uint16(p), true
+}
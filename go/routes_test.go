@@ -0,0 +1,134 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestRouteTarget(t *testing.T) {
+    setVar(t, &routeMap, map[string]string{
+        "ads.example.com": "127.0.0.1:9",
+        "*.example.org":   "edge.example",
+        "*.a.example.org": "[::1]:8443",
+    })
+    for from, want := range map[string]string{
+        "ads.example.com":   "127.0.0.1:9",
+        "ADS.example.com.":  "127.0.0.1:9",
+        "www.example.org":   "edge.example:443",
+        "x.a.example.org":   "[::1]:8443",
+        "example.org":       "",
+        "other.example.com": "",
+    } {
+        host, port, ok := routeTarget(from, 443)
+        got := ""
+        if ok {
+            got = net.JoinHostPort(host, fmt.Sprint(port))
+        }
+        if got != want {
+            t.Errorf("%s: got %q, want %q", from, got, want)
+        }
+    }
+}
+
+// sink starts a TCP target that sends the first data of every connection
+// to it on the returned channel.
+func sink(t testing.TB) (uint16, <-chan string) {
+    received := make(chan string, 8)
+    port := tcpServer(t, func(conn net.Conn) {
+        b := make([]byte, 1024)
+        n, _ := conn.Read(b)
+        received <- string(b[:n])
+    })
+    return port, received
+}
+
+// TestRouteMap sends example.com to a sink on loopback through ROUTE_MAP,
+// on every frontend and with ALLOW_PRIVATE off, which still refuses the
+// sink when it is asked for directly.
+func TestRouteMap(t *testing.T) {
+    port, received := sink(t)
+    setVar(t, &routeMap, map[string]string{"example.com": fmt.Sprintf("127.0.0.1:%d", port)})
+    setVar(t, &allowPrivate, false)
+    setVar(t, &trojanKey, newTrojanKey("secret"))
+    setVar(t, &vmessPath, "/vmess")
+    setVar(t, &vmessUsers, newVMessUsers(users))
+    // The test request's auth ID is only new to a filter of its own.
+    setVar(t, &vmessSeen, &authIDFilter{seen: make(map[[vmessAuthIDLen]byte]time.Time)})
+    srv := newTestServer(t)
+    const host = "example.com"
+
+    expect := func(frontend, payload string) {
+        t.Helper()
+        select {
+        case got := <-received:
+            if got != payload {
+                t.Errorf("%s: sink got %q, want %q", frontend, got, payload)
+            }
+        case <-time.After(5 * time.Second):
+            t.Errorf("%s: nothing reached the sink", frontend)
+        }
+    }
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, host, 80, []byte("vless")))
+    readResponse(t, ws)
+    expect("vless", "vless")
+
+    trojan := append(newTrojanKey("secret"), "\r\n"...)
+    trojan = append(trojan, socks5CommandConnect, socks5AddrDomain, byte(len(host)))
+    trojan = binary.BigEndian.AppendUint16(append(trojan, host...), 80)
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, append(trojan, "\r\ntrojan"...))
+    expect("trojan", "trojan")
+
+    request, _, _ := vmessTestRequest(testUser, host, 80, []byte("vmess"))
+    ws = dialProxy(t, srv, "/vmess")
+    ws.WriteMessage(websocket.BinaryMessage, request)
+    expect("vmess", "vmess")
+
+    target := append(binary.BigEndian.AppendUint16([]byte{muxNetworkTCP}, 80), 2, byte(len(host)))
+    muxSessionConn(t, srv, muxFrame(1, muxStatusNew, muxOptionData, append(target, host...), []byte("mux")))
+    expect("mux", "mux")
+
+    conn, err := net.Dial("tcp", startSOCKS5(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+    connect := append([]byte{socks5Version, socks5CommandConnect, 0, socks5AddrDomain, byte(len(host))}, host...)
+    conn.Write(binary.BigEndian.AppendUint16(connect, 80))
+    // The method selection, then the reply to the CONNECT.
+    reply := make([]byte, 2+10)
+    if _, err := io.ReadFull(conn, reply); err != nil || reply[2+1] != socks5Succeeded {
+        t.Fatalf("SOCKS5 reply %x, %v", reply, err)
+    }
+    conn.Write([]byte("socks5"))
+    expect("socks5", "socks5")
+
+    connectSrv := httptest.NewServer(connectHandler(http.NotFoundHandler()))
+    t.Cleanup(connectSrv.Close)
+    if _, _, resp := connectTo(t, connectSrv, host+":80", "connect"); resp.StatusCode != http.StatusOK {
+        t.Fatalf("CONNECT: got %d", resp.StatusCode)
+    }
+    expect("connect", "connect")
+
+    // The sink itself is still a private target, and the host rules still
+    // apply to the host asked for.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    expectClose(t, ws, closeBlockedHost)
+    setVar(t, &denyHosts, parseHostPatterns(host))
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, host, 80, nil))
+    expectClose(t, ws, closeBlockedHost)
+}
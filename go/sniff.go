@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "log/slog"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/cryptobyte"
+)
+
+// sniff is SNIFF=1: the start of what a client sends on a TCP session, on
+// any of the frontends and on every mux substream, is looked into for the
+// name of the site it is really for, the SNI of a TLS ClientHello or the
+// Host header of an HTTP request, which is logged and checked against
+// SNIFF_ALLOW_HOSTS and SNIFF_DENY_HOSTS. The data itself is always
+// forwarded as it is.
+var (
+    sniff           bool
+    sniffAllowHosts hostPatterns
+    sniffDenyHosts  hostPatterns
+)
+
+// maxSniffData bounds the data held back to be sniffed: the largest TLS
+// record, which a ClientHello has to fit in to be sniffed, and as much of
+// an HTTP request header.
+const maxSniffData = 5 + 1<<14
+
+// sniffWait bounds the time the start of a stream is held back for while
+// more of a ClientHello or request header is still to come. It is only
+// changed by tests.
+var sniffWait = time.Second
+
+// sniffComplete reports whether data, the start of a client's stream, holds
+// all there is to sniff: a whole TLS record or HTTP request header, or
+// enough to tell that it is neither.
+func sniffComplete(data []byte) bool {
+    if len(data) > 0 && data[0] == 0x16 {
+        return len(data) >= 5 && len(data) >= 5+int(data[3])<<8|int(data[4])
+    }
+    // An HTTP request starts with a method, a token of capital letters.
+    method, _, ok := bytes.Cut(data, []byte(" "))
+    for _, c := range method {
+        if c < 'A' || c > 'Z' {
+            return true
+        }
+    }
+    return ok && (len(method) == 0 || bytes.Contains(data, []byte("\r\n\r\n")))
+}
+
+// sniffName returns the server name in data, the start of a client's
+// stream, or "" when it holds neither a TLS ClientHello nor an HTTP request
+// that names one. Only data itself is looked at: a ClientHello or request
+// header cut short by the end of it yields no name.
+func sniffName(data []byte) string {
+    if len(data) > 0 && data[0] == 0x16 {
+        return sniffSNI(data)
+    }
+    return sniffHTTPHost(data)
+}
+
+// sniffSNI returns the host name of the server_name extension of the TLS
+// ClientHello at the start of data.
+func sniffSNI(data []byte) string {
+    var record, hello cryptobyte.String
+    var contentType uint8
+    var version uint16
+    s := cryptobyte.String(data)
+    if !s.ReadUint8(&contentType) || contentType != 0x16 ||
+        !s.ReadUint16(&version) || !s.ReadUint16LengthPrefixed(&record) {
+        return ""
+    }
+
+    var msgType uint8
+    if !record.ReadUint8(&msgType) || msgType != 1 || !record.ReadUint24LengthPrefixed(&hello) {
+        return ""
+    }
+    var sessionID, cipherSuites, compression, extensions cryptobyte.String
+    if !hello.Skip(2+32) ||
+        !hello.ReadUint8LengthPrefixed(&sessionID) ||
+        !hello.ReadUint16LengthPrefixed(&cipherSuites) ||
+        !hello.ReadUint8LengthPrefixed(&compression) ||
+        !hello.ReadUint16LengthPrefixed(&extensions) {
+        return ""
+    }
+
+    for !extensions.Empty() {
+        var ext uint16
+        var body cryptobyte.String
+        if !extensions.ReadUint16(&ext) || !extensions.ReadUint16LengthPrefixed(&body) {
+            return ""
+        }
+        if ext != 0 {
+            continue
+        }
+        var names cryptobyte.String
+        if !body.ReadUint16LengthPrefixed(&names) {
+            return ""
+        }
+        for !names.Empty() {
+            var nameType uint8
+            var name cryptobyte.String
+            if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+                return ""
+            }
+            if nameType == 0 {
+                return strings.ToLower(string(name))
+            }
+        }
+    }
+    return ""
+}
+
+// sniffHTTPHost returns the host of the Host header of the HTTP/1 request
+// at the start of data, without its port.
+func sniffHTTPHost(data []byte) string {
+    line, rest, ok := bytes.Cut(data, []byte("\r\n"))
+    if !ok || !bytes.Contains(line, []byte(" HTTP/1.")) {
+        return ""
+    }
+    for {
+        line, rest, ok = bytes.Cut(rest, []byte("\r\n"))
+        if !ok || len(line) == 0 {
+            return ""
+        }
+        name, value, ok := bytes.Cut(line, []byte(":"))
+        if !ok || !strings.EqualFold(string(name), "host") {
+            continue
+        }
+        host := strings.TrimSpace(string(value))
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        return strings.ToLower(strings.Trim(host, "[]"))
+    }
+}
+
+// checkSniffed logs the name sniffed from data and applies
+// SNIFF_DENY_HOSTS and SNIFF_ALLOW_HOSTS to it, returning the name. Without
+// a name, the allow list refuses the session.
+func checkSniffed(data []byte, logger *slog.Logger) (string, error) {
+    name := sniffName(data)
+    if name != "" {
+        logger.Debug("Sniffed server name", hostAttr("sniffed", name))
+    }
+    if sniffDenyHosts.match(name) || len(sniffAllowHosts) > 0 && !sniffAllowHosts.match(name) {
+        logger.Warn("Sniffed server name rejected by host rules", hostAttr("sniffed", name))
+        return name, newProxyError(closeBlockedHost, errors.New("sniffed server name is not allowed"))
+    }
+    return name, nil
+}
+
+// sniffReader holds back the start of the client's stream r until it has
+// all there is to sniff, maxSniffData of it, or sniffWait has passed since
+// it was first waited on, and passes it on once the host rules allow it.
+// A read still running when the wait runs out goes on in the background,
+// and what it reads follows the data sniffed.
+type sniffReader struct {
+    r      io.Reader
+    logger *slog.Logger
+
+    checked bool
+    buf     []byte
+    pending chan sniffRead
+    err     error
+
+    mu   sync.Mutex
+    name string
+}
+
+// sniffRead is the outcome of a read from the client while sniffing.
+type sniffRead struct {
+    data []byte
+    err  error
+}
+
+func newSniffReader(r io.Reader, logger *slog.Logger) *sniffReader {
+    return &sniffReader{r: r, logger: logger}
+}
+
+// sniff gathers the start of the stream, initial and then what follows it,
+// and applies the rules to it. It returns all the data gathered, which the
+// caller forwards itself, and is called at most once, before any Read.
+// An error reading the client is returned by the next Read instead.
+func (s *sniffReader) sniff(initial []byte) ([]byte, error) {
+    data := initial
+    timeout := time.NewTimer(sniffWait)
+    defer timeout.Stop()
+wait:
+    for s.err == nil && !sniffComplete(data) && len(data) < maxSniffData {
+        if s.pending == nil {
+            s.pending = make(chan sniffRead, 1)
+            go func(p []byte, done chan<- sniffRead) {
+                n, err := s.r.Read(p)
+                done <- sniffRead{p[:n], err}
+            }(make([]byte, maxSniffData-len(data)), s.pending)
+        }
+        select {
+        case res := <-s.pending:
+            s.pending = nil
+            data = append(data, res.data...)
+            s.err = res.err
+        case <-timeout.C:
+            break wait
+        }
+    }
+
+    s.checked = true
+    name, err := checkSniffed(data, s.logger)
+    s.mu.Lock()
+    s.name = name
+    s.mu.Unlock()
+    return data, err
+}
+
+// sniffed returns the name found in the stream, once it has been sniffed.
+func (s *sniffReader) sniffed() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.name
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+    if !s.checked {
+        data, err := s.sniff(nil)
+        if err != nil {
+            return 0, err
+        }
+        s.buf = data
+    }
+    if len(s.buf) == 0 && s.pending != nil {
+        res := <-s.pending
+        s.pending = nil
+        s.buf, s.err = res.data, res.err
+    }
+    if len(s.buf) > 0 {
+        n := copy(p, s.buf)
+        s.buf = s.buf[n:]
+        return n, nil
+    }
+    if s.err != nil {
+        return 0, s.err
+    }
+    return s.r.Read(p)
+}
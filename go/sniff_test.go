@@ -0,0 +1,217 @@
+package main
+
+import (
+    "bytes"
+    "crypto/tls"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// clientHello returns the record of the ClientHello crypto/tls sends for
+// name.
+func clientHello(t testing.TB, name string) []byte {
+    t.Helper()
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+    go tls.Client(client, &tls.Config{ServerName: name}).Handshake()
+
+    server.SetDeadline(time.Now().Add(5 * time.Second))
+    record := make([]byte, 5)
+    if _, err := io.ReadFull(server, record); err != nil {
+        t.Fatal(err)
+    }
+    record = append(record, make([]byte, int(record[3])<<8|int(record[4]))...)
+    if _, err := io.ReadFull(server, record[5:]); err != nil {
+        t.Fatal(err)
+    }
+    return record
+}
+
+// halves splits data in two, for sending as two messages.
+func halves(data []byte) ([]byte, []byte) {
+    return data[:len(data)/2], data[len(data)/2:]
+}
+
+func TestSniffComplete(t *testing.T) {
+    hello := clientHello(t, "example.com")
+    request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+    for name, tc := range map[string]struct {
+        data []byte
+        want bool
+    }{
+        "nothing":          {nil, false},
+        "record header":    {hello[:5], false},
+        "half a record":    {hello[:len(hello)/2], false},
+        "whole record":     {hello, true},
+        "method":           {[]byte("GET"), false},
+        "request line":     {request[:16], false},
+        "whole header":     {request, true},
+        "lowercase method": {[]byte("get / HTTP/1.1\r\n"), true},
+        "binary":           {[]byte{0, 1, 2}, true},
+        "ssh":              {[]byte("SSH-2.0-OpenSSH_9.6\r\n"), true},
+    } {
+        if got := sniffComplete(tc.data); got != tc.want {
+            t.Errorf("%s: got %v", name, got)
+        }
+    }
+    if got := sniffName(hello); got != "example.com" {
+        t.Errorf("sniffed %q from the ClientHello", got)
+    }
+}
+
+// TestSniff sends a ClientHello for an allowed name and an HTTP request for
+// a denied one, each split over two writes, on every TCP path, and checks
+// that the first reaches the target as it was sent and the second does
+// not reach it at all.
+func TestSniff(t *testing.T) {
+    setVar(t, &sniff, true)
+    setVar(t, &sniffDenyHosts, parseHostPatterns("blocked.example"))
+    logs := captureLogs(t)
+    hello := clientHello(t, "example.com")
+    blocked := []byte("GET / HTTP/1.1\r\nHost: blocked.example\r\n\r\n")
+    port := tcpEcho(t)
+    target := fmt.Sprintf("127.0.0.1:%d", port)
+
+    t.Run("vless", func(t *testing.T) {
+        srv := newTestServer(t)
+        first, second := halves(hello)
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, first))
+        ws.WriteMessage(websocket.BinaryMessage, second)
+        readResponse(t, ws)
+        var got []byte
+        for len(got) < len(hello) {
+            _, message, err := ws.ReadMessage()
+            if err != nil {
+                t.Fatal(err)
+            }
+            got = append(got, message...)
+        }
+        if !bytes.Equal(got, hello) {
+            t.Errorf("target got %x, want %x", got, hello)
+        }
+        ws.Close()
+        if r := logs.wait(t, "Session ended"); r["sniffed"] != "example.com" {
+            t.Errorf("session summary: got %v", r)
+        }
+
+        // The request is refused before the target is dialed.
+        var dialed atomic.Bool
+        countDials(t, func(int, string) { dialed.Store(true) })
+        first, second = halves(blocked)
+        ws = dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, first))
+        ws.WriteMessage(websocket.BinaryMessage, second)
+        expectClose(t, ws, closeBlockedHost)
+        if dialed.Load() {
+            t.Error("target dialed for a denied name")
+        }
+    })
+
+    t.Run("socks5", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        for data, allowed := range map[*[]byte]bool{&hello: true, &blocked: false} {
+            conn, reply := socks5Connect(t, addr, "", "", net.IPv4(127, 0, 0, 1), port)
+            if reply != socks5Succeeded {
+                t.Fatalf("got reply %d", reply)
+            }
+            first, second := halves(*data)
+            conn.Write(first)
+            conn.Write(second)
+            if allowed {
+                got := make([]byte, len(*data))
+                if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, *data) {
+                    t.Errorf("target got %q, %v", got, err)
+                }
+                continue
+            }
+            if got, _ := io.ReadAll(conn); len(got) > 0 {
+                t.Errorf("target got %q for a denied name", got)
+            }
+        }
+    })
+
+    t.Run("connect", func(t *testing.T) {
+        srv := httptest.NewServer(connectHandler(http.NotFoundHandler()))
+        t.Cleanup(srv.Close)
+        for data, allowed := range map[*[]byte]bool{&hello: true, &blocked: false} {
+            first, second := halves(*data)
+            conn, br, resp := connectTo(t, srv, target, string(first))
+            if resp.StatusCode != http.StatusOK {
+                t.Fatalf("got %d", resp.StatusCode)
+            }
+            conn.Write(second)
+            if allowed {
+                got := make([]byte, len(*data))
+                if _, err := io.ReadFull(br, got); err != nil || !bytes.Equal(got, *data) {
+                    t.Errorf("target got %q, %v", got, err)
+                }
+                continue
+            }
+            if got, _ := io.ReadAll(br); len(got) > 0 {
+                t.Errorf("target got %q for a denied name", got)
+            }
+        }
+    })
+
+    t.Run("mux", func(t *testing.T) {
+        srv := newTestServer(t)
+        first, second := halves(hello)
+        ws := muxSessionConn(t, srv, muxFrame(1, muxStatusNew, muxOptionData, muxTarget(port), first))
+        ws.WriteMessage(websocket.BinaryMessage, muxFrame(1, muxStatusKeep, muxOptionData, nil, second))
+        first, second = halves(blocked)
+        ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusNew, muxOptionData, muxTarget(port), first))
+        ws.WriteMessage(websocket.BinaryMessage, muxFrame(2, muxStatusKeep, muxOptionData, nil, second))
+
+        var got []byte
+        refused := false
+        for len(got) < len(hello) || !refused {
+            reply := readMuxFrame(t, ws)
+            switch {
+            case reply.id == 1 && reply.status == muxStatusKeep:
+                got = append(got, reply.data...)
+            case reply == muxReply{id: 2, status: muxStatusEnd, option: muxOptionError}:
+                refused = true
+            default:
+                t.Fatalf("got %+v", reply)
+            }
+        }
+        if !bytes.Equal(got, hello) {
+            t.Errorf("target got %x, want %x", got, hello)
+        }
+    })
+}
+
+// TestSniffWait sends the start of an HTTP request that is never finished,
+// and checks that it is passed on once SNIFF has waited for the rest for
+// long enough, with what follows it.
+func TestSniffWait(t *testing.T) {
+    setVar(t, &sniff, true)
+    setVar(t, &sniffWait, 50*time.Millisecond)
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    start := time.Now()
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("GET / HTTP/1.1\r\n")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "GET / HTTP/1.1\r\n" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    if elapsed := time.Since(start); elapsed < sniffWait {
+        t.Errorf("data passed on after %v, before SNIFF had waited", elapsed)
+    }
+    ws.WriteMessage(websocket.BinaryMessage, []byte("Host: example.com\r\n\r\n"))
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "Host: example.com\r\n\r\n" {
+        t.Errorf("got %q, %v", message, err)
+    }
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+    socks5Version = 5
+
+    socks5AuthNone     = 0
+    socks5AuthPassword = 2
+    socks5AuthRejected = 0xff
+
+    socks5CommandConnect = 1
+
+    socks5AddrIPv4   = 1
+    socks5AddrDomain = 3
+    socks5AddrIPv6   = 4
+
+    socks5Succeeded          = 0
+    socks5GeneralFailure     = 1
+    socks5NotAllowed         = 2
+    socks5HostUnreachable    = 4
+    socks5ConnRefused        = 5
+    socks5CommandUnsupported = 7
+    socks5AddrUnsupported    = 8
+)
+
+// socks5HandshakeTimeout bounds the time a client may take to complete the
+// SOCKS5 negotiation.
+const socks5HandshakeTimeout = 30 * time.Second
+
+// serveSOCKS5 accepts SOCKS5 clients on ln until it is closed. The loop is
+// itself counted as a session so that the sessions it starts are added to
+// the wait group before shutdown can begin waiting on it.
+func serveSOCKS5(ln net.Listener) {
+    sessions.Add(1)
+    defer sessions.Done()
+
+    for {
+        conn, err := ln.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            return
+        }
+        if err != nil {
+            slog.Warn("SOCKS5 accept error", "error", err)
+            continue
+        }
+
+        sessions.Add(1)
+        go func() {
+            defer sessions.Done()
+            handleSOCKS5(conn)
+        }()
+    }
+}
+
+// handleSOCKS5 negotiates a SOCKS5 CONNECT with the client and then relays
+// it within the same limits, and through the same address checks, dialer
+// and pumps, as the WebSocket proxy.
+func handleSOCKS5(client net.Conn) {
+    defer client.Close()
+
+    release, ok := acquireSlot()
+    if !ok {
+        return
+    }
+    defer release()
+    defer trackSession(client)()
+
+    logger := slog.With("conn_id", newConnID())
+    logger.Debug("New SOCKS5 connection established", "remote_addr", client.RemoteAddr().String())
+    defer recoverPanic(logger, nil)
+
+    client.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+    host, port, err := socks5Handshake(client)
+    if err != nil {
+        logger.Warn("SOCKS5 handshake error", "error", err)
+        return
+    }
+    logger.Debug("SOCKS5 details", hostAttr("host", host), "port", port)
+
+    if reply := socks5Admit(client); reply != socks5Succeeded {
+        logger.Warn("SOCKS5 session refused", "reply", reply)
+        socks5Reply(client, reply)
+        return
+    }
+
+    if port == 0 {
+        logger.Warn("Target port 0 rejected")
+        socks5Reply(client, socks5NotAllowed)
+        return
+    }
+    checked, err := checkTarget(host, port, logger)
+    if err != nil {
+        logger.Warn("SOCKS5 rejected", hostAttr("host", host), "port", port, "error", err)
+        socks5Reply(client, socks5ReplyCode(err))
+        return
+    }
+
+    if err := checkQuota(); err != nil {
+        logger.Warn("SOCKS5 refused", "error", err)
+        socks5Reply(client, socks5ReplyCode(err))
+        return
+    }
+    releasePumps, ok := acquirePumps()
+    if !ok {
+        socks5Reply(client, socks5GeneralFailure)
+        return
+    }
+    defer releasePumps()
+
+    target, err := dialTarget("tcp", checked.ips, checked.port)
+    if err != nil {
+        dialFailures.Inc()
+        logger.Warn("SOCKS5 dial error", hostAttr("host", host), "port", port, "error", err)
+        socks5Reply(client, socks5ReplyCode(newProxyError(closeDialFailed, err)))
+        return
+    }
+    defer target.Close()
+    if err := writeProxyHeader(target, client.RemoteAddr(), client.LocalAddr()); err != nil {
+        logger.Warn("SOCKS5 error sending PROXY header", "error", err)
+        socks5Reply(client, socks5GeneralFailure)
+        return
+    }
+
+    if err := socks5Reply(client, socks5Succeeded); err != nil {
+        return
+    }
+    client.SetDeadline(time.Time{})
+
+    idle := idleDeadline{client, target}
+    idle.extend()
+
+    var up io.Reader = client
+    var sniffer *sniffReader
+    if sniff {
+        sniffer = newSniffReader(up, logger)
+        up = sniffer
+    }
+    errChan := make(chan error, 2)
+
+    sess := newSession("", logger)
+    sess.target = net.JoinHostPort(host, strconv.Itoa(int(port)))
+    sess.route = checked.route
+    defer limitTunnel(sess, client, target)()
+    go func() {
+        defer recoverPanic(logger, errChan)
+        errChan <- pump(target, up, idle, sess.countUp)
+    }()
+    go func() {
+        defer recoverPanic(logger, errChan)
+        errChan <- pump(client, target, idle, sess.countDown)
+    }()
+
+    err = idleError(<-errChan)
+    if sniffer != nil {
+        sess.sniffed = sniffer.sniffed()
+    }
+    sess.end(err)
+}
+
+// socks5Admit applies the limits every new session is held to, returning
+// the reply that refuses the session, or socks5Succeeded to admit it.
+func socks5Admit(client net.Conn) byte {
+    if draining.Load() || quiesced.Load() {
+        return socks5GeneralFailure
+    }
+    if maxPumps > 0 && activePumps.Load() >= maxPumps {
+        return socks5GeneralFailure
+    }
+    ip, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+    if connLimiter != nil && !connLimiter.allow(ip) {
+        return socks5NotAllowed
+    }
+    return socks5Succeeded
+}
+
+// socks5ReplyCode returns the reply that reports err, a refused target or a
+// failed dial, to the client.
+func socks5ReplyCode(err error) byte {
+    if errors.Is(err, syscall.ECONNREFUSED) {
+        return socks5ConnRefused
+    }
+    var perr *proxyError
+    if errors.As(err, &perr) {
+        switch perr.code {
+        case closeBlockedHost:
+            return socks5NotAllowed
+        case closeDialFailed:
+            return socks5HostUnreachable
+        }
+    }
+    return socks5GeneralFailure
+}
+
+// socks5Handshake performs method negotiation, optional username/password
+// authentication and reads the CONNECT request, returning its target.
+func socks5Handshake(conn net.Conn) (string, uint16, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(conn, head[:]); err != nil {
+        return "", 0, err
+    }
+    if head[0] != socks5Version {
+        return "", 0, fmt.Errorf("unsupported SOCKS version %d", head[0])
+    }
+    methods := make([]byte, head[1])
+    if _, err := io.ReadFull(conn, methods); err != nil {
+        return "", 0, err
+    }
+
+    method := byte(socks5AuthNone)
+    if socks5Auth != "" {
+        method = socks5AuthPassword
+    }
+    offered := false
+    for _, m := range methods {
+        offered = offered || m == method
+    }
+    if !offered {
+        conn.Write([]byte{socks5Version, socks5AuthRejected})
+        return "", 0, fmt.Errorf("client offered no acceptable authentication method")
+    }
+    if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+        return "", 0, err
+    }
+
+    if method == socks5AuthPassword {
+        if err := socks5Authenticate(conn); err != nil {
+            return "", 0, err
+        }
+    }
+
+    var req [4]byte
+    if _, err := io.ReadFull(conn, req[:]); err != nil {
+        return "", 0, err
+    }
+    if req[1] != socks5CommandConnect {
+        socks5Reply(conn, socks5CommandUnsupported)
+        return "", 0, fmt.Errorf("unsupported SOCKS5 command %d", req[1])
+    }
+
+    var host string
+    switch req[3] {
+    case socks5AddrIPv4, socks5AddrIPv6:
+        ip := make(net.IP, net.IPv4len)
+        if req[3] == socks5AddrIPv6 {
+            ip = make(net.IP, net.IPv6len)
+        }
+        if _, err := io.ReadFull(conn, ip); err != nil {
+            return "", 0, err
+        }
+        host = ip.String()
+    case socks5AddrDomain:
+        var n [1]byte
+        if _, err := io.ReadFull(conn, n[:]); err != nil {
+            return "", 0, err
+        }
+        domain := make([]byte, n[0])
+        if _, err := io.ReadFull(conn, domain); err != nil {
+            return "", 0, err
+        }
+        host = normalizeHost(string(domain))
+    default:
+        socks5Reply(conn, socks5AddrUnsupported)
+        return "", 0, fmt.Errorf("unsupported SOCKS5 address type %d", req[3])
+    }
+
+    var port [2]byte
+    if _, err := io.ReadFull(conn, port[:]); err != nil {
+        return "", 0, err
+    }
+    return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+// socks5Authenticate runs the RFC 1929 username/password subnegotiation
+// against SOCKS5_AUTH.
+func socks5Authenticate(conn net.Conn) error {
+    var head [2]byte
+    if _, err := io.ReadFull(conn, head[:]); err != nil {
+        return err
+    }
+    user := make([]byte, head[1])
+    if _, err := io.ReadFull(conn, user); err != nil {
+        return err
+    }
+    var n [1]byte
+    if _, err := io.ReadFull(conn, n[:]); err != nil {
+        return err
+    }
+    pass := make([]byte, n[0])
+    if _, err := io.ReadFull(conn, pass); err != nil {
+        return err
+    }
+
+    got := string(user) + ":" + string(pass)
+    if subtle.ConstantTimeCompare([]byte(got), []byte(socks5Auth)) != 1 {
+        conn.Write([]byte{1, 1})
+        return fmt.Errorf("invalid SOCKS5 credentials")
+    }
+    _, err := conn.Write([]byte{1, 0})
+    return err
+}
+
+// socks5Reply sends a reply with the given status. The bound address is
+// reported as 0.0.0.0:0, which clients do not need for CONNECT.
+func socks5Reply(conn net.Conn, status byte) error {
+    _, err := conn.Write([]byte{socks5Version, status, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+    return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+// startSOCKS5 serves SOCKS5 on a loopback listener and returns its address.
+func startSOCKS5(t testing.TB) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The accept loop counts as a session, which endSessions ends too.
+    t.Cleanup(func() { ln.Close() })
+    context.AfterFunc(sessionCtx, func() { ln.Close() })
+    go serveSOCKS5(ln)
+    return ln.Addr().String()
+}
+
+// socks5Connect negotiates a CONNECT to the IPv4 host and port through the
+// SOCKS5 server at addr, authenticating as user:pass when user is set, and
+// returns the connection and the reply code.
+func socks5Connect(t testing.TB, addr, user, pass string, host net.IP, port uint16) (net.Conn, byte) {
+    t.Helper()
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+    method := byte(socks5AuthNone)
+    if user != "" {
+        method = socks5AuthPassword
+    }
+    conn.Write([]byte{socks5Version, 1, method})
+    var choice [2]byte
+    if _, err := io.ReadFull(conn, choice[:]); err != nil || choice[1] != method {
+        t.Fatalf("method selection: got %v, %v", choice, err)
+    }
+    if user != "" {
+        auth := append([]byte{1, byte(len(user))}, user...)
+        auth = append(append(auth, byte(len(pass))), pass...)
+        conn.Write(auth)
+        var status [2]byte
+        if _, err := io.ReadFull(conn, status[:]); err != nil {
+            t.Fatal(err)
+        }
+        if status[1] != 0 {
+            return conn, socks5NotAllowed
+        }
+    }
+
+    req := append([]byte{socks5Version, socks5CommandConnect, 0, socks5AddrIPv4}, host.To4()...)
+    conn.Write(binary.BigEndian.AppendUint16(req, port))
+    var reply [10]byte
+    if _, err := io.ReadFull(conn, reply[:]); err != nil {
+        t.Fatal(err)
+    }
+    return conn, reply[1]
+}
+
+func TestSOCKS5(t *testing.T) {
+    addr := startSOCKS5(t)
+    localhost := net.IPv4(127, 0, 0, 1)
+    port := tcpEcho(t)
+
+    conn, reply := socks5Connect(t, addr, "", "", localhost, port)
+    if reply != socks5Succeeded {
+        t.Fatalf("got reply %d", reply)
+    }
+    conn.Write([]byte("ping"))
+    got := make([]byte, 4)
+    if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+        t.Errorf("got %q, %v", got, err)
+    }
+
+    setVar(t, &socks5Auth, "user:pass")
+    if _, reply := socks5Connect(t, addr, "user", "wrong", localhost, port); reply == socks5Succeeded {
+        t.Error("wrong password accepted")
+    }
+    if _, reply := socks5Connect(t, addr, "user", "pass", localhost, port); reply != socks5Succeeded {
+        t.Errorf("right password: got reply %d", reply)
+    }
+}
+
+func TestSOCKS5Refusals(t *testing.T) {
+    localhost := net.IPv4(127, 0, 0, 1)
+    port := tcpEcho(t)
+
+    t.Run("private target", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        setVar(t, &allowPrivate, false)
+        if _, reply := socks5Connect(t, addr, "", "", localhost, port); reply != socks5NotAllowed {
+            t.Errorf("got reply %d, want %d", reply, socks5NotAllowed)
+        }
+    })
+    t.Run("closed port", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        if _, reply := socks5Connect(t, addr, "", "", localhost, closedPort(t)); reply != socks5ConnRefused {
+            t.Errorf("got reply %d, want %d", reply, socks5ConnRefused)
+        }
+    })
+    t.Run("quiesced", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        quiesced.Store(true)
+        defer quiesced.Store(false)
+        if _, reply := socks5Connect(t, addr, "", "", localhost, port); reply != socks5GeneralFailure {
+            t.Errorf("got reply %d, want %d", reply, socks5GeneralFailure)
+        }
+    })
+    t.Run("rate limit", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        setVar(t, &connLimiter, newIPLimiter(0.001, 1))
+        if _, reply := socks5Connect(t, addr, "", "", localhost, port); reply != socks5Succeeded {
+            t.Errorf("first session: got reply %d", reply)
+        }
+        if _, reply := socks5Connect(t, addr, "", "", localhost, port); reply != socks5NotAllowed {
+            t.Errorf("second session: got reply %d, want %d", reply, socks5NotAllowed)
+        }
+    })
+    t.Run("max session", func(t *testing.T) {
+        addr := startSOCKS5(t)
+        setVar(t, &maxSession, 100*time.Millisecond)
+        conn, reply := socks5Connect(t, addr, "", "", localhost, port)
+        if reply != socks5Succeeded {
+            t.Fatalf("got reply %d", reply)
+        }
+        start := time.Now()
+        if _, err := conn.Read(make([]byte, 1)); err == nil || time.Since(start) > 2*time.Second {
+            t.Errorf("session still open after MAX_SESSION: %v", err)
+        }
+    })
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "net"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// srcPortAttempts is how many ports of SRC_PORT_RANGE a dial tries before
+// it gives up.
+const srcPortAttempts = 16
+
+// srcPorts is SRC_PORT_RANGE, the local ports outbound connections are
+// dialed from, or nil to leave the choice to the kernel.
+var srcPorts *portRange
+
+// portRange is a range of ports, both ends included.
+type portRange struct {
+    lo, hi int
+}
+
+// parsePortRange parses a range such as 40000-50000.
+func parsePortRange(s string) (*portRange, error) {
+    lo, hi, ok := strings.Cut(s, "-")
+    if !ok {
+        return nil, fmt.Errorf("must be of the form low-high")
+    }
+    r := &portRange{}
+    var err error
+    if r.lo, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+        return nil, err
+    }
+    if r.hi, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+        return nil, err
+    }
+    if r.lo < 1 || r.hi > 65535 || r.lo > r.hi {
+        return nil, fmt.Errorf("must be a range of ports between 1 and 65535")
+    }
+    return r, nil
+}
+
+func (r *portRange) String() string {
+    return fmt.Sprintf("%d-%d", r.lo, r.hi)
+}
+
+// portRangeDialer dials from a port picked at random from ports, and from
+// another one whenever the port picked is already taken.
+type portRangeDialer struct {
+    *net.Dialer
+    ports *portRange
+}
+
+func (d portRangeDialer) Dial(network, addr string) (net.Conn, error) {
+    return d.DialContext(context.Background(), network, addr)
+}
+
+func (d portRangeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    var ip net.IP
+    if local, ok := d.LocalAddr.(*net.TCPAddr); ok {
+        ip = local.IP
+    } else if local, ok := d.LocalAddr.(*net.UDPAddr); ok {
+        ip = local.IP
+    }
+
+    // The ports are tried in turn from a random one, so that no port is
+    // tried twice and a small range is tried in full.
+    size := d.ports.hi - d.ports.lo + 1
+    first := rand.IntN(size)
+    var err error
+    for i := range min(srcPortAttempts, size) {
+        port := d.ports.lo + (first+i)%size
+        bound := *d.Dialer
+        if strings.HasPrefix(network, "udp") {
+            bound.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+        } else {
+            bound.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+        }
+        var conn net.Conn
+        conn, err = bound.DialContext(ctx, network, addr)
+        if err == nil || !portTaken(err) {
+            return conn, err
+        }
+    }
+    return nil, fmt.Errorf("no free source port in SRC_PORT_RANGE %s: %w", d.ports, err)
+}
+
+// portTaken reports whether a dial failed on its source port: bound by
+// another socket, or already connected to the same target.
+func portTaken(err error) bool {
+    return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+func TestSrcPortRange(t *testing.T) {
+    lo := int(closedPort(t))
+    setVar(t, &srcPorts, &portRange{lo: lo, hi: lo + 3})
+    srv := newTestServer(t)
+    // The target answers with the port the connection came from.
+    port := tcpServer(t, func(conn net.Conn) {
+        fmt.Fprint(conn, conn.RemoteAddr().(*net.TCPAddr).Port)
+    })
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, nil))
+    readResponse(t, ws)
+    _, message, err := ws.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var from int
+    fmt.Sscan(string(message), &from)
+    if from < lo || from > lo+3 {
+        t.Errorf("dialed from port %d, want %d-%d", from, lo, lo+3)
+    }
+
+    // A range whose ports are all connected to a target has none left
+    // for it. It is a port of its own, which the session above cannot
+    // still be holding.
+    spare := int(closedPort(t))
+    setVar(t, &srcPorts, &portRange{lo: spare, hi: spare})
+    target := fmt.Sprintf("127.0.0.1:%d", tcpEcho(t))
+    held, err := dialerFor("tcp").Dial("tcp", target)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer held.Close()
+    if conn, err := dialerFor("tcp").Dial("tcp", target); err == nil || !strings.Contains(err.Error(), "no free source port") {
+        t.Errorf("dial with the range used up: got %v, %v", conn, err)
+    }
+
+    for _, v := range []string{"40000", "5-4", "0-10", "1-65536", "a-b"} {
+        if _, err := parsePortRange(v); err == nil {
+            t.Errorf("SRC_PORT_RANGE=%s accepted", v)
+        }
+    }
+    if r, err := parsePortRange(" 40000 - 50000"); err != nil || *r != (portRange{40000, 50000}) {
+        t.Errorf("got %v, %v", r, err)
+    }
+}
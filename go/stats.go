@@ -0,0 +1,143 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// statsPushTimeout bounds one POST to STATS_PUSH_URL.
+const statsPushTimeout = 10 * time.Second
+
+// statsPushURL is the collector that a snapshot of the traffic totals is
+// posted to every statsPushInterval, with statsPushToken as a bearer token
+// when set. No snapshots are pushed when it is empty.
+var (
+    statsPushURL      string
+    statsPushInterval time.Duration
+    statsPushToken    string
+)
+
+// traffic holds the per-user totals served on /stats.
+var traffic = &trafficStats{users: make(map[string]*userTraffic)}
+
+// trafficStats accumulates the bytes proxied for every user label.
+type trafficStats struct {
+    mu    sync.Mutex
+    users map[string]*userTraffic
+}
+
+type userTraffic struct {
+    BytesUp   int64 `json:"bytes_up"`
+    BytesDown int64 `json:"bytes_down"`
+}
+
+// add records traffic for user. Sessions without a user are not recorded.
+func (t *trafficStats) add(user string, up, down int64) {
+    if user == "" {
+        return
+    }
+
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    u := t.users[user]
+    if u == nil {
+        u = &userTraffic{}
+        t.users[user] = u
+    }
+    u.BytesUp += up
+    u.BytesDown += down
+}
+
+// snapshot returns a copy of the current totals.
+func (t *trafficStats) snapshot() map[string]userTraffic {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    users := make(map[string]userTraffic, len(t.users))
+    for user, u := range t.users {
+        users[user] = *u
+    }
+    return users
+}
+
+// handleStats serves the per-user traffic totals to callers presenting
+// STATS_TOKEN as a bearer token.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+    if !validBearerToken(r, statsToken) {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(struct {
+        Users map[string]userTraffic `json:"users"`
+    }{
+        Users: traffic.snapshot(),
+    })
+}
+
+// statsSnapshot is the JSON body posted to STATS_PUSH_URL.
+type statsSnapshot struct {
+    Host              string                 `json:"host"`
+    Time              time.Time              `json:"time"`
+    UptimeSeconds     int64                  `json:"uptime_seconds"`
+    Sessions          int64                  `json:"sessions"`
+    BytesUp           int64                  `json:"bytes_up"`
+    BytesDown         int64                  `json:"bytes_down"`
+    ActiveConnections int64                  `json:"active_connections"`
+    Users             map[string]userTraffic `json:"users"`
+}
+
+// pushStats posts a snapshot to STATS_PUSH_URL every STATS_PUSH_INTERVAL for
+// as long as the server runs. A collector that cannot be reached only costs
+// a warning; the next snapshot is tried on schedule regardless.
+func pushStats() {
+    host, _ := os.Hostname()
+    client := &http.Client{Timeout: statsPushTimeout}
+    for range time.Tick(statsPushInterval) {
+        body, err := json.Marshal(statsSnapshot{
+            Host:              host,
+            Time:              time.Now().UTC(),
+            UptimeSeconds:     int64(time.Since(startTime).Seconds()),
+            Sessions:          sessionsServed.Load(),
+            BytesUp:           totalBytesUp.Load(),
+            BytesDown:         totalBytesDown.Load(),
+            ActiveConnections: activeConnections.Load(),
+            Users:             traffic.snapshot(),
+        })
+        if err != nil {
+            slog.Warn("Failed to encode stats snapshot", "error", err)
+            continue
+        }
+        if err := postStats(client, body); err != nil {
+            slog.Warn("Failed to push stats", "error", err)
+        }
+    }
+}
+
+func postStats(client *http.Client, body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, statsPushURL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if statsPushToken != "" {
+        req.Header.Set("Authorization", "Bearer "+statsPushToken)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("collector returned %s", resp.Status)
+    }
+    return nil
+}
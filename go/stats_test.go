@@ -0,0 +1,125 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// fetchStats returns the totals /stats reports for user.
+func fetchStats(t testing.TB, url, token, user string) (userTraffic, int) {
+    t.Helper()
+    req, _ := http.NewRequest(http.MethodGet, url, nil)
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var body struct {
+        Users map[string]userTraffic `json:"users"`
+    }
+    json.NewDecoder(resp.Body).Decode(&body)
+    return body.Users[user], resp.StatusCode
+}
+
+func TestStats(t *testing.T) {
+    withUsers(t, "carol:44444444-4444-4444-4444-444444444444")
+    carol, _ := parseUUID("44444444-4444-4444-4444-444444444444")
+    setVar(t, &statsToken, "secret")
+    stats := httptest.NewServer(http.HandlerFunc(handleStats))
+    t.Cleanup(stats.Close)
+
+    if _, status := fetchStats(t, stats.URL, "wrong", "carol"); status != http.StatusUnauthorized {
+        t.Errorf("wrong token: got %d", status)
+    }
+    before, _ := fetchStats(t, stats.URL, statsToken, "carol")
+
+    srv := newTestServer(t)
+    payload := strings.Repeat("x", 1000)
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(carol, commandTCP, "127.0.0.1", tcpEcho(t), []byte(payload)))
+    readResponse(t, ws)
+    for n := 0; n < len(payload); {
+        _, message, err := ws.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        n += len(message)
+    }
+
+    // The echo reaches the client just before it is counted.
+    want := userTraffic{BytesUp: before.BytesUp + 1000, BytesDown: before.BytesDown + 1000}
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+        got, _ := fetchStats(t, stats.URL, statsToken, "carol")
+        if got == want {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("got %+v, want %+v", got, want)
+        }
+    }
+}
+
+func TestStatsPush(t *testing.T) {
+    snapshots := make(chan statsSnapshot, 100)
+    var pushes atomic.Int32
+    collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer push-token" {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        // The first push fails, which the server only logs.
+        if pushes.Add(1) == 1 {
+            http.Error(w, "unavailable", http.StatusServiceUnavailable)
+            return
+        }
+        var snapshot statsSnapshot
+        if json.NewDecoder(r.Body).Decode(&snapshot) == nil {
+            snapshots <- snapshot
+        }
+    }))
+    t.Cleanup(collector.Close)
+
+    port := closedPort(t)
+    addr := fmt.Sprintf("127.0.0.1:%d", port)
+    p := startMain(t, addr, fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1",
+        "STATS_PUSH_URL="+collector.URL, "STATS_PUSH_INTERVAL=50ms", "STATS_PUSH_TOKEN=push-token")
+    ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("ping")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    ws.Close()
+
+    // Snapshots keep coming after the failed push, and soon count the
+    // session.
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case s := <-snapshots:
+            if s.Sessions == 1 && s.BytesUp == 4 && s.BytesDown == 4 && len(s.Users) == 1 {
+                if out := p.stop(); !strings.Contains(out, "Failed to push stats") {
+                    t.Errorf("failed push not logged: %s", out)
+                }
+                return
+            }
+        case <-timeout:
+            t.Fatalf("no snapshot counting the session: %s", p.stop())
+        }
+    }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// testCert is a certificate issued for the tests, with its key.
+type testCert struct {
+    cert    *x509.Certificate
+    key     *ecdsa.PrivateKey
+    certPEM []byte
+    keyPEM  []byte
+}
+
+// issueCert issues a certificate for 127.0.0.1 named cn, signed by parent,
+// or self-signed when parent is nil.
+func issueCert(t testing.TB, cn string, parent *testCert, isCA bool) *testCert {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{CommonName: cn},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  isCA,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+    }
+    signer, signerKey := template, key
+    if parent != nil {
+        signer, signerKey = parent.cert, parent.key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+    keyDER, _ := x509.MarshalECPrivateKey(key)
+    return &testCert{
+        cert:    cert,
+        key:     key,
+        certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+        keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+    }
+}
+
+// serveTLS serves handler over TLS with cert, the way serve does with
+// TLS_CERT and TLS_KEY, and returns the address it listens on.
+func serveTLS(t testing.TB, cert *testCert, handler http.Handler) string {
+    t.Helper()
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    os.WriteFile(certFile, cert.certPEM, 0o600)
+    os.WriteFile(keyFile, cert.keyPEM, 0o600)
+    savedCert, savedKey := tlsCert, tlsKey
+    tlsCert, tlsKey = certFile, keyFile
+    t.Cleanup(func() { tlsCert, tlsKey = savedCert, savedKey })
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := &http.Server{Handler: handler}
+    go serve(srv, ln)
+    t.Cleanup(func() { srv.Close() })
+    return ln.Addr().String()
+}
+
+func TestTLS(t *testing.T) {
+    cert := issueCert(t, "server", nil, false)
+    addr := serveTLS(t, cert, http.HandlerFunc(handleRequest))
+
+    roots := x509.NewCertPool()
+    roots.AddCert(cert.cert)
+    d := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+    ws, _, err := d.Dial("wss://"+addr+"/", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("secure")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "secure" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+
+    // A client that does not trust the certificate is refused.
+    if _, _, err := websocket.DefaultDialer.Dial("wss://"+addr+"/", nil); err == nil {
+        t.Error("handshake with an untrusted certificate succeeded")
+    }
+}
+
+func TestClientCert(t *testing.T) {
+    ca := issueCert(t, "client ca", nil, true)
+    pool := x509.NewCertPool()
+    pool.AddCert(ca.cert)
+    setVar(t, &tlsClientCAs, pool)
+    logs := captureLogs(t)
+    cert := issueCert(t, "server", nil, false)
+    addr := serveTLS(t, cert, http.HandlerFunc(handleRequest))
+
+    roots := x509.NewCertPool()
+    roots.AddCert(cert.cert)
+    dial := func(client *testCert) (*websocket.Conn, error) {
+        config := &tls.Config{RootCAs: roots}
+        if client != nil {
+            config.Certificates = []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}}
+        }
+        d := websocket.Dialer{TLSClientConfig: config}
+        ws, _, err := d.Dial("wss://"+addr+"/", nil)
+        return ws, err
+    }
+
+    ws, err := dial(issueCert(t, "alice", ca, false))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+    ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", tcpEcho(t), []byte("ping")))
+    readResponse(t, ws)
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+    if record := logs.wait(t, "New WebSocket connection established"); record["client_cert"] != "CN=alice" {
+        t.Errorf("client_cert: got %v", record["client_cert"])
+    }
+
+    // A certificate the CA did not sign, or none at all, is refused.
+    for name, client := range map[string]*testCert{"unsigned": issueCert(t, "mallory", nil, false), "none": nil} {
+        if ws, err := dial(client); err == nil {
+            ws.Close()
+            t.Errorf("%s client certificate accepted", name)
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "net"
+    "strconv"
+)
+
+// trojanKeyLen is the length of the hex SHA-224 of the password that opens
+// a Trojan request.
+const trojanKeyLen = 56
+
+// trojanKey is the hex SHA-224 of TROJAN_PASSWORD, or nil when Trojan is
+// disabled.
+var trojanKey []byte
+
+func newTrojanKey(password string) []byte {
+    sum := sha256.Sum224([]byte(password))
+    return []byte(hex.EncodeToString(sum[:]))
+}
+
+// isTrojanRequest reports whether message starts a Trojan request rather
+// than a VLESS one. Both are served on WS_PATH; a Trojan request is told
+// apart by its shape, a hex password hash followed by CRLF, so that any
+// other message, such as a VLESS request with an unsupported version, is
+// refused as VLESS.
+func isTrojanRequest(message []byte) bool {
+    if trojanKey == nil || len(message) < trojanKeyLen+2 {
+        return false
+    }
+    for _, c := range message[:trojanKeyLen] {
+        if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+            return false
+        }
+    }
+    return bytes.Equal(message[trojanKeyLen:trojanKeyLen+2], []byte("\r\n"))
+}
+
+// handleTrojanRequest handles a Trojan request: the hex password hash and
+// CRLF, then a command, a SOCKS5 address, a port and another CRLF, followed
+// by the initial data. Trojan has no response header.
+func handleTrojanRequest(wsConn *clientConn, message []byte, logger *slog.Logger) error {
+    if len(message) < trojanKeyLen+2 {
+        return newProxyError(closeMalformedHeader, errShortHeader)
+    }
+    if subtle.ConstantTimeCompare(message[:trojanKeyLen], trojanKey) != 1 {
+        authFailures.Inc()
+        return fmt.Errorf("%w: invalid Trojan password", errAuthFailed)
+    }
+    sess := newSession("trojan", logger)
+
+    i := trojanKeyLen + 2
+    if len(message) < i+2 {
+        return newProxyError(closeMalformedHeader, fmt.Errorf("%w for command", errShortHeader))
+    }
+
+    command, atyp := message[i], message[i+1]
+    i += 2
+    switch command {
+    case socks5CommandConnect:
+    case 3:
+        return newProxyError(closeBadCommand, fmt.Errorf("UDP over Trojan is not supported"))
+    default:
+        return newProxyError(closeBadCommand, fmt.Errorf("unknown command %d", command))
+    }
+
+    var host string
+    switch atyp {
+    case socks5AddrIPv4, socks5AddrIPv6:
+        n := net.IPv4len
+        if atyp == socks5AddrIPv6 {
+            n = net.IPv6len
+        }
+        if len(message) < i+n {
+            return newProxyError(closeMalformedHeader, fmt.Errorf("%w for address", errShortHeader))
+        }
+        host = net.IP(message[i : i+n]).String()
+        i += n
+    case socks5AddrDomain:
+        if len(message) < i+1 || len(message) < i+1+int(message[i]) {
+            return newProxyError(closeMalformedHeader, fmt.Errorf("%w for domain name", errShortHeader))
+        }
+        host = normalizeHost(string(message[i+1 : i+1+int(message[i])]))
+        i += 1 + int(message[i])
+    default:
+        return malformedHeader("unknown address type")
+    }
+
+    if len(message) < i+4 {
+        return newProxyError(closeMalformedHeader, fmt.Errorf("%w for port", errShortHeader))
+    }
+    targetPort := binary.BigEndian.Uint16(message[i : i+2])
+    if !bytes.Equal(message[i+2:i+4], []byte("\r\n")) {
+        return malformedHeader("missing CRLF after Trojan request")
+    }
+    i += 4
+    if targetPort == 0 {
+        logger.Warn("Target port 0 rejected")
+        return newProxyError(closeBadCommand, fmt.Errorf("target port 0 is not valid"))
+    }
+
+    logger.Debug("Connection details", hostAttr("host", host), "port", targetPort, "atyp", atyp, "command", command, "protocol", "trojan")
+
+    sess.target = net.JoinHostPort(host, strconv.Itoa(int(targetPort)))
+    target, err := checkTarget(host, targetPort, logger)
+    if err != nil {
+        return err
+    }
+    sess.route = target.route
+
+    return proxyTCP(clientSide{
+        conn:    wsConn,
+        initial: message[i:],
+        up:      &wsStream{conn: wsConn},
+        down:    &wsStream{conn: wsConn},
+        respond: func() error { return nil },
+    }, target.ips, target.port, sess)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+// trojanTestRequest builds a Trojan request authenticated with password
+// for a TCP session to 127.0.0.1:port, carrying payload.
+func trojanTestRequest(password string, port uint16, payload string) []byte {
+    m := append(newTrojanKey(password), "\r\n"...)
+    m = append(m, socks5CommandConnect, socks5AddrIPv4, 127, 0, 0, 1)
+    m = binary.BigEndian.AppendUint16(m, port)
+    return append(append(m, "\r\n"...), payload...)
+}
+
+func TestTrojan(t *testing.T) {
+    setVar(t, &trojanKey, newTrojanKey("secret"))
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+
+    ws := dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, trojanTestRequest("secret", port, "ping"))
+    if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+        t.Fatalf("got %q, %v", message, err)
+    }
+
+    // VLESS still works beside Trojan.
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("ping")))
+    readResponse(t, ws)
+
+    ws = dialProxy(t, srv, "/")
+    ws.WriteMessage(websocket.BinaryMessage, trojanTestRequest("wrong", port, "ping"))
+    if _, message, err := ws.ReadMessage(); err == nil {
+        t.Errorf("wrong password accepted, got %q", message)
+    }
+}
+
+func TestIsTrojanRequest(t *testing.T) {
+    setVar(t, &trojanKey, newTrojanKey("secret"))
+    request := trojanTestRequest("secret", 80, "")
+    for name, tc := range map[string]struct {
+        message []byte
+        want    bool
+    }{
+        "trojan":          {request, true},
+        "other password":  {trojanTestRequest("other", 80, ""), true},
+        "vless":           {testRequest(testUser, commandTCP, "127.0.0.1", 80, nil), false},
+        "vless version 1": {append([]byte{1}, testRequest(testUser, commandTCP, "127.0.0.1", 80, nil)[1:]...), false},
+        "no CRLF":         {append(bytes.Clone(request[:trojanKeyLen]), "\n\n"...), false},
+        "not hex":         {append(bytes.Repeat([]byte("x"), trojanKeyLen), "\r\n"...), false},
+        "short":           {request[:trojanKeyLen], false},
+    } {
+        if got := isTrojanRequest(tc.message); got != tc.want {
+            t.Errorf("%s: got %v", name, got)
+        }
+    }
+
+    setVar(t, &trojanKey, nil)
+    if isTrojanRequest(request) {
+        t.Error("Trojan request recognized with Trojan off")
+    }
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "golang.org/x/net/proxy"
+)
+
+// Dialer opens connections to targets. A *net.Dialer dials them directly;
+// the dialers returned by newUpstreamDialer reach them through another
+// proxy, which turns this server into one hop of a chain.
+type Dialer interface {
+    DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// forwardDialer reaches the upstream proxy or instance itself: a
+// *net.Dialer, a portRangeDialer with SRC_PORT_RANGE, or with POOL_IDLE the
+// dialPool in front of either.
+type forwardDialer interface {
+    Dialer
+    Dial(network, addr string) (net.Conn, error)
+}
+
+// upstreamDialer is the proxy set by UPSTREAM_PROXY or UPSTREAM_WS that TCP
+// targets are dialed through, or nil when they are dialed directly.
+var upstreamDialer Dialer
+
+// newUpstreamDialer returns a dialer for the proxy at rawURL, either
+// socks5://[user:pass@]host:port or http://[user:pass@]host:port. The
+// proxy itself is reached with forward, so DIAL_TIMEOUT and OUTBOUND_IP
+// still apply.
+func newUpstreamDialer(rawURL string, forward forwardDialer) (Dialer, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Port() == "" {
+        return nil, fmt.Errorf("missing port")
+    }
+
+    switch u.Scheme {
+    case "socks5", "socks5h":
+        var auth *proxy.Auth
+        if u.User != nil {
+            password, _ := u.User.Password()
+            auth = &proxy.Auth{User: u.User.Username(), Password: password}
+        }
+        d, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+        if err != nil {
+            return nil, err
+        }
+        return d.(proxy.ContextDialer), nil
+    case "http":
+        d := &httpConnectDialer{addr: u.Host, forward: forward}
+        if u.User != nil {
+            password, _ := u.User.Password()
+            d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+        }
+        return d, nil
+    default:
+        return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+    }
+}
+
+// httpConnectDialer reaches targets through an HTTP proxy by sending it a
+// CONNECT request for each of them.
+type httpConnectDialer struct {
+    addr    string
+    auth    string
+    forward forwardDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+    if err != nil {
+        return nil, err
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    req := &http.Request{
+        Method: http.MethodConnect,
+        URL:    &url.URL{Opaque: addr},
+        Host:   addr,
+        Header: make(http.Header),
+    }
+    if d.auth != "" {
+        req.Header.Set("Proxy-Authorization", d.auth)
+    }
+    if err := req.Write(conn); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("upstream proxy: %w", err)
+    }
+
+    br := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(br, req)
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("upstream proxy: %w", err)
+    }
+    // The body of a successful response is the tunnel itself, so it is
+    // never closed here.
+    if resp.StatusCode != http.StatusOK {
+        conn.Close()
+        return nil, fmt.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+    }
+    conn.SetDeadline(time.Time{})
+
+    // A target that speaks first may already have sent data that br read
+    // along with the response.
+    if br.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, r: br}, nil
+    }
+    return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.r.Read(p)
+}
+
+// wsUpstreamDialer reaches targets through another instance of this server,
+// sending it a VLESS request over a new WebSocket for each connection. The
+// instance dials the target itself, so the two form a two-hop relay.
+type wsUpstreamDialer struct {
+    url    string
+    id     [16]byte
+    dialer websocket.Dialer
+}
+
+// newWSUpstreamDialer returns a dialer for the instance at the ws:// or
+// wss:// rawURL, authenticating with uuid. The instance itself is reached
+// with forward, and the WebSocket handshake bounded by DIAL_TIMEOUT.
+func newWSUpstreamDialer(rawURL, uuid string, forward forwardDialer) (Dialer, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "ws" && u.Scheme != "wss" {
+        return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+    }
+    id, err := parseUUID(uuid)
+    if err != nil {
+        return nil, fmt.Errorf("invalid UPSTREAM_UUID: %w", err)
+    }
+    return &wsUpstreamDialer{
+        url: rawURL,
+        id:  id,
+        dialer: websocket.Dialer{
+            NetDialContext:   forward.DialContext,
+            HandshakeTimeout: dialer.Timeout,
+        },
+    }, nil
+}
+
+func (d *wsUpstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    port, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil {
+        return nil, fmt.Errorf("invalid port %q", portStr)
+    }
+
+    ws, _, err := d.dialer.DialContext(ctx, d.url, nil)
+    if err != nil {
+        return nil, fmt.Errorf("upstream instance: %w", err)
+    }
+    conn := &wsNetConn{clientConn: &clientConn{Conn: ws}}
+    conn.stream.conn = conn.clientConn
+
+    if deadline, ok := ctx.Deadline(); ok {
+        ws.SetReadDeadline(deadline)
+    }
+    if err := writeData(conn.clientConn, vlessRequest(d.id, host, uint16(port))); err != nil {
+        ws.Close()
+        return nil, fmt.Errorf("upstream instance: %w", err)
+    }
+
+    // The instance only responds once it has connected to the target, and
+    // closes the WebSocket with the reason when it cannot.
+    var resp [2]byte
+    if _, err := io.ReadFull(&conn.stream, resp[:]); err != nil {
+        ws.Close()
+        return nil, fmt.Errorf("upstream instance: %w", err)
+    }
+    if _, err := io.CopyN(io.Discard, &conn.stream, int64(resp[1])); err != nil {
+        ws.Close()
+        return nil, fmt.Errorf("upstream instance: %w", err)
+    }
+    ws.SetReadDeadline(time.Time{})
+    return conn, nil
+}
+
+// vlessRequest encodes the header of a VLESS TCP request for host and port.
+func vlessRequest(id [16]byte, host string, port uint16) []byte {
+    b := append([]byte{0}, id[:]...)
+    b = append(b, 0, commandTCP)
+    b = binary.BigEndian.AppendUint16(b, port)
+    ip := net.ParseIP(host)
+    switch {
+    case ip.To4() != nil:
+        b = append(b, 1)
+        b = append(b, ip.To4()...)
+    case ip != nil:
+        b = append(b, 3)
+        b = append(b, ip...)
+    default:
+        b = append(b, 2, byte(len(host)))
+        b = append(b, host...)
+    }
+    return b
+}
+
+// wsNetConn is a WebSocket connection to an upstream instance used as the
+// target connection of a session.
+type wsNetConn struct {
+    *clientConn
+    stream wsStream
+}
+
+// Read returns io.EOF once the instance has closed the WebSocket normally,
+// which it does once the target has finished.
+func (c *wsNetConn) Read(p []byte) (int, error) {
+    n, err := c.stream.Read(p)
+    if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+        err = io.EOF
+    }
+    return n, err
+}
+
+func (c *wsNetConn) Write(p []byte) (int, error) {
+    return c.stream.Write(p)
+}
+
+// CloseWrite passes a half-close on to the instance as a normal close
+// frame. The instance forwards it to the target and keeps sending the rest
+// of the target's data.
+func (c *wsNetConn) CloseWrite() error {
+    return c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+func (c *wsNetConn) SetDeadline(t time.Time) error {
+    c.SetReadDeadline(t)
+    return c.SetWriteDeadline(t)
+}
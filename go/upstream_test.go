@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/websocket"
+)
+
+// socks5Upstream starts a SOCKS5 server that takes no authentication and
+// CONNECTs to IPv4 targets, sending every target it is asked for to
+// targets, and returns its address. It dials on its own rather than
+// through this server's dialer, which the tests point at it.
+func socks5Upstream(t testing.TB, targets chan<- string) string {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                b := make([]byte, 10)
+                if _, err := io.ReadFull(conn, b[:3]); err != nil {
+                    return
+                }
+                conn.Write([]byte{socks5Version, socks5AuthNone})
+                if _, err := io.ReadFull(conn, b); err != nil || b[3] != socks5AddrIPv4 {
+                    return
+                }
+                target := net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(b[8:]))))
+                targets <- target
+                up, err := net.Dial("tcp", target)
+                if err != nil {
+                    return
+                }
+                defer up.Close()
+                conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+                go io.Copy(up, conn)
+                io.Copy(conn, up)
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+// connectUpstream starts an HTTP proxy that answers CONNECT requests,
+// sending every target it is asked for to targets.
+func connectUpstream(t testing.TB, targets chan<- string) string {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        targets <- r.Host
+        up, err := net.Dial("tcp", r.Host)
+        if err != nil {
+            w.WriteHeader(http.StatusBadGateway)
+            return
+        }
+        defer up.Close()
+        conn, _, err := w.(http.Hijacker).Hijack()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+        go io.Copy(up, conn)
+        io.Copy(conn, up)
+    }))
+    t.Cleanup(srv.Close)
+    return srv.Listener.Addr().String()
+}
+
+func TestUpstreamProxy(t *testing.T) {
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    target := fmt.Sprintf("127.0.0.1:%d", port)
+
+    targets := make(chan string, 1)
+    for _, url := range []string{
+        "socks5://" + socks5Upstream(t, targets),
+        "http://" + connectUpstream(t, targets),
+    } {
+        d, err := newUpstreamDialer(url, dialer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        setVar(t, &upstreamDialer, d)
+
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", port, []byte("ping")))
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+            t.Errorf("%s: got %q, %v", url, message, err)
+        }
+        select {
+        case got := <-targets:
+            if got != target {
+                t.Errorf("%s: upstream asked for %s, want %s", url, got, target)
+            }
+        default:
+            t.Errorf("%s: session did not go through the upstream", url)
+        }
+    }
+
+    if _, err := newUpstreamDialer("ftp://127.0.0.1:21", dialer); err == nil {
+        t.Error("unsupported scheme accepted")
+    }
+}
+
+// TestUpstreamInstance chains this server through a second instance of it,
+// running in a child process, with UPSTREAM_WS.
+func TestUpstreamInstance(t *testing.T) {
+    const upstreamUUID = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+    port := closedPort(t)
+    upstream := startMain(t, fmt.Sprintf("127.0.0.1:%d", port),
+        fmt.Sprintf("PORT=%d", port), "BIND_ADDR=127.0.0.1", "ALLOW_PRIVATE=1", "UUID="+upstreamUUID)
+    srv := newTestServer(t)
+    echo := tcpEcho(t)
+
+    for _, uuid := range []string{defaultUUID, upstreamUUID} {
+        d, err := newWSUpstreamDialer(fmt.Sprintf("ws://127.0.0.1:%d/", port), uuid, dialer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        setVar(t, &upstreamDialer, d)
+
+        ws := dialProxy(t, srv, "/")
+        ws.WriteMessage(websocket.BinaryMessage, testRequest(testUser, commandTCP, "127.0.0.1", echo, []byte("ping")))
+        if uuid != upstreamUUID {
+            if _, _, err := ws.ReadMessage(); err == nil {
+                t.Error("upstream instance accepted a UUID it does not know")
+            }
+            continue
+        }
+        readResponse(t, ws)
+        if _, message, err := ws.ReadMessage(); err != nil || string(message) != "ping" {
+            t.Errorf("got %q, %v", message, err)
+        }
+        ws.Close()
+    }
+
+    if out := upstream.stop(); !strings.Contains(out, fmt.Sprintf(`"target":"127.0.0.1:%d"`, echo)) {
+        t.Errorf("upstream instance did not serve the session: %s", out)
+    }
+}
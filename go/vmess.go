@@ -0,0 +1,472 @@
+package main
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/sha3"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash"
+    "hash/crc32"
+    "hash/fnv"
+    "io"
+    "log/slog"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/chacha20poly1305"
+)
+
+// VMess AEAD request header layout: the encrypted auth ID, the encrypted
+// header length, the connection nonce, then the encrypted header itself.
+const (
+    vmessAuthIDLen   = 16
+    vmessNonceLen    = 8
+    vmessPreambleLen = vmessAuthIDLen + 2 + 16 + vmessNonceLen
+)
+
+// vmessMaxTimeDiff is how far the timestamp in an auth ID may be from the
+// server's clock. Auth IDs are also remembered for twice as long so that a
+// captured request cannot be replayed.
+const vmessMaxTimeDiff = 120 * time.Second
+
+// Security types and options of a VMess request.
+const (
+    vmessSecurityAES128GCM        = 3
+    vmessSecurityChaCha20Poly1305 = 4
+    vmessSecurityNone             = 5
+
+    vmessOptionChunkStream         = 0x01
+    vmessOptionChunkMasking        = 0x04
+    vmessOptionGlobalPadding       = 0x08
+    vmessOptionAuthenticatedLength = 0x10
+)
+
+// vmessMaxChunk is the largest payload sent to the client in one chunk.
+const vmessMaxChunk = 16 * 1024
+
+// vmessUser is a configured user with the keys VMess derives from its UUID.
+type vmessUser struct {
+    label  string
+    cmdKey []byte
+    authID cipher.Block
+}
+
+var (
+    vmessUsers []vmessUser
+    vmessSeen  = &authIDFilter{seen: make(map[[vmessAuthIDLen]byte]time.Time)}
+)
+
+// newVMessUsers derives the VMess keys of every user.
+func newVMessUsers(users map[[16]byte]string) []vmessUser {
+    var list []vmessUser
+    for id, label := range users {
+        sum := md5.Sum(append(id[:], "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+        block, _ := aes.NewCipher(vmessKDF(sum[:], "AES Auth ID Encryption")[:16])
+        list = append(list, vmessUser{label: label, cmdKey: sum[:], authID: block})
+    }
+    return list
+}
+
+// vmessKDF is the VMess AEAD key derivation: HMAC-SHA256 keyed with
+// "VMess AEAD KDF", nested once more for every element of path.
+func vmessKDF(key []byte, path ...string) []byte {
+    newHash := func() hash.Hash { return hmac.New(sha256.New, []byte("VMess AEAD KDF")) }
+    for _, p := range path {
+        parent := newHash
+        newHash = func() hash.Hash { return hmac.New(parent, []byte(p)) }
+    }
+    h := newHash()
+    h.Write(key)
+    return h.Sum(nil)
+}
+
+func newGCM(key []byte) cipher.AEAD {
+    block, _ := aes.NewCipher(key)
+    aead, _ := cipher.NewGCM(block)
+    return aead
+}
+
+// authIDFilter remembers recently used auth IDs.
+type authIDFilter struct {
+    mu   sync.Mutex
+    seen map[[vmessAuthIDLen]byte]time.Time
+}
+
+// add records id and reports whether it was new.
+func (f *authIDFilter) add(id [vmessAuthIDLen]byte) bool {
+    now := time.Now()
+
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    for old, expires := range f.seen {
+        if !now.Before(expires) {
+            delete(f.seen, old)
+        }
+    }
+    if _, ok := f.seen[id]; ok {
+        return false
+    }
+    f.seen[id] = now.Add(2 * vmessMaxTimeDiff)
+    return true
+}
+
+// vmessAuthenticate finds the user whose key decrypts authID to a valid,
+// current auth ID. It does not check for replays: handleVMessRequest adds
+// the auth ID to vmessSeen once the whole header has arrived.
+func vmessAuthenticate(authID []byte) (*vmessUser, bool) {
+    var plain [vmessAuthIDLen]byte
+    for i := range vmessUsers {
+        u := &vmessUsers[i]
+        u.authID.Decrypt(plain[:], authID)
+        if binary.BigEndian.Uint32(plain[12:]) != crc32.ChecksumIEEE(plain[:12]) {
+            continue
+        }
+        diff := time.Since(time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0))
+        if diff > vmessMaxTimeDiff || diff < -vmessMaxTimeDiff {
+            return nil, false
+        }
+        return u, true
+    }
+    return nil, false
+}
+
+// vmessRequest is a decrypted VMess request header.
+type vmessRequest struct {
+    bodyIV, bodyKey []byte
+    respAuth        byte
+    option          byte
+    security        byte
+    command         byte
+    host            string
+    port            uint16
+}
+
+// handleVMessRequest handles a VMess request arriving on VMESS_PATH. It
+// produces the same target as a VLESS request and shares its TCP backend.
+func handleVMessRequest(wsConn *clientConn, message []byte, logger *slog.Logger) error {
+    if len(message) < vmessPreambleLen {
+        return newProxyError(closeMalformedHeader, errShortHeader)
+    }
+
+    authID := message[:vmessAuthIDLen]
+    user, ok := vmessAuthenticate(authID)
+    if !ok {
+        authFailures.Inc()
+        return fmt.Errorf("%w: invalid VMess auth ID", errAuthFailed)
+    }
+    sess := newSession(user.label, logger)
+
+    nonce := string(message[vmessAuthIDLen+18 : vmessPreambleLen])
+    lengthAEAD := newGCM(vmessKDF(user.cmdKey, "VMess Header AEAD Key_Length", string(authID), nonce)[:16])
+    length, err := lengthAEAD.Open(nil,
+        vmessKDF(user.cmdKey, "VMess Header AEAD Nonce_Length", string(authID), nonce)[:12],
+        message[vmessAuthIDLen:vmessAuthIDLen+18], authID)
+    if err != nil {
+        return malformedHeader("VMess header length does not decrypt")
+    }
+
+    end := vmessPreambleLen + int(binary.BigEndian.Uint16(length)) + 16
+    if len(message) < end {
+        return newProxyError(closeMalformedHeader, fmt.Errorf("%w for VMess header", errShortHeader))
+    }
+    headerAEAD := newGCM(vmessKDF(user.cmdKey, "VMess Header AEAD Key", string(authID), nonce)[:16])
+    header, err := headerAEAD.Open(nil,
+        vmessKDF(user.cmdKey, "VMess Header AEAD Nonce", string(authID), nonce)[:12],
+        message[vmessPreambleLen:end], authID)
+    if err != nil {
+        return malformedHeader("VMess header does not decrypt")
+    }
+    if !vmessSeen.add([vmessAuthIDLen]byte(authID)) {
+        authFailures.Inc()
+        return fmt.Errorf("%w: replayed VMess auth ID", errAuthFailed)
+    }
+
+    req, err := parseVMessHeader(header)
+    if err != nil {
+        return newProxyError(closeMalformedHeader, err)
+    }
+
+    switch req.command {
+    case commandTCP:
+    case commandUDP:
+        return newProxyError(closeBadCommand, fmt.Errorf("UDP over VMess is not supported"))
+    case commandMux:
+        return newProxyError(closeBadCommand, fmt.Errorf("mux command is not supported"))
+    default:
+        return newProxyError(closeBadCommand, fmt.Errorf("unknown command %d", req.command))
+    }
+    if req.port == 0 {
+        logger.Warn("Target port 0 rejected")
+        return newProxyError(closeBadCommand, fmt.Errorf("target port 0 is not valid"))
+    }
+
+    logger.Debug("Connection details", "user", user.label, hostAttr("host", req.host), "port", req.port, "command", req.command, "protocol", "vmess")
+
+    up, down, err := vmessStreams(req, io.MultiReader(bytes.NewReader(message[end:]), &wsStream{conn: wsConn}), &wsStream{conn: wsConn})
+    if err != nil {
+        return newProxyError(closeBadCommand, err)
+    }
+
+    sess.target = net.JoinHostPort(req.host, strconv.Itoa(int(req.port)))
+    target, err := checkTarget(req.host, req.port, logger)
+    if err != nil {
+        return err
+    }
+    sess.route = target.route
+
+    return proxyTCP(clientSide{
+        conn:    wsConn,
+        up:      up,
+        down:    down,
+        respond: func() error { return writeVMessResponse(wsConn, req) },
+    }, target.ips, target.port, sess)
+}
+
+// parseVMessHeader parses a decrypted request header: version, body IV and
+// key, response auth, option, padding length and security, a reserved byte,
+// command, port, address, padding and an FNV-1a checksum.
+func parseVMessHeader(b []byte) (*vmessRequest, error) {
+    if len(b) < 41+4 {
+        return nil, errors.New("VMess header too short")
+    }
+    sum := fnv.New32a()
+    sum.Write(b[:len(b)-4])
+    if sum.Sum32() != binary.BigEndian.Uint32(b[len(b)-4:]) {
+        return nil, errors.New("VMess header checksum mismatch")
+    }
+    if b[0] != 1 {
+        return nil, fmt.Errorf("unsupported VMess version %d", b[0])
+    }
+
+    req := &vmessRequest{
+        bodyIV:   b[1:17],
+        bodyKey:  b[17:33],
+        respAuth: b[33],
+        option:   b[34],
+        security: b[35] & 0x0f,
+        command:  b[37],
+        port:     binary.BigEndian.Uint16(b[38:40]),
+    }
+    padding := int(b[35] >> 4)
+
+    rest := b[41 : len(b)-4]
+    switch b[40] {
+    case 1:
+        if len(rest) < 4 {
+            return nil, errors.New("VMess header too short for IPv4")
+        }
+        req.host, rest = net.IP(rest[:4]).String(), rest[4:]
+    case 2:
+        if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+            return nil, errors.New("VMess header too short for domain name")
+        }
+        req.host, rest = normalizeHost(string(rest[1:1+int(rest[0])])), rest[1+int(rest[0]):]
+    case 3:
+        if len(rest) < 16 {
+            return nil, errors.New("VMess header too short for IPv6")
+        }
+        req.host, rest = net.IP(rest[:16]).String(), rest[16:]
+    default:
+        return nil, errors.New("unknown address type")
+    }
+    if len(rest) != padding {
+        return nil, errors.New("VMess header has trailing data")
+    }
+    return req, nil
+}
+
+// vmessStreams returns the decoder of the client's body and the encoder of
+// the response body for req's security type and options.
+func vmessStreams(req *vmessRequest, r io.Reader, w io.Writer) (io.Reader, io.Writer, error) {
+    if req.option&vmessOptionAuthenticatedLength != 0 {
+        return nil, nil, errors.New("VMess authenticated length is not supported")
+    }
+
+    respKey := sha256.Sum256(req.bodyKey)
+    respIV := sha256.Sum256(req.bodyIV)
+
+    var reqAEAD, respAEAD cipher.AEAD
+    switch req.security {
+    case vmessSecurityAES128GCM:
+        reqAEAD, respAEAD = newGCM(req.bodyKey), newGCM(respKey[:16])
+    case vmessSecurityChaCha20Poly1305:
+        reqAEAD, _ = chacha20poly1305.New(chachaKey(req.bodyKey))
+        respAEAD, _ = chacha20poly1305.New(chachaKey(respKey[:16]))
+    case vmessSecurityNone:
+    default:
+        return nil, nil, fmt.Errorf("unsupported VMess security type %d", req.security)
+    }
+
+    if req.option&vmessOptionChunkStream == 0 {
+        if req.security != vmessSecurityNone {
+            return nil, nil, errors.New("VMess without chunk stream is only supported with no security")
+        }
+        return r, w, nil
+    }
+    return &vmessReader{r: r, chunks: newVMessChunks(req, reqAEAD, req.bodyIV)},
+        &vmessWriter{w: w, chunks: newVMessChunks(req, respAEAD, respIV[:16])}, nil
+}
+
+func chachaKey(key []byte) []byte {
+    first := md5.Sum(key)
+    second := md5.Sum(first[:])
+    return append(first[:], second[:]...)
+}
+
+// vmessChunks holds the state one direction of a chunk stream shares
+// between its chunks: the AEAD and nonce counter, and the SHAKE128 stream
+// that masks the chunk sizes and picks their padding.
+type vmessChunks struct {
+    aead    cipher.AEAD
+    nonce   []byte
+    count   uint16
+    shake   *sha3.SHAKE
+    padding bool
+}
+
+func newVMessChunks(req *vmessRequest, aead cipher.AEAD, iv []byte) *vmessChunks {
+    c := &vmessChunks{aead: aead, nonce: append([]byte(nil), iv...)}
+    if req.option&vmessOptionChunkMasking != 0 {
+        c.shake = sha3.NewSHAKE128()
+        c.shake.Write(iv)
+        // Plain chunks carry no padding, whatever the option says.
+        c.padding = aead != nil && req.option&vmessOptionGlobalPadding != 0
+    }
+    return c
+}
+
+func (c *vmessChunks) next() uint16 {
+    var b [2]byte
+    c.shake.Read(b[:])
+    return binary.BigEndian.Uint16(b[:])
+}
+
+// sizes returns the padding length of the next chunk and the mask of its
+// size, in the order VMess draws them.
+func (c *vmessChunks) sizes() (padding int, mask uint16) {
+    if c.shake == nil {
+        return 0, 0
+    }
+    if c.padding {
+        padding = int(c.next() % 64)
+    }
+    return padding, c.next()
+}
+
+func (c *vmessChunks) overhead() int {
+    if c.aead == nil {
+        return 0
+    }
+    return c.aead.Overhead()
+}
+
+func (c *vmessChunks) nextNonce() []byte {
+    binary.BigEndian.PutUint16(c.nonce, c.count)
+    c.count++
+    return c.nonce[:c.aead.NonceSize()]
+}
+
+// vmessReader decodes the client's chunked body. An empty chunk marks the
+// end of the client's data and reads as io.EOF.
+type vmessReader struct {
+    r      io.Reader
+    chunks *vmessChunks
+    buf    []byte
+}
+
+func (r *vmessReader) Read(p []byte) (int, error) {
+    for len(r.buf) == 0 {
+        var sizeBytes [2]byte
+        if _, err := io.ReadFull(r.r, sizeBytes[:]); err != nil {
+            return 0, err
+        }
+        padding, mask := r.chunks.sizes()
+        size := int(binary.BigEndian.Uint16(sizeBytes[:]) ^ mask)
+        if size < padding+r.chunks.overhead() {
+            return 0, errors.New("invalid VMess chunk size")
+        }
+
+        chunk := make([]byte, size)
+        if _, err := io.ReadFull(r.r, chunk); err != nil {
+            return 0, err
+        }
+        payload := chunk[:size-padding]
+        if size-padding == r.chunks.overhead() {
+            return 0, io.EOF
+        }
+        if r.chunks.aead != nil {
+            plain, err := r.chunks.aead.Open(payload[:0], r.chunks.nextNonce(), payload, nil)
+            if err != nil {
+                return 0, fmt.Errorf("VMess chunk does not decrypt: %w", err)
+            }
+            payload = plain
+        }
+        r.buf = payload
+    }
+
+    n := copy(p, r.buf)
+    r.buf = r.buf[n:]
+    return n, nil
+}
+
+// vmessWriter encodes the response body, sending every chunk as one message.
+type vmessWriter struct {
+    w      io.Writer
+    chunks *vmessChunks
+}
+
+func (w *vmessWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := min(len(p), vmessMaxChunk)
+        padding, mask := w.chunks.sizes()
+
+        chunk := make([]byte, 2, 2+n+w.chunks.overhead()+padding)
+        if w.chunks.aead != nil {
+            chunk = w.chunks.aead.Seal(chunk, w.chunks.nextNonce(), p[:n], nil)
+        } else {
+            chunk = append(chunk, p[:n]...)
+        }
+        pad := make([]byte, padding)
+        rand.Read(pad)
+        chunk = append(chunk, pad...)
+        binary.BigEndian.PutUint16(chunk, uint16(len(chunk)-2)^mask)
+
+        if _, err := w.w.Write(chunk); err != nil {
+            return written, err
+        }
+        written += n
+        p = p[n:]
+    }
+    return written, nil
+}
+
+// writeVMessResponse sends the AEAD response header: the response auth and
+// an empty option and command, encrypted with keys derived from the
+// response body key and IV.
+func writeVMessResponse(wsConn *clientConn, req *vmessRequest) error {
+    respKey := sha256.Sum256(req.bodyKey)
+    respIV := sha256.Sum256(req.bodyIV)
+    header := []byte{req.respAuth, 0, 0, 0}
+
+    lengthAEAD := newGCM(vmessKDF(respKey[:16], "AEAD Resp Header Len Key")[:16])
+    out := lengthAEAD.Seal(nil, vmessKDF(respIV[:16], "AEAD Resp Header Len IV")[:12],
+        binary.BigEndian.AppendUint16(nil, uint16(len(header))), nil)
+    headerAEAD := newGCM(vmessKDF(respKey[:16], "AEAD Resp Header Key")[:16])
+    out = headerAEAD.Seal(out, vmessKDF(respIV[:16], "AEAD Resp Header IV")[:12], header, nil)
+
+    if err := writeData(wsConn, out); err != nil {
+        return fmt.Errorf("failed to send response: %w", err)
+    }
+    return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "crypto/aes"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "hash/crc32"
+    "hash/fnv"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// vmessTestRequest encrypts a VMess AEAD request for a TCP session to
+// host:port as id, with an AES-128-GCM chunk stream carrying payload, and
+// returns it with the body key and IV it chose.
+func vmessTestRequest(id [16]byte, host string, port uint16, payload []byte) (message, bodyKey, bodyIV []byte) {
+    cmdKey := md5.Sum(append(id[:], "c48619fe-8f02-49e0-b9e9-edf763e17e21"...))
+    bodyKey, bodyIV = make([]byte, 16), make([]byte, 16)
+    for i := range bodyKey {
+        bodyKey[i], bodyIV[i] = byte(i), byte(16+i)
+    }
+
+    header := append([]byte{1}, bodyIV...)
+    header = append(header, bodyKey...)
+    header = append(header, 0x42, vmessOptionChunkStream, vmessSecurityAES128GCM, 0, commandTCP)
+    header = binary.BigEndian.AppendUint16(header, port)
+    if ip := net.ParseIP(host).To4(); ip != nil {
+        header = append(append(header, 1), ip...)
+    } else {
+        header = append(append(header, 2, byte(len(host))), host...)
+    }
+    sum := fnv.New32a()
+    sum.Write(header)
+    header = sum.Sum(header)
+
+    var authID [vmessAuthIDLen]byte
+    binary.BigEndian.PutUint64(authID[:], uint64(time.Now().Unix()))
+    copy(authID[8:12], bodyIV)
+    binary.BigEndian.PutUint32(authID[12:], crc32.ChecksumIEEE(authID[:12]))
+    block, _ := aes.NewCipher(vmessKDF(cmdKey[:], "AES Auth ID Encryption")[:16])
+    block.Encrypt(authID[:], authID[:])
+
+    nonce := "8 nonces"
+    message = append([]byte(nil), authID[:]...)
+    message = newGCM(vmessKDF(cmdKey[:], "VMess Header AEAD Key_Length", string(authID[:]), nonce)[:16]).Seal(message,
+        vmessKDF(cmdKey[:], "VMess Header AEAD Nonce_Length", string(authID[:]), nonce)[:12],
+        binary.BigEndian.AppendUint16(nil, uint16(len(header))), authID[:])
+    message = append(message, nonce...)
+    message = newGCM(vmessKDF(cmdKey[:], "VMess Header AEAD Key", string(authID[:]), nonce)[:16]).Seal(message,
+        vmessKDF(cmdKey[:], "VMess Header AEAD Nonce", string(authID[:]), nonce)[:12],
+        header, authID[:])
+
+    chunk := newGCM(bodyKey).Seal(nil, append([]byte{0, 0}, bodyIV[2:12]...), payload, nil)
+    message = binary.BigEndian.AppendUint16(message, uint16(len(chunk)))
+    return append(message, chunk...), bodyKey, bodyIV
+}
+
+func TestParseVMessHeader(t *testing.T) {
+    // Version 1, body IV 00..0f, body key 10..1f, response auth 0x20, chunk
+    // stream, AES-128-GCM, TCP to example.com:443, then its FNV-1a sum.
+    header, _ := hex.DecodeString("01000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+        "200103000101bb020b6578616d706c652e636f6d537e98cd")
+    req, err := parseVMessHeader(header)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if req.host != "example.com" || req.port != 443 || req.command != commandTCP ||
+        req.security != vmessSecurityAES128GCM || req.respAuth != 0x20 || req.bodyKey[0] != 0x10 {
+        t.Errorf("got %+v", req)
+    }
+
+    header[len(header)-1] ^= 1
+    if _, err := parseVMessHeader(header); err == nil {
+        t.Error("header with a bad checksum accepted")
+    }
+}
+
+func TestVMess(t *testing.T) {
+    setVar(t, &vmessPath, "/vmess")
+    setVar(t, &vmessUsers, newVMessUsers(users))
+    srv := newTestServer(t)
+    port := tcpEcho(t)
+    logs := captureLogs(t)
+
+    request, bodyKey, bodyIV := vmessTestRequest(testUser, "127.0.0.1", port, []byte("ping"))
+    ws := dialProxy(t, srv, "/vmess")
+    if err := ws.WriteMessage(websocket.BinaryMessage, request); err != nil {
+        t.Fatal(err)
+    }
+
+    respKey, respIV := sha256.Sum256(bodyKey), sha256.Sum256(bodyIV)
+    _, message, err := ws.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    header, err := newGCM(vmessKDF(respKey[:16], "AEAD Resp Header Key")[:16]).Open(nil,
+        vmessKDF(respIV[:16], "AEAD Resp Header IV")[:12], message[18:], nil)
+    if err != nil || header[0] != 0x42 {
+        t.Fatalf("response header %x, %v", header, err)
+    }
+
+    _, message, err = ws.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    echo, err := newGCM(respKey[:16]).Open(nil, append([]byte{0, 0}, respIV[2:12]...), message[2:], nil)
+    if err != nil || string(echo) != "ping" {
+        t.Errorf("got %q, %v", echo, err)
+    }
+    record := logs.find("Connection details")
+    if record == nil || record["host"] != "127.0.0.1" || record["port"] != float64(port) || record["protocol"] != "vmess" {
+        t.Errorf("logged %v", record)
+    }
+
+    // The same request again is a replay.
+    ws = dialProxy(t, srv, "/vmess")
+    ws.WriteMessage(websocket.BinaryMessage, request)
+    if _, _, err := ws.ReadMessage(); err == nil {
+        t.Error("replayed request accepted")
+    }
+}